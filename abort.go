@@ -0,0 +1,44 @@
+package ftp
+
+// The result of reading a command in the background.
+type readResult struct {
+	cmd *Command
+	err error
+}
+
+// Read the next command from the control connection, or receive it if it is
+// being read in the background.
+func (s *Session) read() (*Command, error) {
+	if s.next == nil {
+		cmd := new(Command)
+		err := cmd.Decode(&s.conn.Reader)
+		return cmd, err
+	}
+	r := <-s.next
+	s.next = nil
+	return r.cmd, r.err
+}
+
+// Start reading the next command in the background, if not already, and
+// return the channel receiving it. The result is put back if received other
+// than by read.
+func (s *Session) readAhead() chan readResult {
+	if s.next == nil {
+		next := make(chan readResult, 1)
+		r := &s.conn.Reader // s.conn is cleared by Close.
+		go func() {
+			cmd := new(Command)
+			err := cmd.Decode(r)
+			next <- readResult{cmd, err}
+		}()
+		s.next = next
+	}
+	return s.next
+}
+
+// ABOR closes the data connection. A transfer it interrupted has already
+// been replied to with 426.
+func (s *fileSession) handleABOR(c *Command) error {
+	s.AbortData()
+	return s.Reply(226, "Abort successful.")
+}
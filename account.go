@@ -0,0 +1,75 @@
+package ftp
+
+import "errors"
+
+// Reasons for refusing a login, passed to FileHandler.LoginRefused.
+var (
+	ErrLoginIncorrect  = errors.New("user name or password incorrect")
+	ErrAccountExpired  = errors.New("account expired")
+	ErrPasswordExpired = errors.New("password expired")
+	ErrOutsideWindow   = errors.New("login outside allowed windows")
+	ErrLoggedIn        = errors.New("user logged in to another session")
+)
+
+// Check whether the session's account may log in now.
+func (s *fileSession) checkAccount() error {
+	a := s.Account
+	now := s.Server.now()
+	switch {
+	case !a.Expires.IsZero() && !now.Before(a.Expires):
+		return ErrAccountExpired
+	case a.PasswordExpired:
+		return ErrPasswordExpired
+	case len(a.Windows) > 0 && windowCloses(a.Windows, now).IsZero():
+		return ErrOutsideWindow
+	}
+	return nil
+}
+
+// Refuse a login for the reason given by err.
+func (s *fileSession) refuseLogin(err error) error {
+	if s.LoginRefused != nil {
+		s.LoginRefused(s.Session, err)
+	}
+	s.User, s.Account = "", nil
+	switch err {
+	case ErrLoginIncorrect:
+		s.Server.recordLogin(s.Addr, false)
+		return s.Reply(430, "Invalid user name or password.")
+	case ErrAccountExpired:
+		return s.Reply(530, "Account expired.")
+	case ErrPasswordExpired:
+		return s.Reply(530, "Password expired; change it to log in.")
+	case ErrLoggedIn:
+		return s.Reply(530, "Already logged in to another session.")
+	}
+	return s.Reply(530, "Login not allowed at this time.")
+}
+
+// A Takeover is a policy for a user logging in while already logged in.
+type Takeover int
+
+const (
+	// TakeoverDefault defers to the FileHandler's policy, or allows both
+	// sessions.
+	TakeoverDefault Takeover = iota
+
+	// TakeoverAllow allows both sessions.
+	TakeoverAllow
+
+	// TakeoverReject refuses the new login.
+	TakeoverReject
+
+	// TakeoverKick closes the user's other sessions at once, as for
+	// Server.Kick. This suits clients that reconnect after crashing and
+	// would otherwise be held off by their dead sessions.
+	TakeoverKick
+)
+
+// Return the takeover policy for the session's user.
+func (s *fileSession) takeover() Takeover {
+	if s.Account != nil && s.Account.Takeover != TakeoverDefault {
+		return s.Account.Takeover
+	}
+	return s.Takeover
+}
@@ -0,0 +1,205 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Admin is a Handler for managing a live Server with any FTP client. Serve
+// it from a separate Server, ideally with TLS and on a private address. After
+// login, it provides these SITE commands:
+//
+//	SITE WHO                  List sessions in progress.
+//	SITE KICK <id>            Close a session at once.
+//	SITE LIMIT [class rate]   Show or set bandwidth limits; class * is global.
+//	SITE RELOAD               Call Reload.
+//	SITE MAINT [mode [msg]]   Show or set maintenance mode: ON, RO or OFF.
+//	SITE READONLY [ON [msg]]  Show or set read-only mode; OFF clears it.
+type Admin struct {
+	Server     *Server      // Server managed.
+	Authorizer Authorizer   // Authorizer for operators. If nil, logins are refused.
+	Reload     func() error // Reload configuration, if set.
+
+	once sync.Once
+	h    *FileHandler
+}
+
+var _ Handler = (*Admin)(nil)
+
+// Handle implements Handler.
+func (a *Admin) Handle(s *Session) error {
+	a.once.Do(func() {
+		auth := a.Authorizer
+		if auth == nil {
+			auth = denyAuth{}
+		}
+		site := map[string]*Extension{
+			"WHO":      {Handle: a.handleWHO, Help: "SITE WHO"},
+			"KICK":     {Handle: a.handleKICK, Help: "SITE KICK <sp> session-id"},
+			"LIMIT":    {Handle: a.handleLIMIT, Help: "SITE LIMIT [<sp> class <sp> bytes-per-second]"},
+			"MAINT":    {Handle: a.handleMAINT, Help: "SITE MAINT [<sp> ON|RO|OFF [<sp> message]]"},
+			"READONLY": {Handle: a.handleREADONLY, Help: "SITE READONLY [<sp> ON|OFF [<sp> message]]"},
+		}
+		if a.Reload != nil {
+			site["RELOAD"] = &Extension{Handle: a.handleRELOAD, Help: "SITE RELOAD"}
+		}
+		a.h = &FileHandler{Authorizer: auth, FileSystem: emptyFS{}, Site: site}
+	})
+	return a.h.Handle(s)
+}
+
+func (a *Admin) handleWHO(s *Session, c *Command) error {
+	msg := []string{"Sessions:"}
+	for _, si := range a.Server.Sessions() {
+		user := si.User
+		if user == "" {
+			user = "-"
+		}
+		var addr string
+		if si.Addr != nil {
+			addr = si.Addr.String()
+		}
+		line := fmt.Sprintf("%s %s %s since %s", si.ID, user, addr, si.Start.UTC().Format(time.RFC3339))
+		if si.Cmd != "" {
+			line += fmt.Sprintf(" %s (%d bytes)", si.Cmd, si.Transferred)
+		}
+		msg = append(msg, line)
+	}
+	msg = append(msg, "End.")
+	return s.ReplyLines(200, msg)
+}
+
+func (a *Admin) handleKICK(s *Session, c *Command) error {
+	if c.Msg == "" {
+		return s.Reply(501, "A session ID is required.")
+	}
+	if !a.Server.Kick(c.Msg) {
+		return s.Reply(550, "No such session.")
+	}
+	return s.Reply(200, "Session closed.")
+}
+
+func (a *Admin) handleLIMIT(s *Session, c *Command) error {
+	if c.Msg == "" {
+		msg := []string{"Limits in bytes per second:", "* " + formatRate(a.Server.classRate(""))}
+		for _, class := range a.Server.rateClasses() {
+			msg = append(msg, class+" "+formatRate(a.Server.classRate(class)))
+		}
+		msg = append(msg, "End.")
+		return s.ReplyLines(200, msg)
+	}
+	args := c.Args()
+	if len(args) != 2 {
+		return s.Reply(501, "Usage: SITE LIMIT class bytes-per-second")
+	}
+	rate, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return s.Reply(501, "Invalid rate.")
+	}
+	class := args[0]
+	if class == "*" {
+		class = ""
+	}
+	a.Server.SetRate(class, rate)
+	return s.Reply(200, "Limit set.")
+}
+
+func (a *Admin) handleMAINT(s *Session, c *Command) error {
+	if c.Msg == "" {
+		m, ok := a.Server.InMaintenance()
+		if !ok {
+			return s.Reply(200, "Not in maintenance.")
+		} else if m.ReadOnly {
+			return s.ReplyString(200, "Read-only maintenance: "+m.message())
+		}
+		return s.ReplyString(200, "Maintenance: "+m.message())
+	}
+	args := strings.SplitN(c.Msg, " ", 2)
+	m := Maintenance{}
+	if len(args) == 2 {
+		m.Message = args[1]
+	}
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+	case "RO":
+		m.ReadOnly = true
+	case "OFF":
+		a.Server.EndMaintenance()
+		return s.Reply(200, "Maintenance ended.")
+	default:
+		return s.Reply(501, "Usage: SITE MAINT ON|RO|OFF [message]")
+	}
+	a.Server.StartMaintenance(m)
+	return s.Reply(200, "Maintenance started.")
+}
+
+func (a *Admin) handleREADONLY(s *Session, c *Command) error {
+	if c.Msg == "" {
+		if msg, ok := a.Server.ReadOnly(); ok {
+			return s.ReplyString(200, "Read-only: "+msg)
+		}
+		return s.Reply(200, "Not read-only.")
+	}
+	args := strings.SplitN(c.Msg, " ", 2)
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		var msg string
+		if len(args) == 2 {
+			msg = args[1]
+		}
+		a.Server.SetReadOnly(msg)
+		return s.Reply(200, "Server is read-only.")
+	case "OFF":
+		a.Server.ClearReadOnly()
+		return s.Reply(200, "Server is writable.")
+	}
+	return s.Reply(501, "Usage: SITE READONLY ON|OFF [message]")
+}
+
+func (a *Admin) handleRELOAD(s *Session, c *Command) error {
+	if err := a.Reload(); err != nil {
+		return s.ReplyString(550, "Reload failed: "+err.Error())
+	}
+	return s.Reply(200, "Reloaded.")
+}
+
+// Format a rate for SITE LIMIT.
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(rate, 10)
+}
+
+// A denyAuth is an Authorizer refusing all logins.
+type denyAuth struct{}
+
+func (denyAuth) Authorize(user, pass string) (bool, error) {
+	return false, nil
+}
+
+// An emptyFS is a read-only FileSystem with an empty root directory.
+type emptyFS struct{}
+
+func (emptyFS) Stat(p string) (os.FileInfo, error) {
+	if p != "/" {
+		return nil, os.ErrNotExist
+	}
+	return &stat{name: "/", mode: os.ModeDir | 0555}, nil
+}
+
+func (fs emptyFS) Open(p string) (File, error) {
+	if _, err := fs.Stat(p); err != nil {
+		return nil, err
+	}
+	return &dirFile{}, nil
+}
+
+func (emptyFS) Create(p string) (File, error) { return nil, os.ErrPermission }
+func (emptyFS) Mkdir(p string) error          { return os.ErrPermission }
+func (emptyFS) Remove(p string) error         { return os.ErrPermission }
+func (emptyFS) Rename(old, new string) error  { return os.ErrPermission }
@@ -0,0 +1,75 @@
+package ftp
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// An AuditRecord describes a command and its outcome.
+type AuditRecord struct {
+	Time     time.Time     `json:"time"`     // When the command was received.
+	Session  string        `json:"session"`  // Session ID.
+	User     string        `json:"user"`     // User, if logged in or given.
+	Addr     string        `json:"addr"`     // Address of the client.
+	Cmd      string        `json:"cmd"`      // Command name.
+	Arg      string        `json:"arg"`      // Argument, hidden for PASS.
+	Path     string        `json:"path"`     // Absolute path of the argument, if a path.
+	Code     int           `json:"code"`     // Final reply code.
+	Duration time.Duration `json:"duration"` // Time until the final reply.
+	Bytes    int64         `json:"bytes"`    // Bytes of file data transferred.
+}
+
+// An Auditor receives an AuditRecord for every command a server replies to.
+// Audit is called from session goroutines, so it must be safe for concurrent
+// use, and it delays the session until it returns.
+type Auditor interface {
+	Audit(r *AuditRecord)
+}
+
+// AuditFunc is an Auditor calling a function.
+type AuditFunc func(r *AuditRecord)
+
+// Audit implements Auditor.
+func (f AuditFunc) Audit(r *AuditRecord) { f(r) }
+
+// NewAuditWriter returns an Auditor writing records to w as lines of JSON.
+// Writes are serialized, so w may be a file or a *syslog.Writer.
+func NewAuditWriter(w io.Writer) Auditor {
+	return &auditWriter{w: w}
+}
+
+type auditWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (a *auditWriter) Audit(r *AuditRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(append(b, '\n'))
+}
+
+// Send the audit record for the current command, replied to with code.
+func (s *Session) audit(code int) {
+	if s.Server.Auditor == nil || s.cmd == nil {
+		return
+	}
+	s.Server.Auditor.Audit(&AuditRecord{
+		Time:     s.start,
+		Session:  s.ID,
+		User:     s.Server.Redact.user(s.User),
+		Addr:     s.logAddr(),
+		Cmd:      s.cmd.Cmd,
+		Arg:      s.logArg(s.cmd),
+		Path:     s.logPath(s.cmd),
+		Code:     code,
+		Duration: time.Since(s.start),
+		Bytes:    s.xfer,
+	})
+}
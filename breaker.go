@@ -0,0 +1,217 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("file system circuit breaker is open")
+
+// A Breaker stops FileSystem calls after repeated failures, so that sessions
+// fail fast while a backend is down rather than piling up waiting on it. New
+// sessions are refused with a 421 reply and commands fail with 451 until the
+// cooldown passes, after which a single trial call is let through. If it
+// succeeds, the breaker closes again.
+type Breaker struct {
+	Threshold int           // Consecutive failures opening the breaker, or 5 if 0.
+	Cooldown  time.Duration // Time before a trial call, or 10 seconds if 0.
+
+	// OnChange, if set, is called whenever the breaker opens or closes, e.g.
+	// to alert an operator.
+	OnChange func(open bool)
+
+	mu       sync.Mutex
+	failures int       // Consecutive failures.
+	open     bool      // Whether the breaker is open.
+	until    time.Time // When the next trial may be made.
+	trial    bool      // Whether a trial call is in progress.
+}
+
+// Return whether the breaker is open and cooling down.
+func (b *Breaker) tripped() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open && time.Now().Before(b.until)
+}
+
+// Return whether a call may be made.
+func (b *Breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open:
+		return true
+	case b.trial || time.Now().Before(b.until):
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Record the outcome of a call. Errors about particular files don't count as
+// failures of the backend.
+func (b *Breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil && !os.IsNotExist(err) && !os.IsPermission(err) &&
+		!os.IsExist(err) && err != ErrQuotaExceeded && err != context.Canceled &&
+		err != errNotSupported && isOffline(err) == nil
+	b.mu.Lock()
+	was := b.open
+	b.trial = false
+	if failed {
+		b.failures++
+		threshold := b.Threshold
+		if threshold <= 0 {
+			threshold = 5
+		}
+		if b.open || b.failures >= threshold {
+			cooldown := b.Cooldown
+			if cooldown <= 0 {
+				cooldown = 10 * time.Second
+			}
+			b.open, b.until = true, time.Now().Add(cooldown)
+		}
+	} else {
+		b.failures, b.open = 0, false
+	}
+	open := b.open
+	b.mu.Unlock()
+	if open != was && b.OnChange != nil {
+		b.OnChange(open)
+	}
+}
+
+// A breakerFS is a FileSystem guarded by a Breaker, including the optional
+// interfaces it forwards.
+type breakerFS struct {
+	wrappedFS
+	b *Breaker
+}
+
+func (f *breakerFS) Create(path string) (File, error) {
+	if !f.b.allow() {
+		return nil, errBreakerOpen
+	}
+	file, err := f.FileSystem.Create(path)
+	f.b.record(err)
+	return file, err
+}
+
+func (f *breakerFS) Mkdir(path string) error {
+	if !f.b.allow() {
+		return errBreakerOpen
+	}
+	err := f.FileSystem.Mkdir(path)
+	f.b.record(err)
+	return err
+}
+
+func (f *breakerFS) Open(path string) (File, error) {
+	if !f.b.allow() {
+		return nil, errBreakerOpen
+	}
+	file, err := f.FileSystem.Open(path)
+	f.b.record(err)
+	return file, err
+}
+
+func (f *breakerFS) Remove(path string) error {
+	if !f.b.allow() {
+		return errBreakerOpen
+	}
+	err := f.FileSystem.Remove(path)
+	f.b.record(err)
+	return err
+}
+
+func (f *breakerFS) Rename(old, new string) error {
+	if !f.b.allow() {
+		return errBreakerOpen
+	}
+	err := f.FileSystem.Rename(old, new)
+	f.b.record(err)
+	return err
+}
+
+func (f *breakerFS) Stat(path string) (os.FileInfo, error) {
+	if !f.b.allow() {
+		return nil, errBreakerOpen
+	}
+	fi, err := f.FileSystem.Stat(path)
+	f.b.record(err)
+	return fi, err
+}
+
+func (f *breakerFS) CreateAt(path string, off int64) (File, error) {
+	if !f.b.allow() {
+		return nil, errBreakerOpen
+	}
+	file, err := f.wrappedFS.CreateAt(path, off)
+	f.b.record(err)
+	return file, err
+}
+
+func (f *breakerFS) OpenAt(path string, off int64) (File, error) {
+	if !f.b.allow() {
+		return nil, errBreakerOpen
+	}
+	file, err := f.wrappedFS.OpenAt(path, off)
+	f.b.record(err)
+	return file, err
+}
+
+func (f *breakerFS) OpenStat(path string) (File, os.FileInfo, error) {
+	if !f.b.allow() {
+		return nil, nil, errBreakerOpen
+	}
+	file, fi, err := f.wrappedFS.OpenStat(path)
+	f.b.record(err)
+	return file, fi, err
+}
+
+func (f *breakerFS) Quota(user string) (int64, int64, error) {
+	if !f.b.allow() {
+		return 0, 0, errBreakerOpen
+	}
+	used, limit, err := f.wrappedFS.Quota(user)
+	f.b.record(err)
+	return used, limit, err
+}
+
+func (f *breakerFS) Allocate(size int64) error {
+	if !f.b.allow() {
+		return errBreakerOpen
+	}
+	err := f.wrappedFS.Allocate(size)
+	f.b.record(err)
+	return err
+}
+
+func (f *breakerFS) DirSize(path string) (int64, error) {
+	if !f.b.allow() {
+		return 0, errBreakerOpen
+	}
+	size, err := f.wrappedFS.DirSize(path)
+	f.b.record(err)
+	return size, err
+}
+
+func (f *breakerFS) Chtimes(path string, atime, mtime time.Time) error {
+	if !f.b.allow() {
+		return errBreakerOpen
+	}
+	err := f.wrappedFS.Chtimes(path, atime, mtime)
+	f.b.record(err)
+	return err
+}
@@ -0,0 +1,255 @@
+package ftp
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// A listCache holds recent directory listings, keyed by cleaned path.
+type listCache struct {
+	mu  sync.Mutex
+	m   map[string]listEntry
+	gen uint64 // Incremented by every invalidation.
+}
+
+type listEntry struct {
+	list    []os.FileInfo
+	expires time.Time
+}
+
+// Return the cached listing of dir, if it is fresh.
+func (c *listCache) get(dir string) ([]os.FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[dir]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return append([]os.FileInfo(nil), e.list...), true
+}
+
+// Store the listing of dir for ttl, unless the cache was invalidated since
+// gen.
+func (c *listCache) put(dir string, list []os.FileInfo, gen uint64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.m == nil {
+		c.m = make(map[string]listEntry)
+	}
+	now := time.Now()
+	for k, e := range c.m {
+		if now.After(e.expires) {
+			delete(c.m, k)
+		}
+	}
+	c.m[dir] = listEntry{list, now.Add(ttl)}
+}
+
+// Return the current generation, to be passed to put.
+func (c *listCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Drop the listings of the given paths and of their parent directories.
+func (c *listCache) invalidate(paths ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		delete(c.m, p)
+		delete(c.m, path.Dir(p))
+	}
+}
+
+// A listCacheFS is a FileSystem that caches directory listings.
+type listCacheFS struct {
+	wrappedFS
+	cache *listCache
+	ttl   time.Duration
+}
+
+func (fs *listCacheFS) Create(p string) (File, error) {
+	return fs.CreateAt(p, 0)
+}
+
+func (fs *listCacheFS) CreateAt(p string, off int64) (File, error) {
+	fs.cache.invalidate(p)
+	f, err := CreateAt(fs.FileSystem, p, off)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingFile{f, func() { fs.cache.invalidate(p) }}, nil
+}
+
+func (fs *listCacheFS) Mkdir(p string) error {
+	defer fs.cache.invalidate(p)
+	return fs.FileSystem.Mkdir(p)
+}
+
+func (fs *listCacheFS) Remove(p string) error {
+	defer fs.cache.invalidate(p)
+	return fs.FileSystem.Remove(p)
+}
+
+func (fs *listCacheFS) Rename(old, new string) error {
+	defer fs.cache.invalidate(old, new)
+	return fs.FileSystem.Rename(old, new)
+}
+
+func (fs *listCacheFS) Chtimes(p string, atime, mtime time.Time) error {
+	defer fs.cache.invalidate(p)
+	return fs.wrappedFS.Chtimes(p, atime, mtime)
+}
+
+func (fs *listCacheFS) Open(p string) (File, error) {
+	dir := path.Clean("/" + p)
+	if list, ok := fs.cache.get(dir); ok {
+		return &dirFile{list: list}, nil
+	}
+	gen := fs.cache.generation()
+	f, err := fs.FileSystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingFile{File: f, fs: fs, dir: dir, gen: gen}, nil
+}
+
+// A cachingFile records a complete listing read from it in a listCache.
+type cachingFile struct {
+	File
+	fs   *listCacheFS // Nil once the listing is complete or failed.
+	dir  string
+	gen  uint64
+	list []os.FileInfo
+}
+
+// Readdir implements File.
+func (f *cachingFile) Readdir(n int) ([]os.FileInfo, error) {
+	list, err := f.File.Readdir(n)
+	if f.fs == nil {
+		return list, err
+	}
+	f.list = append(f.list, list...)
+	switch {
+	case n <= 0 && err == nil, n > 0 && err == io.EOF:
+		f.fs.cache.put(f.dir, f.list, f.gen, f.fs.ttl)
+		f.fs, f.list = nil, nil
+	case err != nil:
+		f.fs, f.list = nil, nil
+	}
+	return list, err
+}
+
+// An invalidatingFile invalidates cached information again once written, so
+// that anything read during an upload isn't kept.
+type invalidatingFile struct {
+	File
+	invalidate func()
+}
+
+func (f *invalidatingFile) Close() error {
+	defer f.invalidate()
+	return f.File.Close()
+}
+
+// Sync syncs the file, if it can be synced, for Durability and journal
+// checkpoints.
+func (f *invalidatingFile) Sync() error {
+	return syncFile(f.File)
+}
+
+// Truncate truncates the file, if it can be truncated, for sparse restarts.
+func (f *invalidatingFile) Truncate(size int64) error {
+	return extend(f.File, size)
+}
+
+// CloseWithError is like Close, for uploads that failed.
+func (f *invalidatingFile) CloseWithError(err error) error {
+	defer f.invalidate()
+	return closeFailed(f.File, err)
+}
+
+// Maximum number of entries in a session's stat cache.
+const statCacheSize = 64
+
+// A statCacheFS is a FileSystem that caches Stat results for one session.
+type statCacheFS struct {
+	wrappedFS
+	ttl time.Duration
+	m   map[string]statEntry
+}
+
+type statEntry struct {
+	fi      os.FileInfo
+	expires time.Time
+}
+
+func (fs *statCacheFS) Stat(p string) (os.FileInfo, error) {
+	key := path.Clean("/" + p)
+	if e, ok := fs.m[key]; ok && time.Now().Before(e.expires) {
+		return e.fi, nil
+	}
+	fi, err := fs.FileSystem.Stat(p)
+	if err != nil {
+		delete(fs.m, key)
+		return nil, err
+	}
+	if fs.m == nil || len(fs.m) >= statCacheSize {
+		fs.m = make(map[string]statEntry)
+	}
+	fs.m[key] = statEntry{fi, time.Now().Add(fs.ttl)}
+	return fi, nil
+}
+
+func (fs *statCacheFS) Create(p string) (File, error) {
+	return fs.CreateAt(p, 0)
+}
+
+func (fs *statCacheFS) CreateAt(p string, off int64) (File, error) {
+	fs.invalidate(p)
+	f, err := CreateAt(fs.FileSystem, p, off)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingFile{f, func() { fs.invalidate(p) }}, nil
+}
+
+func (fs *statCacheFS) Mkdir(p string) error {
+	defer fs.invalidate(p)
+	return fs.FileSystem.Mkdir(p)
+}
+
+// Removing or renaming a directory affects everything below it, so these
+// drop the whole cache.
+func (fs *statCacheFS) Remove(p string) error {
+	defer fs.invalidate("")
+	return fs.FileSystem.Remove(p)
+}
+
+func (fs *statCacheFS) Rename(old, new string) error {
+	defer fs.invalidate("")
+	return fs.FileSystem.Rename(old, new)
+}
+
+func (fs *statCacheFS) Chtimes(p string, atime, mtime time.Time) error {
+	defer fs.invalidate(p)
+	return fs.wrappedFS.Chtimes(p, atime, mtime)
+}
+
+// Drop the cached entry for p, or all entries if p is "".
+func (fs *statCacheFS) invalidate(p string) {
+	if p == "" {
+		fs.m = nil
+		return
+	}
+	delete(fs.m, path.Clean("/"+p))
+}
@@ -10,8 +10,9 @@ var errEmptyCmd = errors.New("got empty command")
 
 // A Command read from or written to a control channel.
 type Command struct {
-	Cmd string // Cmd is the command type.
+	Cmd string // Cmd is the command type, in upper case.
 	Msg string // Msg is the full message.
+	Raw string // Raw is the line as it was read, if decoded.
 }
 
 // Encode c into w.
@@ -28,6 +29,11 @@ func (c *Command) Decode(r *textproto.Reader) error {
 	if err != nil {
 		return err
 	}
+	c.Raw = line
+	// Clients send Telnet IP and Synch sequences before ABOR.
+	for len(line) > 0 && (line[0] == 0xff || line[0] == 0xf4 || line[0] == 0xf2) {
+		line = line[1:]
+	}
 	s := strings.SplitN(line, " ", 2)
 	if s[0] == "" {
 		return errEmptyCmd
@@ -47,6 +53,41 @@ func (c *Command) Args() []string {
 	return strings.Split(c.Msg, " ")
 }
 
+// Sub returns the subcommand given as the message of c, as for SITE and OPTS.
+// The subcommand's Raw is the message of c.
+func (c *Command) Sub() *Command {
+	s := strings.SplitN(c.Msg, " ", 2)
+	sub := &Command{Cmd: strings.ToUpper(s[0]), Raw: c.Msg}
+	if len(s) > 1 {
+		sub.Msg = s[1]
+	}
+	return sub
+}
+
+// Facts parses a message starting with a list of facts, as in
+// "modify=20160102150405;UNIX.mode=0644; name" for MFF or "type;size;" for
+// OPTS MLST. It returns the facts, with names in lower case, and the rest
+// of the message. If the message has no facts, it returns nil and the whole
+// message.
+func (c *Command) Facts() (map[string]string, string) {
+	list, rest := c.Msg, ""
+	if i := strings.IndexByte(c.Msg, ' '); i >= 0 {
+		list, rest = c.Msg[:i], c.Msg[i+1:]
+	}
+	if !strings.HasSuffix(list, ";") {
+		return nil, c.Msg
+	}
+	facts := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimSuffix(list, ";"), ";") {
+		name, value := f, ""
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name, value = f[:i], f[i+1:]
+		}
+		facts[strings.ToLower(name)] = value
+	}
+	return facts, rest
+}
+
 // A Reply read from or written to a control channel.
 type Reply struct {
 	Code int
@@ -55,6 +96,12 @@ type Reply struct {
 
 // Encode r into w.
 func (r *Reply) Encode(w *textproto.Writer) error {
+	return r.encode(w, false)
+}
+
+// Encode r into w. If coded is true, continuation lines are prefixed with the
+// reply code rather than a space.
+func (r *Reply) encode(w *textproto.Writer, coded bool) error {
 	lines := r.Lines()
 	last := len(lines) - 1
 	if len(lines) > 1 {
@@ -62,7 +109,13 @@ func (r *Reply) Encode(w *textproto.Writer) error {
 			return err
 		}
 		for _, line := range lines[1:last] {
-			if err := w.PrintfLine(" %s", line); err != nil {
+			var err error
+			if coded {
+				err = w.PrintfLine("%03d-%s", r.Code, line)
+			} else {
+				err = w.PrintfLine(" %s", line)
+			}
+			if err != nil {
 				return err
 			}
 		}
@@ -21,10 +21,10 @@ type Client struct {
 	Listener Listener // Listener for incoming connections.
 	Debug    bool     // Debug prints control channel traffic.
 
-	*context
+	*clientState
 }
 
-type context struct {
+type clientState struct {
 	laddr net.TCPAddr
 	raddr net.TCPAddr
 	conn  *textproto.Conn
@@ -47,14 +47,14 @@ func (c *Client) Connect() error {
 	if c.Addr == "" {
 		return errors.New("no addr to dial")
 	}
-	if c.context != nil {
+	if c.clientState != nil {
 		c.Close()
 	}
 	conn, err := c.dial(c.Addr)
 	if err != nil {
 		return err
 	}
-	c.context = &context{
+	c.clientState = &clientState{
 		laddr: *conn.LocalAddr().(*net.TCPAddr),
 		raddr: *conn.RemoteAddr().(*net.TCPAddr),
 		conn:  textproto.NewConn(conn),
@@ -68,7 +68,7 @@ func (c *Client) Connect() error {
 }
 
 func (c *Client) connect() error {
-	if c.context != nil {
+	if c.clientState != nil {
 		return nil
 	}
 	return c.Connect()
@@ -296,7 +296,7 @@ func (c *Client) Close() error {
 		return errors.New("not connected")
 	}
 	err := c.conn.Close()
-	c.context = nil
+	c.clientState = nil
 	return err
 }
 
@@ -307,6 +307,7 @@ type clientFile struct {
 	seek   int64
 	closed bool
 	prelim bool
+	listed bool
 }
 
 // Seek implements File.
@@ -342,6 +343,10 @@ func (f *clientFile) Write(b []byte) (n int, err error) {
 
 // Readdir implements File.
 func (f *clientFile) Readdir(n int) (fi []os.FileInfo, err error) {
+	if f.listed && n > 0 {
+		return nil, io.EOF
+	}
+	f.listed = true
 	if err := f.start("NLST", false); err != nil {
 		return nil, err
 	}
@@ -401,7 +406,7 @@ func (f *clientFile) readdir(n int) (fi []os.FileInfo, err error) {
 			return fi, nil
 		}
 		if line != "" {
-			fi = append(fi, &stat{name: line})
+			fi = append(fi, &stat{name: path.Base(line)})
 		}
 		if err == io.EOF {
 			return fi, nil
@@ -0,0 +1,139 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// A doneCode is the reply code for the successful completion of a command.
+type doneCode struct {
+	strict int // Code required by the RFCs.
+	compat int // Code used when not strict, if different.
+}
+
+// Reply codes for successful completion, keyed by command. Conformance fixes
+// belong here, with the previous code kept in compat if clients may rely on
+// it.
+var doneCodes = map[string]doneCode{
+	"APPE": {strict: 226},
+	"CDUP": {strict: 200, compat: 250},
+	"CWD":  {strict: 250},
+	"DELE": {strict: 250},
+	"EPRT": {strict: 200},
+	"LIST": {strict: 226},
+	"MKD":  {strict: 257},
+	"MLSD": {strict: 226},
+	"MODE": {strict: 200},
+	"NLST": {strict: 226},
+	"NOOP": {strict: 200},
+	"PORT": {strict: 200},
+	"PWD":  {strict: 257},
+	"QUIT": {strict: 221},
+	"RETR": {strict: 226},
+	"RMD":  {strict: 250},
+	"RNTO": {strict: 250},
+	"STOR": {strict: 226},
+	"STOU": {strict: 226},
+	"TYPE": {strict: 200},
+}
+
+// Commands that transfer data, which complete with 226.
+var transferCommands = map[string]bool{
+	"APPE": true, "LIST": true, "MLSD": true, "NLST": true, "RETR": true,
+	"STOR": true, "STOU": true,
+}
+
+// Reply to the successful completion of the current command with msg.
+func (s *fileSession) done(msg string) error {
+	return s.ReplyString(s.doneCode(s.cmd.Cmd), s.localize(msg))
+}
+
+// Return the reply code for the successful completion of cmd. Commands
+// missing from doneCodes, such as those of extensions reusing built-in
+// handlers, get 226 if they transfer data and 200 otherwise.
+func (s *fileSession) doneCode(cmd string) int {
+	c, ok := doneCodes[cmd]
+	if !ok && transferCommands[cmd] {
+		return 226
+	} else if !ok {
+		return 200
+	}
+	if c.compat != 0 && !s.Server.Strict {
+		return c.compat
+	}
+	return c.strict
+}
+
+// Errno names used as reason tokens for errors of the operating system.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EEXIST:       "EEXIST",
+	syscall.EISDIR:       "EISDIR",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.EROFS:        "EROFS",
+}
+
+// Return the reason token for a failure caused by err, for replies with
+// Server.ReasonCodes. Tokens are errno names where one fits, and must not
+// change once integrations may rely on them.
+func reasonCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case err == errIsDir:
+		return "EISDIR"
+	case err == errNotDir:
+		return "ENOTDIR"
+	case err == ErrQuotaExceeded:
+		return "EDQUOT"
+	case err == errMemoryLimit:
+		return "ENOMEM"
+	case err == errDirSizeLimit, err == errHashLimit:
+		return "EFBIG"
+	case err == ErrRestartRange:
+		return "ERANGE"
+	case err == ErrRestartASCII, err == errNotSupported:
+		return "ENOTSUP"
+	case err == os.ErrInvalid:
+		return "EINVAL"
+	case isUnavailable(err):
+		return "EAGAIN"
+	case isOffline(err) != nil:
+		return "EOFFLINE"
+	case isNotExist(err):
+		return "ENOENT"
+	case isPermission(err):
+		return "EACCES"
+	}
+	switch e := err.(type) {
+	case *journalError:
+		return "ERANGE"
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok && errnoNames[errno] != "" {
+		return errnoNames[errno]
+	}
+	return "EIO"
+}
+
+// Reply to a failure caused by err, as Reply does, appending the reason
+// token of err if the Server's ReasonCodes is set.
+func (s *fileSession) replyErr(code int, err error, format string, args ...interface{}) error {
+	r := reasonCode(err)
+	if r == "" || !s.Server.ReasonCodes {
+		return s.Reply(code, format, args...)
+	}
+	msg := s.localize(format)
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return s.ReplyString(code, msg+" ["+r+"]")
+}
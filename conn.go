@@ -92,7 +92,7 @@ func (c *Conn) listen() {
 
 func (c *Conn) accept() (net.Conn, error) {
 	c.m.Lock()
-	for c.active == nil || c.err == nil {
+	for c.active == nil && c.err == nil {
 		c.m.Wait()
 	}
 	conn, err := c.active, c.err
@@ -251,6 +251,65 @@ func (c *Conn) Close() (err error) {
 	return err
 }
 
+// CloseWrite flushes and shuts down the writing side of the connection where
+// supported, so that the peer sees the end of the data before the connection
+// is closed. This does nothing if nothing has been written.
+func (c *Conn) CloseWrite() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	var err error
+	walkConn(c.active, func(nc net.Conn) bool {
+		cw, ok := nc.(interface {
+			CloseWrite() error
+		})
+		if ok {
+			err = cw.CloseWrite()
+		}
+		return ok
+	})
+	return err
+}
+
+// Abort closes the connection abruptly, discarding buffered data and sending
+// a TCP reset where possible.
+func (c *Conn) Abort() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.active == nil {
+		return c.passive.Close()
+	}
+	walkConn(c.active, func(nc net.Conn) bool {
+		l, ok := nc.(interface {
+			SetLinger(int) error
+		})
+		if ok {
+			l.SetLinger(0)
+		}
+		return ok
+	})
+	return c.active.Close()
+}
+
+// Call f on c and on the connections it wraps, as returned by NetConn
+// methods, until f returns true.
+func walkConn(c net.Conn, f func(net.Conn) bool) {
+	for c != nil && !f(c) {
+		u, ok := c.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			return
+		}
+		c = u.NetConn()
+	}
+}
+
 // LocalAddr waits for a connection, then calls LocalAddr on it.
 func (c *Conn) LocalAddr() net.Addr {
 	conn, err := c.accept()
@@ -31,3 +31,14 @@ func (c *Context) CloseData() error {
 	c.Data = nil
 	return conn.Close()
 }
+
+// AbortData closes the data connection abruptly, as for ABOR, and sets it to
+// nil. If there is no data connection, this returns an error.
+func (c *Context) AbortData() error {
+	if c.Data == nil {
+		return errNoDataConn
+	}
+	conn := c.Data
+	c.Data = nil
+	return conn.Abort()
+}
@@ -0,0 +1,77 @@
+package ftp
+
+import (
+	"os"
+	"strings"
+)
+
+// A ControlPolicy says how a FileHandler treats control characters, such as
+// CR and LF, in file names. Sent as is, these corrupt listings and replies.
+type ControlPolicy int
+
+const (
+	// ControlReplace replaces control characters in listed names with '?',
+	// and rejects path arguments containing them.
+	ControlReplace ControlPolicy = iota
+
+	// ControlOmit omits names containing control characters from listings,
+	// and rejects path arguments containing them.
+	ControlOmit
+
+	// ControlAllow leaves names as they are. This is unsafe.
+	ControlAllow
+)
+
+// Return whether s contains control characters.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, isControl) >= 0
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// A controlFS is a FileSystem whose directory listings are made safe to send
+// according to a ControlPolicy.
+type controlFS struct {
+	wrappedFS
+	policy ControlPolicy
+}
+
+func (f *controlFS) Open(p string) (File, error) {
+	file, err := f.FileSystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &controlFile{file, f.policy}, nil
+}
+
+// A controlFile is a File whose Readdir applies a ControlPolicy.
+type controlFile struct {
+	File
+	policy ControlPolicy
+}
+
+// Readdir implements File.
+func (f *controlFile) Readdir(n int) ([]os.FileInfo, error) {
+	list, err := f.File.Readdir(n)
+	out := list[:0:0]
+	for _, fi := range list {
+		switch {
+		case !hasControl(fi.Name()):
+			out = append(out, fi)
+		case f.policy == ControlReplace:
+			name := strings.Map(func(r rune) rune {
+				if isControl(r) {
+					return '?'
+				}
+				return r
+			}, fi.Name())
+			out = append(out, &namedFileInfo{fi, name})
+		}
+	}
+	if n > 0 && len(out) == 0 && len(list) > 0 && err == nil {
+		return f.Readdir(n)
+	}
+	return out, err
+}
@@ -0,0 +1,77 @@
+package ftp
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default limit on the size of a directory message.
+const defaultDirMessageSize = 4096
+
+// A dirMessages caches directory messages, keyed by path.
+type dirMessages struct {
+	mu sync.Mutex
+	m  map[string]dirMessage
+}
+
+type dirMessage struct {
+	mod  time.Time
+	size int64
+	text string
+}
+
+// Maximum number of cached directory messages.
+const dirMessagesSize = 256
+
+// Return the message for dir, or "" if there is none. Messages are cached
+// until their file's size or modification time changes.
+func (s *fileSession) dirMessage(dir string) string {
+	if s.DirMessage == "" {
+		return ""
+	}
+	limit := s.DirMessageSize
+	if limit <= 0 {
+		limit = defaultDirMessageSize
+	}
+	p := path.Join(dir, s.DirMessage)
+	fi, err := s.Stat(p)
+	if err != nil || fi.IsDir() || fi.Size() > limit {
+		return ""
+	}
+	c := &s.messages
+	c.mu.Lock()
+	m, ok := c.m[p]
+	c.mu.Unlock()
+	if ok && m.mod.Equal(fi.ModTime()) && m.size == fi.Size() {
+		return m.text
+	}
+	f, err := s.Open(p)
+	if err != nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(f, limit))
+	f.Close()
+	if err != nil {
+		return ""
+	}
+	text := strings.TrimRight(strings.Replace(string(b), "\r", "", -1), "\n")
+	c.mu.Lock()
+	if c.m == nil || len(c.m) >= dirMessagesSize {
+		c.m = make(map[string]dirMessage)
+	}
+	c.m[p] = dirMessage{fi.ModTime(), fi.Size(), text}
+	c.mu.Unlock()
+	return text
+}
+
+// Reply to a change of directory, including its message.
+func (s *fileSession) replyCWD(dir string) error {
+	if msg := s.dirMessage(dir); msg != "" {
+		return s.done(msg + "\nDirectory successfully changed.")
+	}
+	return s.done("Directory successfully changed.")
+}
@@ -0,0 +1,49 @@
+package ftp
+
+import (
+	"errors"
+	"path"
+	"time"
+)
+
+var errDirSizeLimit = errors.New("directory size limit reached")
+
+// Return the cumulative size of the files below dir, walking it with the
+// session's FileSystem. Walking fails with errDirSizeLimit if it would go
+// deeper than the handler's DirSizeDepth or take longer than DirSizeTimeout.
+func (s *fileSession) walkSize(dir string) (int64, error) {
+	var deadline time.Time
+	if s.DirSizeTimeout > 0 {
+		deadline = time.Now().Add(s.DirSizeTimeout)
+	}
+	return s.walkSizeDepth(dir, 0, deadline)
+}
+
+func (s *fileSession) walkSizeDepth(dir string, depth int, deadline time.Time) (int64, error) {
+	if depth >= s.DirSizeDepth || !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, errDirSizeLimit
+	}
+	f, err := s.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	list, cost, err := readdir(f, s.Session)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer s.release(cost)
+	var size int64
+	for _, fi := range list {
+		if !fi.IsDir() {
+			size += fi.Size()
+			continue
+		}
+		n, err := s.walkSizeDepth(path.Join(dir, fi.Name()), depth+1, deadline)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
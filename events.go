@@ -0,0 +1,61 @@
+package ftp
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// An Event describes a completed upload, download, or deletion.
+type Event struct {
+	Type    string    `json:"type"`    // "upload", "download", or "delete".
+	Path    string    `json:"path"`    // Absolute path of the file.
+	User    string    `json:"user"`    // User who made the change.
+	Session string    `json:"session"` // Session ID.
+	Time    time.Time `json:"time"`    // When the command was received.
+	Bytes   int64     `json:"bytes"`   // Bytes transferred.
+}
+
+// A Publisher publishes messages to a topic of a message queue such as
+// Kafka, NATS, or SQS. Adapting a client to this is usually a few lines.
+// Publish is called from session goroutines, so it must be safe for
+// concurrent use, and should queue messages rather than wait for delivery.
+type Publisher interface {
+	Publish(topic string, key, value []byte) error
+}
+
+// Event types by command.
+var eventTypes = map[string]string{
+	"APPE": "upload",
+	"STOR": "upload",
+	"STOU": "upload",
+	"RETR": "download",
+	"DELE": "delete",
+	"RMD":  "delete",
+}
+
+// NewEventPublisher returns an Auditor publishing an Event as JSON to topic
+// for each successful upload, download, and deletion, keyed by path. Paths
+// and users are redacted as configured for the Server. Errors publishing
+// are passed to onError if it is non-nil.
+func NewEventPublisher(p Publisher, topic string, onError func(error)) Auditor {
+	return AuditFunc(func(r *AuditRecord) {
+		typ := eventTypes[r.Cmd]
+		if typ == "" || r.Code < 200 || r.Code >= 300 {
+			return
+		}
+		b, err := json.Marshal(&Event{
+			Type:    typ,
+			Path:    r.Path,
+			User:    r.User,
+			Session: r.Session,
+			Time:    r.Time,
+			Bytes:   r.Bytes,
+		})
+		if err == nil {
+			err = p.Publish(topic, []byte(r.Path), b)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+)
+
+var errFaultReset = errors.New("injected data connection reset")
+
+// A Fault is injected into matching commands to test client resilience. Each
+// command gets at most one fault, the first that matches.
+type Fault struct {
+	Cmd         string  // Cmd matches the command name, or any command if empty.
+	Path        string  // Path matches the absolute path argument with path.Match, if non-empty.
+	Probability float64 // Probability of injecting the fault, or always if 0.
+
+	Delay time.Duration // Delay before handling the command.
+
+	// Code replies instead of handling the command if non-zero. This is
+	// typically a 4xx code like 421, 450, or 451.
+	Code int
+	Msg  string
+
+	// ResetAfter resets the data connection of a transfer after this many
+	// bytes if positive.
+	ResetAfter int64
+
+	// TruncateAt ends a transfer normally after this many bytes if positive.
+	TruncateAt int64
+}
+
+// Whether f applies to c in s.
+func (f *Fault) match(s *fileSession, c *Command) bool {
+	if f.Cmd != "" && !strings.EqualFold(f.Cmd, c.Cmd) {
+		return false
+	}
+	if f.Path != "" {
+		if ok, _ := path.Match(f.Path, s.Path(c.Msg)); !ok || c.Msg == "" {
+			return false
+		}
+	}
+	return f.Probability <= 0 || rand.Float64() < f.Probability
+}
+
+// Inject any fault for c, returning whether the command has been handled.
+func (s *fileSession) injectFault(c *Command) (bool, error) {
+	s.fault = nil
+	for i := range s.Faults {
+		if f := &s.Faults[i]; f.match(s, c) {
+			s.fault = f
+			break
+		}
+	}
+	if s.fault == nil {
+		return false, nil
+	}
+	time.Sleep(s.fault.Delay)
+	if s.fault.Code == 0 {
+		return false, nil
+	}
+	msg := s.fault.Msg
+	if msg == "" {
+		msg = "Injected fault."
+	}
+	if s.Data != nil && c.Cmd != "PASV" && c.Cmd != "EPSV" {
+		s.CloseData()
+	}
+	return true, s.ReplyString(s.fault.Code, msg)
+}
+
+// Copy a transfer, applying any injected fault.
+func (s *fileSession) copyData(dst io.Writer, src io.Reader) (int64, error) {
+	f := s.fault
+	if f == nil {
+		return io.Copy(dst, src)
+	}
+	if f.TruncateAt > 0 {
+		src = io.LimitReader(src, f.TruncateAt)
+	}
+	if f.ResetAfter <= 0 {
+		return io.Copy(dst, src)
+	}
+	// The serving goroutine clears s.Data once the transfer ends.
+	data := s.Data
+	n, err := io.CopyN(dst, src, f.ResetAfter)
+	if err == nil {
+		data.Flush()
+		data.Abort()
+		err = errFaultReset
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
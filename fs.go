@@ -1,9 +1,12 @@
 package ftp
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
+	"time"
 )
 
 // FileSystem is the interface expected by a FileHandler. This type is intended
@@ -19,11 +22,268 @@ type FileSystem interface {
 	Stat(path string) (os.FileInfo, error) // Stat a file or directory.
 }
 
+// A ContextFileSystem is a FileSystem whose operations take a context, so
+// that backend calls can be cancelled. When a FileHandler's FileSystem also
+// implements this, these methods are used with the session's context, which
+// is cancelled when the session ends.
+type ContextFileSystem interface {
+	CreateContext(ctx context.Context, path string) (File, error)
+	MkdirContext(ctx context.Context, path string) error
+	OpenContext(ctx context.Context, path string) (File, error)
+	RemoveContext(ctx context.Context, path string) error
+	RenameContext(ctx context.Context, old, new string) error
+	StatContext(ctx context.Context, path string) (os.FileInfo, error)
+}
+
+// WithContext returns a ContextFileSystem for fs. If fs doesn't implement
+// ContextFileSystem itself, the returned one calls the methods of fs unless
+// the context is already done.
+func WithContext(fs FileSystem) ContextFileSystem {
+	if c, ok := fs.(ContextFileSystem); ok {
+		return c
+	}
+	return contextFileSystem{wrappedFS{fs}}
+}
+
+// BindContext returns a FileSystem calling the methods of fs with ctx. The
+// result also implements ContextFileSystem, ignoring ctx in favor of the
+// context passed to its methods, and the optional interfaces such as
+// CreateAter, forwarding them to fs unless ctx is done. Where fs lacks one,
+// its methods fail.
+func BindContext(fs ContextFileSystem, ctx context.Context) FileSystem {
+	if b, ok := fs.(*boundFileSystem); ok {
+		fs = b.ContextFileSystem
+	}
+	return &boundFileSystem{fs, ctx}
+}
+
+// A contextFileSystem adapts a FileSystem to a ContextFileSystem. The
+// optional interfaces of the FileSystem are forwarded.
+type contextFileSystem struct {
+	wrappedFS
+}
+
+func (f contextFileSystem) CreateContext(ctx context.Context, path string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.Create(path)
+}
+
+func (f contextFileSystem) MkdirContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.FileSystem.Mkdir(path)
+}
+
+func (f contextFileSystem) OpenContext(ctx context.Context, path string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.Open(path)
+}
+
+func (f contextFileSystem) RemoveContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.FileSystem.Remove(path)
+}
+
+func (f contextFileSystem) RenameContext(ctx context.Context, old, new string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.FileSystem.Rename(old, new)
+}
+
+func (f contextFileSystem) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.FileSystem.Stat(path)
+}
+
+// A boundFileSystem is a ContextFileSystem used as a FileSystem.
+type boundFileSystem struct {
+	ContextFileSystem
+	ctx context.Context
+}
+
+func (f *boundFileSystem) Create(path string) (File, error) {
+	return f.CreateContext(f.ctx, path)
+}
+
+func (f *boundFileSystem) Mkdir(path string) error {
+	return f.MkdirContext(f.ctx, path)
+}
+
+func (f *boundFileSystem) Open(path string) (File, error) {
+	return f.OpenContext(f.ctx, path)
+}
+
+func (f *boundFileSystem) Remove(path string) error {
+	return f.RemoveContext(f.ctx, path)
+}
+
+func (f *boundFileSystem) Rename(old, new string) error {
+	return f.RenameContext(f.ctx, old, new)
+}
+
+func (f *boundFileSystem) Stat(path string) (os.FileInfo, error) {
+	return f.StatContext(f.ctx, path)
+}
+
+func (f *boundFileSystem) CreateAt(path string, off int64) (File, error) {
+	if off == 0 {
+		return f.Create(path)
+	}
+	c, ok := f.ContextFileSystem.(CreateAter)
+	if !ok {
+		return nil, errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.CreateAt(path, off)
+}
+
+func (f *boundFileSystem) OpenAt(path string, off int64) (File, error) {
+	o, ok := f.ContextFileSystem.(OpenAter)
+	if !ok {
+		return nil, errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return o.OpenAt(path, off)
+}
+
+func (f *boundFileSystem) OpenStat(path string) (File, os.FileInfo, error) {
+	o, ok := f.ContextFileSystem.(OpenStater)
+	if !ok {
+		return nil, nil, errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return o.OpenStat(path)
+}
+
+func (f *boundFileSystem) Quota(user string) (int64, int64, error) {
+	q, ok := f.ContextFileSystem.(Quotaer)
+	if !ok {
+		return 0, 0, errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	return q.Quota(user)
+}
+
+func (f *boundFileSystem) Allocate(size int64) error {
+	a, ok := f.ContextFileSystem.(Allocator)
+	if !ok {
+		return errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return err
+	}
+	return a.Allocate(size)
+}
+
+func (f *boundFileSystem) DirSize(path string) (int64, error) {
+	d, ok := f.ContextFileSystem.(DirSizer)
+	if !ok {
+		return 0, errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.DirSize(path)
+}
+
+func (f *boundFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	c, ok := f.ContextFileSystem.(Chtimeser)
+	if !ok {
+		return errNotSupported
+	} else if err := f.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Chtimes(path, atime, mtime)
+}
+
+// An OpenStater is a FileSystem that can open a file and describe it in a
+// single call. For backends where opening is expensive, FileHandler uses this
+// for SIZE and MDTM and keeps the File so that a following RETR of the same
+// path doesn't open it again.
+type OpenStater interface {
+	OpenStat(path string) (File, os.FileInfo, error)
+}
+
+// An OpenAter is a FileSystem that can open a file for reading from an
+// offset. For remote backends this lets RETR after REST issue a ranged read
+// rather than seeking, which may mean downloading and discarding data.
+type OpenAter interface {
+	OpenAt(path string, off int64) (File, error)
+}
+
+// A CreateAter is a FileSystem that can resume writing a file at an offset,
+// keeping the data before it. This lets REST and STOR, and APPE, resume
+// uploads, including on backends whose writers can't seek, such as object
+// stores supporting append or compose operations. Without it, uploads can
+// only replace files, since Create truncates them.
+type CreateAter interface {
+	CreateAt(path string, off int64) (File, error)
+}
+
+// ErrQuotaExceeded may be returned by a FileSystem when a user's storage quota
+// would be exceeded. STOR replies to it with 552.
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// An OfflineError may be returned by a FileSystem's Open when a file is held
+// on offline storage, such as tape, and must be recalled before it can be
+// read. The FileSystem should start the recall and return at once rather than
+// block the session; RETR replies 450, asking the client to try again later.
+type OfflineError struct {
+	Path       string
+	RetryAfter time.Duration // Estimated time until the file is online, or 0.
+}
+
+func (e *OfflineError) Error() string {
+	return "file is offline: " + e.Path
+}
+
+// A Quotaer is a FileSystem that enforces storage quotas. FileHandler reports
+// them with SITE QUOTA.
+type Quotaer interface {
+	// Quota returns the bytes used by and allowed to user. The limit is
+	// negative if the user has none.
+	Quota(user string) (used, limit int64, err error)
+}
+
+// An Allocator is a FileSystem that can reserve space for an upload
+// announced with ALLO, for example by preallocating it, or refuse it by
+// returning ErrQuotaExceeded or another error if space is short.
+type Allocator interface {
+	Allocate(size int64) error
+}
+
+// A DirSizer is a FileSystem that can report the cumulative size of the
+// files below a directory, as object stores often can cheaply. FileHandler
+// uses this for SITE DSIZ.
+type DirSizer interface {
+	DirSize(path string) (int64, error)
+}
+
+// A Chtimeser is a FileSystem that can set the access and modification times
+// of a file, as os.Chtimes does, leaving a time unchanged if it is zero.
+// FileHandler uses this for MFMT, which sync tools use to preserve
+// timestamps.
+type Chtimeser interface {
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
 // File is the interface returned by certain FileSystem methods.
 type File interface {
 	io.Reader
 	io.Writer
-	io.Seeker
+	io.Seeker // Offsets are 64-bit; files over 4 GiB must be supported.
 	io.Closer
 
 	// Readdir has semantics like os.Readdir.
@@ -41,6 +301,19 @@ func (f *LocalFileSystem) Create(path string) (File, error) {
 	return os.Create(f.path(path))
 }
 
+// CreateAt implements CreateAter.
+func (f *LocalFileSystem) CreateAt(path string, off int64) (File, error) {
+	file, err := os.OpenFile(f.path(path), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(off, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
 // Open implements FileSystem.
 func (f *LocalFileSystem) Open(path string) (File, error) {
 	return os.Open(f.path(path))
@@ -61,11 +334,103 @@ func (f *LocalFileSystem) Remove(path string) error {
 	return os.Remove(f.path(path))
 }
 
+// Chtimes implements Chtimeser.
+func (f *LocalFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(f.path(path), atime, mtime)
+}
+
 // Rename implements FileSystem.
 func (f *LocalFileSystem) Rename(old, new string) error {
 	return os.Rename(f.path(old), f.path(new))
 }
 
+// A wrappedFS is embedded by FileSystems wrapping another to forward the
+// optional interfaces of the one wrapped, which embedding FileSystem alone
+// would hide. Where it lacks one, the methods fail with errNotSupported.
+// Wrappers override the methods whose behavior they change.
+type wrappedFS struct {
+	FileSystem
+}
+
+func (f wrappedFS) CreateAt(path string, off int64) (File, error) {
+	return CreateAt(f.FileSystem, path, off)
+}
+
+func (f wrappedFS) OpenAt(path string, off int64) (File, error) {
+	if o, ok := f.FileSystem.(OpenAter); ok {
+		return o.OpenAt(path, off)
+	}
+	return nil, errNotSupported
+}
+
+func (f wrappedFS) OpenStat(path string) (File, os.FileInfo, error) {
+	if o, ok := f.FileSystem.(OpenStater); ok {
+		return o.OpenStat(path)
+	}
+	return nil, nil, errNotSupported
+}
+
+func (f wrappedFS) Quota(user string) (int64, int64, error) {
+	if q, ok := f.FileSystem.(Quotaer); ok {
+		return q.Quota(user)
+	}
+	return 0, 0, errNotSupported
+}
+
+func (f wrappedFS) Allocate(size int64) error {
+	if a, ok := f.FileSystem.(Allocator); ok {
+		return a.Allocate(size)
+	}
+	return errNotSupported
+}
+
+func (f wrappedFS) DirSize(path string) (int64, error) {
+	if d, ok := f.FileSystem.(DirSizer); ok {
+		return d.DirSize(path)
+	}
+	return 0, errNotSupported
+}
+
+func (f wrappedFS) Chtimes(path string, atime, mtime time.Time) error {
+	if c, ok := f.FileSystem.(Chtimeser); ok {
+		return c.Chtimes(path, atime, mtime)
+	}
+	return errNotSupported
+}
+
+// OpenAt opens path in fs for reading from off, using OpenAt if fs is an
+// OpenAter supporting it or seeking otherwise.
+func OpenAt(fs FileSystem, path string, off int64) (File, error) {
+	if o, ok := fs.(OpenAter); ok && off > 0 {
+		if file, err := o.OpenAt(path, off); err != errNotSupported {
+			return file, err
+		}
+	}
+	file, err := fs.Open(path)
+	if err != nil || off == 0 {
+		return file, err
+	}
+	if err := seekTo(file, off); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// CreateAt creates path in fs for writing from off, using CreateAt if off is
+// positive. If fs isn't a CreateAter, that fails with an error, since Create
+// would truncate the data before off.
+func CreateAt(fs FileSystem, path string, off int64) (File, error) {
+	if off == 0 {
+		return fs.Create(path)
+	}
+	c, ok := fs.(CreateAter)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return c.CreateAt(path, off)
+}
+
 func (f *LocalFileSystem) path(p string) string {
 	p = path.Join("/", p) // Prevent directory traversal.
 	if f.Root == "" {
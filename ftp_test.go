@@ -1,22 +1,32 @@
 package ftp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -72,9 +82,24 @@ func TestFTP(t *testing.T) {
 	} else if !bytes.Equal(b, []byte("wow cool")) {
 		t.Fatal("bad data:", string(b))
 	}
+
+	d, err := c.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := d.Readdir(0); err != nil {
+		t.Fatal(err)
+	} else if len(fi) != 1 || fi[0].Name() != "foo.txt" {
+		t.Fatal("bad listing:", fi)
+	}
 }
 
 func newTLS() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{newCert()}}
+}
+
+// Return a self-signed certificate with the given DNS names.
+func newCert(names ...string) tls.Certificate {
 	now := time.Now()
 	tmpl := &x509.Certificate{
 		SerialNumber:          big.NewInt(123),
@@ -85,9 +110,10 @@ func newTLS() *tls.Config {
 		BasicConstraintsValid: true,
 		IsCA:           true,
 		MaxPathLenZero: true,
+		DNSNames:       names,
 	}
 
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		panic(err)
 	}
@@ -96,27 +122,7 @@ func newTLS() *tls.Config {
 	if err != nil {
 		panic(err)
 	}
-
-	cert, err := tls.X509KeyPair(
-		pem.EncodeToMemory(&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: xcert,
-		}),
-		pem.EncodeToMemory(&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		}),
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		CipherSuites: []uint16{
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-		},
-	}
+	return tls.Certificate{Certificate: [][]byte{xcert}, PrivateKey: key}
 }
 
 // Not a real test. This is just to aid in manual testing until the client is
@@ -150,6 +156,86 @@ func testServer(t *testing.T) {
 	panic(err)
 }
 
+// A lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// Listen for implicit FTPS with s, returning a function dialing it.
+func listenTLS(t *testing.T, s *Server) (func(*tls.Config) (*textproto.Conn, error), func()) {
+	s.Addr = "localhost:0"
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(config *tls.Config) (*textproto.Conn, error) {
+		c, err := tls.Dial("tcp", li.Addr().String(), config)
+		if err != nil {
+			return nil, err
+		}
+		tc := textproto.NewConn(c)
+		if _, _, err := tc.ReadResponse(220); err != nil {
+			tc.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return dial, func() { li.Close() }
+}
+
+func TestTLSDebug(t *testing.T) {
+	var keys lockedBuffer
+	hellos := make(chan string, 1)
+	dial, done := listenTLS(t, &Server{
+		Handler:      &FileHandler{FileSystem: newTestFS()},
+		TLS:          newTLS(),
+		KeyLogWriter: &keys,
+		HandshakeError: func(hello *tls.ClientHelloInfo, err error) {
+			if hello == nil {
+				hellos <- ""
+			} else {
+				hellos <- hello.ServerName
+			}
+		},
+	})
+	defer done()
+
+	c, err := dial(&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 331, "USER foo")
+	c.Close()
+	if !strings.HasPrefix(keys.String(), "CLIENT_") {
+		t.Errorf("bad key log: %q", keys.String())
+	}
+
+	// An ECDSA certificate has no cipher suites in common with this.
+	if _, err := dial(&tls.Config{
+		ServerName:   "ftp.example.com",
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+	}); err == nil {
+		t.Fatal("handshake succeeded")
+	}
+	if name := <-hellos; name != "ftp.example.com" {
+		t.Errorf("got server name %q", name)
+	}
+}
+
 type fileInfos []os.FileInfo
 
 func (f fileInfos) Len() int           { return len(f) }
@@ -321,3 +407,3950 @@ type testAuth struct{}
 func (testAuth) Authorize(user, pass string) (bool, error) {
 	return user == "foo" && pass == "bar", nil
 }
+
+// Start s and return a raw control connection to it.
+func dialTest(t testing.TB, s *Server) (*textproto.Conn, func()) {
+	if s.Addr == "" {
+		s.Addr = "localhost:0"
+	}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = li.Addr().String()
+	c, err := textproto.Dial("tcp", s.Addr)
+	if err != nil {
+		li.Close()
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		li.Close()
+	}
+}
+
+// Open a data connection with EPSV.
+func dialEPSV(t testing.TB, c *textproto.Conn, s *Server) net.Conn {
+	port, err := ParseEPSV(expect(t, c, 229, "EPSV"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	d, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Send a command and check the reply code, returning the reply message.
+func expect(t testing.TB, c *textproto.Conn, code int, cmd string) string {
+	if err := c.PrintfLine("%s", cmd); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	return msg
+}
+
+func TestFEAT(t *testing.T) {
+	h := &FileHandler{
+		FileSystem: newTestFS(),
+		Commands: map[string]*Extension{
+			"XFOO": {
+				Feature: "XFOO",
+				Public:  true,
+				Handle: func(s *Session, c *Command) error {
+					return s.Reply(200, "Foo.")
+				},
+			},
+		},
+	}
+	c, done := dialTest(t, &Server{Handler: h})
+	defer done()
+
+	feat := expect(t, c, 211, "FEAT")
+	if !strings.Contains(feat, "XFOO") {
+		t.Error("FEAT is missing extension:", feat)
+	}
+	if strings.Contains(feat, "PROT") {
+		t.Error("FEAT advertises PROT without TLS:", feat)
+	}
+	expect(t, c, 200, "XFOO")
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 502, "PBSZ 0")
+	if help := expect(t, c, 214, "HELP cwd"); help != "Syntax: CWD <sp> pathname" {
+		t.Error("bad HELP reply:", help)
+	}
+	expect(t, c, 502, "HELP PBSZ")
+}
+
+func TestMLST(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	msg := expect(t, c, 250, "MLST /")
+	if lines := strings.Split(msg, "\n"); len(lines) != 3 {
+		t.Fatal("bad MLST reply:", msg)
+	} else if !strings.HasPrefix(lines[1], " type=dir;") {
+		t.Error("bad MLST facts:", lines[1])
+	}
+	expect(t, c, 550, "MLST /nope")
+}
+
+func TestDirMetadata(t *testing.T) {
+	for _, sizeDirs := range []bool{false, true} {
+		fs := newTestFS()
+		fs.Mkdir("/dir")
+		c, done := dialTest(t, &Server{
+			Handler: &FileHandler{FileSystem: fs, SizeDirs: sizeDirs},
+		})
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		mlst := expect(t, c, 250, "MLST /dir")
+		if !strings.Contains(mlst, " type=dir;") {
+			t.Error("bad MLST reply:", mlst)
+		}
+		mdtm := expect(t, c, 213, "MDTM /dir")
+		if !strings.Contains(mlst, "modify="+mdtm+";") {
+			t.Errorf("MDTM %s doesn't match MLST %q", mdtm, mlst)
+		}
+		if sizeDirs {
+			if size := expect(t, c, 213, "SIZE /dir"); !strings.Contains(mlst, "size="+size+";") {
+				t.Errorf("SIZE %s doesn't match MLST %q", size, mlst)
+			}
+		} else {
+			expect(t, c, 550, "SIZE /dir")
+		}
+		done()
+	}
+}
+
+func TestMLSD(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "MLSD /")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "type=file;size=5;") || !strings.HasSuffix(string(b), " a.txt\r\n") {
+		t.Errorf("bad MLSD listing: %q", b)
+	}
+	d = dialEPSV(t, c, s)
+	expect(t, c, 501, "MLSD /a.txt")
+	d.Close()
+}
+
+func TestOPTS(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Options: map[string]*Extension{
+				"NLST": {Handle: func(s *Session, c *Command) error {
+					return s.ReplyString(200, c.Cmd+" "+c.Msg)
+				}},
+			},
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "OPTS utf8 on")
+	expect(t, c, 501, "OPTS UTF8 OFF")
+	expect(t, c, 501, "OPTS XYZZY 1")
+	if msg := expect(t, c, 200, "OPTS NLST long"); msg != "NLST long" {
+		t.Error("bad OPTS NLST reply:", msg)
+	}
+	if msg := expect(t, c, 200, "OPTS MLST Size;bogus;type;"); msg != "MLST OPTS type;size;" {
+		t.Error("bad OPTS MLST reply:", msg)
+	}
+	if msg := expect(t, c, 211, "FEAT"); !strings.Contains(msg, "MLST type*;size*;modify;perm;") {
+		t.Error("bad FEAT reply:", msg)
+	}
+	if msg := expect(t, c, 250, "MLST /"); !strings.Contains(msg, " type=dir;size=0; /") {
+		t.Error("bad MLST reply:", msg)
+	}
+}
+
+func TestState(t *testing.T) {
+	var st State
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Commands: map[string]*Extension{
+				"XSTA": {Handle: func(s *Session, c *Command) error {
+					st = s.State()
+					return s.Reply(200, "OK.")
+				}},
+			},
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "TYPE I")
+	expect(t, c, 200, "MODE S")
+	expect(t, c, 200, "OPTS UTF8 ON")
+	expect(t, c, 200, "OPTS MLST size;")
+	expect(t, c, 200, "OPTS HASH MD5")
+	expect(t, c, 200, "XSTA")
+	want := State{Type: "I", Mode: "S", Prot: "C", UTF8: true, Hash: "MD5", Facts: []string{"size"}}
+	if fmt.Sprint(st) != fmt.Sprint(want) {
+		t.Errorf("got state %+v, want %+v", st, want)
+	}
+}
+
+func TestNoopTimeout(t *testing.T) {
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: newTestFS(), NoopTimeout: 50 * time.Millisecond}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "NOOP")
+	time.Sleep(30 * time.Millisecond)
+	expect(t, c, 257, "PWD")
+	time.Sleep(30 * time.Millisecond)
+	expect(t, c, 200, "NOOP")
+	time.Sleep(30 * time.Millisecond)
+	expect(t, c, 421, "NOOP")
+}
+
+func TestStatus(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "TYPE I")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 550, "SIZE b.txt")
+	msg := expect(t, c, 211, "STAT")
+	for _, want := range []string{
+		"Logged in as foo",
+		"TYPE: I, MODE: S, PROT: C",
+		"No data connection",
+		"Bytes transferred: 5",
+		"Last error: SIZE: 550",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("status missing %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		Strict:  true,
+	})
+	defer done()
+
+	expect(t, c, 500, "XYZZY")
+	expect(t, c, 501, "USER")
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 501, "PWD /")
+	expect(t, c, 500, "LIST\t-la")
+	expect(t, c, 200, "CDUP")
+	expect(t, c, 221, "QUIT")
+}
+
+func TestSplitCommand(t *testing.T) {
+	s := &fileSession{
+		FileHandler: &FileHandler{
+			Commands: map[string]*Extension{
+				"XAB":  {Handle: func(*Session, *Command) error { return nil }},
+				"XABC": {Handle: func(*Session, *Command) error { return nil }},
+			},
+		},
+		Session: &Session{Server: &Server{}},
+	}
+	for _, tt := range []struct {
+		raw, cmd, msg string
+	}{
+		{"CWDfoo", "CWD", "foo"},
+		{"cwdfoo", "CWD", "foo"},
+		{"RETRa.txt", "RETR", "a.txt"},
+		{"MKDdir", "MKD", "dir"},
+		{"MKDIR", "", ""},
+		{"CWD", "", ""},
+		{"XABCd", "", ""},
+		{"FOOBAR", "", ""},
+	} {
+		c := &Command{Raw: tt.raw, Cmd: strings.ToUpper(tt.raw)}
+		cmd := s.splitCommand(c)
+		if tt.cmd == "" && cmd != nil {
+			t.Errorf("%s: split as %s %q", tt.raw, c.Cmd, c.Msg)
+		} else if tt.cmd != "" && (cmd == nil || c.Cmd != tt.cmd || c.Msg != tt.msg) {
+			t.Errorf("%s: got %s %q, want %s %q", tt.raw, c.Cmd, c.Msg, tt.cmd, tt.msg)
+		}
+	}
+}
+
+func TestDoneCodes(t *testing.T) {
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: newTestFS()}})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 250, "CDUP")
+	expect(t, c, 221, "QUIT")
+
+	for cmd := range doneCodes {
+		if fileCommands[cmd] == nil && !pathCommands[cmd] {
+			t.Errorf("reply code for unknown command %s", cmd)
+		}
+	}
+	for cmd := range transferCommands {
+		if _, ok := doneCodes[cmd]; !ok {
+			t.Errorf("no reply code for transfer command %s", cmd)
+		}
+	}
+	s := &fileSession{Session: &Session{Server: &Server{}}}
+	if code := s.doneCode("XNOP"); code != 200 {
+		t.Errorf("got %d for a command without a reply code, want 200", code)
+	}
+}
+
+func TestPASVOverIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is unavailable:", err)
+	}
+	l.Close()
+	for _, ip := range []net.IP{nil, net.IPv4(192, 0, 2, 1)} {
+		c, done := dialTest(t, &Server{
+			Addr:     "[::1]:0",
+			Handler:  &FileHandler{FileSystem: newTestFS()},
+			PublicIP: ip,
+		})
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		if ip == nil {
+			expect(t, c, 425, "PASV")
+		} else if msg := expect(t, c, 227, "PASV"); !strings.Contains(msg, "(192,0,2,1,") {
+			t.Error("bad PASV reply:", msg)
+		}
+		done()
+	}
+}
+
+func TestPassiveReply(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		PassiveReply: func(s *Session, code int, addr *net.TCPAddr) string {
+			if code == 227 {
+				return fmt.Sprintf("=%s", HostPort(addr))
+			}
+			return ""
+		},
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 227, "PASV"); !strings.HasPrefix(msg, "=127,0,0,1,") {
+		t.Error("bad PASV reply:", msg)
+	}
+	if msg := expect(t, c, 229, "EPSV"); !strings.HasPrefix(msg, "Entering Extended Passive Mode") {
+		t.Error("bad EPSV reply:", msg)
+	}
+}
+
+func TestPartitionedPorts(t *testing.T) {
+	p := &PartitionedPorts{
+		Range:     PortRange{1000, 1005},
+		Instance:  1,
+		Instances: 2,
+	}
+	var got []int
+	for {
+		port, err := p.Allocate(nil)
+		if err == ErrNoPorts {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, port)
+	}
+	if fmt.Sprint(got) != "[1001 1003 1005]" {
+		t.Fatal("bad ports:", got)
+	}
+	p.Release(1003)
+	if port, err := p.Allocate(nil); err != nil || port != 1003 {
+		t.Fatal("bad port after release:", port, err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy, pdone := proxyTest(t)
+	defer pdone()
+	proxy.Addr = "localhost:0"
+	pl, err := proxy.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	c := &Client{Addr: pl.Addr().String()}
+	defer c.Close()
+	if ok, err := c.Authorize("alice", "nope"); err != nil || ok {
+		t.Fatal("login should fail:", err)
+	}
+	if ok, err := c.Authorize("alice", "secret"); err != nil || !ok {
+		t.Fatal("login failed:", err)
+	}
+	f, err := c.Create("foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("proxied"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = c.Open("foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "proxied" {
+		t.Fatal("bad data:", string(b))
+	}
+}
+
+// Start a backend FileHandler and a ProxyHandler routing alice to it.
+func proxyTest(t *testing.T) (*Server, func()) {
+	backend := &Server{
+		Addr: "localhost:0",
+		Handler: &FileHandler{
+			Authorizer: new(testAuth),
+			FileSystem: newTestFS(),
+		},
+	}
+	bl, err := backend.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Server{
+		Handler: &ProxyHandler{
+			Route: func(user, pass string) (*Upstream, error) {
+				if user != "alice" || pass != "secret" {
+					return nil, nil
+				}
+				return &Upstream{bl.Addr().String(), "foo", "bar"}, nil
+			},
+		},
+	}
+	return proxy, func() { bl.Close() }
+}
+
+func TestProxyLoggedIn(t *testing.T) {
+	proxy, pdone := proxyTest(t)
+	defer pdone()
+	c, done := dialTest(t, proxy)
+	defer done()
+	expect(t, c, 331, "USER alice")
+	expect(t, c, 230, "PASS secret")
+	for _, cmd := range []string{"USER foo", "PASS bar", "ACCT x", "REIN"} {
+		expect(t, c, 503, cmd)
+	}
+	expect(t, c, 257, "PWD")
+}
+
+func TestProxyAbortedTransfer(t *testing.T) {
+	proxy, pdone := proxyTest(t)
+	defer pdone()
+	c, done := dialTest(t, proxy)
+	defer done()
+	expect(t, c, 331, "USER alice")
+	expect(t, c, 230, "PASS secret")
+	d := dialEPSV(t, c, proxy)
+	expect(t, c, 150, "STOR a.txt")
+	d.Write([]byte("partial"))
+	d.(*net.TCPConn).SetLinger(0)
+	d.Close()
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 257, "PWD")
+}
+
+func TestHTTPHandler(t *testing.T) {
+	files := map[string][]byte{}
+	var m sync.Mutex
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/" && r.Method != "PUT":
+			for name := range files {
+				fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", name[1:], name[1:])
+			}
+		case r.Method == "PUT":
+			files[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case files[r.URL.Path] == nil:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write(files[r.URL.Path])
+		}
+	}))
+	defer hs.Close()
+
+	s := &Server{
+		Addr: "localhost:0",
+		Handler: &HTTPHandler{
+			URL:    hs.URL,
+			Header: http.Header{"Authorization": {"Bearer token"}},
+		},
+	}
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	c := &Client{Addr: li.Addr().String()}
+	defer c.Close()
+	if ok, err := c.Authorize("foo", "bar"); err != nil || !ok {
+		t.Fatal("login failed:", err)
+	}
+	f, _ := c.Create("foo.txt")
+	f.Write([]byte("over http"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, _ = c.Open("foo.txt")
+	if b, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "over http" {
+		t.Fatal("bad data:", string(b))
+	}
+	d, _ := c.Open("/")
+	if fi, err := d.Readdir(0); err != nil {
+		t.Fatal(err)
+	} else if len(fi) != 1 || fi[0].Name() != "foo.txt" {
+		t.Fatal("bad listing:", fi)
+	}
+}
+
+func TestHTTPAbortedUpload(t *testing.T) {
+	stored := make(chan bool, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, err := ioutil.ReadAll(r.Body)
+		stored <- err == nil
+	}))
+	defer hs.Close()
+
+	s := &Server{Handler: &HTTPHandler{URL: hs.URL}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR a.txt")
+	d.Write([]byte("partial"))
+	d.(*net.TCPConn).SetLinger(0)
+	d.Close()
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	if <-stored {
+		t.Error("aborted upload was stored")
+	}
+}
+
+func TestScriptHandler(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &ScriptHandler{
+			Rules: []ScriptRule{
+				{Cmd: "SYST", Code: 215, Msg: "Weird Type: X"},
+				{Cmd: "PWD", Raw: "257-no final line\r\n257 \"/\"\r\n"},
+				{Cmd: "STAT", Code: 421, Msg: "Bye.", Close: true},
+			},
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 215, "SYST"); msg != "Weird Type: X" {
+		t.Error("bad SYST reply:", msg)
+	}
+	expect(t, c, 257, "PWD")
+	expect(t, c, 502, "MDTM foo")
+	expect(t, c, 421, "STAT")
+}
+
+func TestDeterministic(t *testing.T) {
+	fs := newTestFS()
+	fs["/b.txt"] = &testFile{fs: fs, path: "/b.txt", mode: 0644, size: 5,
+		time: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)}
+	fs["/a.txt"] = &testFile{fs: fs, path: "/a.txt", mode: 0644,
+		time: time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)}
+	c, done := dialTest(t, &Server{
+		Handler:       &FileHandler{FileSystem: fs},
+		Clock:         func() time.Time { return time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC) },
+		Deterministic: true,
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	want := strings.Join([]string{
+		"Status:",
+		" -rw-r--r-- 1   user  group       0  Jan  2 2015 a.txt",
+		" -rw-r--r-- 1   user  group       5 Jan  2 03:04 b.txt",
+		"End.",
+	}, "\n")
+	if msg := expect(t, c, 213, "STAT /"); msg != want {
+		t.Errorf("got:\n%s\nwant:\n%s", msg, want)
+	}
+	if msg := expect(t, c, 213, "MDTM b.txt"); msg != "20160102030405" {
+		t.Error("bad MDTM:", msg)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Commands: map[string]*Extension{
+				"XBUG": {Public: true, Handle: func(*Session, *Command) error {
+					panic("oops")
+				}},
+			},
+		},
+		ErrorHandler: func(s *Session, err error) { errs <- err },
+	})
+	defer done()
+
+	c.PrintfLine("XBUG")
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Error(err)
+	}
+	if err, ok := (<-errs).(*PanicError); !ok || err.Value != "oops" {
+		t.Error("bad error:", err)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	s := &Server{
+		Handler:     &FileHandler{FileSystem: newTestFS()},
+		MaxSessions: 1,
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	c2, err := textproto.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, _, err := c2.ReadResponse(421); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxSessionMemory(t *testing.T) {
+	fs := newTestFS()
+	for i := 0; i < 100; i++ {
+		f, _ := fs.Create(fmt.Sprintf("/file%d", i))
+		f.Write(nil)
+		f.Close()
+	}
+	c, done := dialTest(t, &Server{
+		Handler:          &FileHandler{FileSystem: fs},
+		MaxSessionMemory: 10000,
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 451, "STAT /")
+	expect(t, c, 213, "STAT /file1")
+}
+
+// A countFS counts calls to Open and Stat.
+type countFS struct {
+	FileSystem
+	opens, stats int
+}
+
+func (f *countFS) Open(p string) (File, error) {
+	f.opens++
+	return f.FileSystem.Open(p)
+}
+
+func (f *countFS) Stat(p string) (os.FileInfo, error) {
+	f.stats++
+	return f.FileSystem.Stat(p)
+}
+
+func TestListCache(t *testing.T) {
+	fs := &countFS{FileSystem: newTestFS()}
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: fs, ListCacheTTL: time.Minute},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 213, "STAT /")
+	expect(t, c, 213, "STAT /")
+	if fs.opens != 1 {
+		t.Errorf("got %d opens, want 1", fs.opens)
+	}
+	expect(t, c, 257, "MKD /dir")
+	if msg := expect(t, c, 213, "STAT /"); !strings.Contains(msg, "dir") {
+		t.Error("stale listing:", msg)
+	}
+	if fs.opens != 2 {
+		t.Errorf("got %d opens, want 2", fs.opens)
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	fs := &countFS{FileSystem: newTestFS()}
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: fs, StatCacheTTL: time.Minute},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 213, "SIZE a.txt")
+	expect(t, c, 213, "MDTM a.txt")
+	if fs.stats != 1 {
+		t.Errorf("got %d stats, want 1", fs.stats)
+	}
+	expect(t, c, 250, "DELE a.txt")
+	expect(t, c, 550, "SIZE a.txt")
+}
+
+// An openStatFS implements OpenStater, counting calls to it and to Open.
+type openStatFS struct {
+	FileSystem
+	opens int
+}
+
+func (f *openStatFS) Open(p string) (File, error) {
+	f.opens++
+	return f.FileSystem.Open(p)
+}
+
+func (f *openStatFS) OpenStat(p string) (File, os.FileInfo, error) {
+	f.opens++
+	file, err := f.FileSystem.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.FileSystem.Stat(p)
+	return file, stat, err
+}
+
+func TestOpenStat(t *testing.T) {
+	fs := &openStatFS{FileSystem: newTestFS()}
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	// OpenStat is reached through the session's wrappers, and isn't used
+	// for virtual files.
+	s := &Server{Handler: &FileHandler{
+		FileSystem: fs,
+		OpTimeout:  time.Second,
+		Breaker:    &Breaker{Threshold: 2, Cooldown: time.Minute},
+		Virtual: map[string]*VirtualFile{
+			"/v.txt": {Content: func(*Session) []byte { return []byte("hi") }},
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 213, "SIZE v.txt"); msg != "2" {
+		t.Errorf("got size %s for the virtual file, want 2", msg)
+	}
+	expect(t, c, 213, "SIZE a.txt")
+	expect(t, c, 213, "MDTM a.txt")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q", b)
+	}
+	if fs.opens != 1 {
+		t.Errorf("got %d opens, want 1", fs.opens)
+	}
+}
+
+// An openAtFS implements OpenAter, recording the offset asked for.
+type openAtFS struct {
+	FileSystem
+	off int64
+}
+
+func (f *openAtFS) OpenAt(p string, off int64) (File, error) {
+	f.off = off
+	file, err := f.FileSystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &noSeekFile{file}, nil
+}
+
+// A noSeekFile is a File that has already been positioned.
+type noSeekFile struct{ File }
+
+func (f *noSeekFile) Seek(int64, int) (int64, error) { return 0, errNotSupported }
+
+func TestOpenAt(t *testing.T) {
+	fs := &openAtFS{FileSystem: newTestFS()}
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	// OpenAt is reached through the session's wrappers, and isn't used for
+	// generated files.
+	s := &Server{Handler: &FileHandler{
+		FileSystem: fs,
+		OpTimeout:  time.Second,
+		Generated: map[string]Generator{
+			"/g.txt": func(string) (io.ReadCloser, os.FileInfo, error) {
+				return ioutil.NopCloser(strings.NewReader("hello")), &stat{size: 5}, nil
+			},
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 3")
+	expect(t, c, 150, "RETR g.txt")
+	if b, _ := ioutil.ReadAll(d); string(b) != "lo" {
+		t.Errorf("got %q from the generated file, want %q", b, "lo")
+	}
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if fs.off != 0 {
+		t.Errorf("OpenAt called for the generated file")
+	}
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 2")
+	expect(t, c, 150, "RETR a.txt")
+	ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if fs.off != 2 {
+		t.Errorf("got offset %d, want 2", fs.off)
+	}
+}
+
+func TestCreateAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// CreateAt must reach the LocalFileSystem through the session's
+	// wrappers.
+	for _, h := range []*FileHandler{
+		{FileSystem: &LocalFileSystem{Root: dir}},
+		{
+			FileSystem:   &LocalFileSystem{Root: dir},
+			OpTimeout:    time.Second,
+			Breaker:      &Breaker{Threshold: 2, Cooldown: time.Minute},
+			StatCacheTTL: time.Minute,
+			ListCacheTTL: time.Minute,
+		},
+	} {
+		if err := ioutil.WriteFile(dir+"/a.txt", []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Handler: h}
+		c, done := dialTest(t, s)
+
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		d := dialEPSV(t, c, s)
+		expect(t, c, 350, "REST 2")
+		expect(t, c, 150, "STOR a.txt")
+		d.Write([]byte("XY"))
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(dir + "/a.txt"); string(b) != "heXYo" {
+			t.Errorf("got %q, want %q", b, "heXYo")
+		}
+		done()
+	}
+}
+
+func TestAPPE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		d := dialEPSV(t, c, s)
+		expect(t, c, 150, "APPE "+name)
+		d.Write([]byte(" world"))
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(dir + "/a.txt"); string(b) != "hello world" {
+		t.Errorf("got %q, want %q", b, "hello world")
+	}
+	if b, _ := ioutil.ReadFile(dir + "/b.txt"); string(b) != " world" {
+		t.Errorf("got %q, want %q", b, " world")
+	}
+
+	// Without CreateAt, existing files can only be replaced.
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s = &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done2 := dialTest(t, s)
+	defer done2()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 504, "APPE a.txt")
+	d.Close()
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 2")
+	expect(t, c, 504, "STOR a.txt")
+	d.Close()
+	if fi, _ := fs.Stat("/a.txt"); fi.Size() != 5 {
+		t.Errorf("file truncated to %d bytes", fi.Size())
+	}
+	d = dialEPSV(t, c, s)
+	expect(t, c, 150, "APPE b.txt")
+	d.Write([]byte(" world"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A largeFS serves files of any size with content derived from offsets, and
+// records uploads, which may resume at any offset, without storing them.
+// Seeking to the end of a file returns io.EOF, and seeks beyond clamp, if
+// positive, stop there, as some backends do near the end of a file.
+type largeFS struct {
+	testFS
+	sizes map[string]int64
+	clamp int64
+
+	mu      sync.Mutex
+	uploads map[string][2]int64 // Offset and length of uploads.
+}
+
+func (f *largeFS) Stat(p string) (os.FileInfo, error) {
+	if size, ok := f.sizes[p]; ok {
+		return &stat{name: p, size: size, mode: 0644}, nil
+	}
+	return f.testFS.Stat(p)
+}
+
+func (f *largeFS) Open(p string) (File, error) {
+	if size, ok := f.sizes[p]; ok {
+		return &largeFile{fs: f, path: p, size: size}, nil
+	}
+	return f.testFS.Open(p)
+}
+
+func (f *largeFS) Create(p string) (File, error) {
+	return f.CreateAt(p, 0)
+}
+
+func (f *largeFS) CreateAt(p string, off int64) (File, error) {
+	return &largeFile{fs: f, path: p, size: -1, off: off, start: off}, nil
+}
+
+// Content of large files at off.
+func largeByte(off int64) byte {
+	return byte(off % 251)
+}
+
+type largeFile struct {
+	fs         *largeFS
+	path       string
+	size       int64 // Negative for uploads.
+	off, start int64
+	written    int64
+}
+
+func (f *largeFile) Read(b []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if n := f.size - f.off; int64(len(b)) > n {
+		b = b[:n]
+	}
+	for i := range b {
+		b[i] = largeByte(f.off + int64(i))
+	}
+	f.off += int64(len(b))
+	return len(b), nil
+}
+
+func (f *largeFile) Seek(off int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return f.off, errNotSupported
+	}
+	if f.fs.clamp > 0 && off > f.fs.clamp {
+		off = f.fs.clamp
+	}
+	f.off, f.start = off, off
+	if off == f.size {
+		return off, io.EOF
+	}
+	return off, nil
+}
+
+func (f *largeFile) Write(b []byte) (int, error) {
+	f.written += int64(len(b))
+	return len(b), nil
+}
+
+func (f *largeFile) Close() error {
+	if f.size < 0 {
+		f.fs.mu.Lock()
+		f.fs.uploads[f.path] = [2]int64{f.start, f.written}
+		f.fs.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *largeFile) Readdir(int) ([]os.FileInfo, error) { return nil, errNotSupported }
+
+func TestLargeFiles(t *testing.T) {
+	const size = 5<<30 + 3
+	fs := &largeFS{
+		testFS:  newTestFS(),
+		sizes:   map[string]int64{"/big": size},
+		uploads: make(map[string][2]int64),
+	}
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "TYPE I")
+	if msg := expect(t, c, 213, "SIZE big"); msg != "5368709123" {
+		t.Error("bad SIZE reply:", msg)
+	}
+	if msg := expect(t, c, 250, "MLST big"); !strings.Contains(msg, "size=5368709123;") {
+		t.Error("bad MLST reply:", msg)
+	}
+
+	retr := func(off int64, code int) []byte {
+		d := dialEPSV(t, c, s)
+		defer d.Close()
+		if msg := expect(t, c, 350, fmt.Sprint("REST ", off)); !strings.Contains(msg, fmt.Sprint(off)) {
+			t.Error("bad REST reply:", msg)
+		}
+		if code != 150 {
+			expect(t, c, code, "RETR big")
+			return nil
+		}
+		expect(t, c, 150, "RETR big")
+		b, _ := ioutil.ReadAll(d)
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	off := int64(size - 3)
+	b := retr(off, 150)
+	if want := []byte{largeByte(off), largeByte(off + 1), largeByte(off + 2)}; !bytes.Equal(b, want) {
+		t.Errorf("RETR from %d got %v, want %v", off, b, want)
+	}
+	if b := retr(size, 150); len(b) != 0 {
+		t.Errorf("RETR from the end got %d bytes", len(b))
+	}
+	retr(size+1, 554)
+
+	// The file has shrunk since its size was reported.
+	fs.clamp = size - 10
+	d := dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 5368709118")
+	expect(t, c, 150, "RETR big")
+	if b, _ := ioutil.ReadAll(d); len(b) != 0 {
+		t.Errorf("RETR from a clamped offset sent %d bytes", len(b))
+	}
+	d.Close()
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Fatal(err)
+	}
+	fs.clamp = 0
+
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 5368709123")
+	expect(t, c, 150, "STOR big")
+	d.Write([]byte("abc"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if got, want := fs.uploads["/big"], [2]int64{size, 3}; got != want {
+		t.Errorf("upload at %v, want %v", got, want)
+	}
+}
+
+func TestSparseRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sparse := range []bool{false, true} {
+		s := &Server{Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}, SparseRestart: sparse}}
+		c, done := dialTest(t, s)
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		d := dialEPSV(t, c, s)
+		expect(t, c, 350, "REST 8")
+		if !sparse {
+			expect(t, c, 554, "STOR a.txt")
+			d.Close()
+			done()
+			continue
+		}
+		expect(t, c, 150, "STOR a.txt")
+		d.Write([]byte("XY"))
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	if b, _ := ioutil.ReadFile(dir + "/a.txt"); string(b) != "hello\x00\x00\x00XY" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	for _, test := range []struct {
+		off, size int64
+		typ       string
+		err       error
+	}{
+		{0, 0, "A", nil},
+		{5, 5, "I", nil},
+		{6, 5, "I", ErrRestartRange},
+		{2, 5, "A", ErrRestartASCII},
+	} {
+		if err := CheckRestart(test.off, test.size, test.typ); err != test.err {
+			t.Errorf("CheckRestart(%d, %d, %q) = %v, want %v", test.off, test.size, test.typ, err, test.err)
+		}
+	}
+	if _, err := ParseRestart("-1"); err == nil {
+		t.Error("negative offset accepted")
+	}
+
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	if _, err := CreateAt(fs, "/a.txt", 5); err != errNotSupported {
+		t.Error("CreateAt without a CreateAter:", err)
+	}
+	if fi, _ := fs.Stat("/a.txt"); fi.Size() != 5 {
+		t.Error("CreateAt truncated the file")
+	}
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 6")
+	expect(t, c, 554, "RETR a.txt")
+	d.Close()
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 1")
+	expect(t, c, 554, "STOR b.txt")
+	d.Close()
+	expect(t, c, 200, "TYPE A")
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 1")
+	expect(t, c, 554, "RETR a.txt")
+	d.Close()
+}
+
+func TestRANG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(name, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "RANG STREAM") {
+		t.Error("FEAT is missing RANG STREAM:", feat)
+	}
+	expect(t, c, 501, "RANG 5 2")
+	expect(t, c, 501, "RANG 5")
+	expect(t, c, 350, "RANG 1 0")
+
+	d := dialEPSV(t, c, s)
+	if msg := expect(t, c, 350, "RANG 2 5"); msg != "Restarting at 2. End byte range at 5." {
+		t.Error("bad RANG reply:", msg)
+	}
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "2345" {
+		t.Errorf("got %q for bytes 2-5", b)
+	}
+
+	for _, tt := range []struct {
+		rang, data string
+		code       int
+		want       string
+	}{
+		{"RANG 2 4", "abc", 226, "01abc56789"},
+		{"RANG 8 9", "xyz", 552, "01abc567xy"},
+		{"RANG 0 1", "ab", 226, "ab"},
+	} {
+		d := dialEPSV(t, c, s)
+		expect(t, c, 350, tt.rang)
+		expect(t, c, 150, "STOR a.txt")
+		d.Write([]byte(tt.data))
+		d.Close()
+		if _, _, err := c.ReadResponse(tt.code); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(name); string(b) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.rang, b, tt.want)
+		}
+	}
+
+	// APPE ignores a range set before it.
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "RANG 0 0")
+	expect(t, c, 150, "APPE a.txt")
+	d.Write([]byte("cd"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "abcd" {
+		t.Errorf("got %q after APPE, want %q", b, "abcd")
+	}
+
+	expect(t, c, 200, "TYPE A")
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "RANG 0 1")
+	expect(t, c, 554, "RETR a.txt")
+	d.Close()
+}
+
+// A ctxFS is a ContextFileSystem recording the context of the last call.
+type ctxFS struct {
+	FileSystem
+	ctx chan context.Context
+}
+
+func (f *ctxFS) CreateContext(ctx context.Context, p string) (File, error) {
+	return WithContext(f.FileSystem).CreateContext(ctx, p)
+}
+
+func (f *ctxFS) MkdirContext(ctx context.Context, p string) error {
+	return WithContext(f.FileSystem).MkdirContext(ctx, p)
+}
+
+func (f *ctxFS) OpenContext(ctx context.Context, p string) (File, error) {
+	return WithContext(f.FileSystem).OpenContext(ctx, p)
+}
+
+func (f *ctxFS) RemoveContext(ctx context.Context, p string) error {
+	return WithContext(f.FileSystem).RemoveContext(ctx, p)
+}
+
+func (f *ctxFS) RenameContext(ctx context.Context, old, new string) error {
+	return WithContext(f.FileSystem).RenameContext(ctx, old, new)
+}
+
+func (f *ctxFS) StatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	f.ctx <- ctx
+	return WithContext(f.FileSystem).StatContext(ctx, p)
+}
+
+func TestContextFileSystem(t *testing.T) {
+	fs := &ctxFS{FileSystem: newTestFS(), ctx: make(chan context.Context, 1)}
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 250, "CWD /")
+	ctx := <-fs.ctx
+	if ctx.Err() != nil {
+		t.Fatal("context done early")
+	}
+	expect(t, c, 221, "QUIT")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("context not cancelled")
+	}
+}
+
+// A slowFS is a FileSystem whose Stat fails the first time and whose Open is
+// slow.
+type slowFS struct {
+	FileSystem
+	stats int
+}
+
+func (f *slowFS) Stat(p string) (os.FileInfo, error) {
+	if f.stats++; f.stats == 1 {
+		return nil, errors.New("transient")
+	}
+	return f.FileSystem.Stat(p)
+}
+
+func (f *slowFS) Open(p string) (File, error) {
+	time.Sleep(time.Second)
+	return f.FileSystem.Open(p)
+}
+
+func TestOpTimeout(t *testing.T) {
+	fs := &slowFS{FileSystem: newTestFS()}
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: fs,
+			OpTimeout:  50 * time.Millisecond,
+			Retries:    1,
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 250, "CWD /")
+	expect(t, c, 451, "STAT /")
+}
+
+// A brokenFS is a FileSystem whose Stat always fails.
+type brokenFS struct {
+	FileSystem
+}
+
+func (brokenFS) Stat(p string) (os.FileInfo, error) {
+	return nil, errors.New("backend down")
+}
+
+func TestBreaker(t *testing.T) {
+	changes := make(chan bool, 1)
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: brokenFS{newTestFS()},
+			Breaker: &Breaker{
+				Threshold: 2,
+				Cooldown:  time.Minute,
+				OnChange:  func(open bool) { changes <- open },
+			},
+		},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 550, "CWD /")
+	expect(t, c, 550, "CWD /")
+	if !<-changes {
+		t.Error("breaker not opened")
+	}
+	if msg := expect(t, c, 451, "CWD /"); msg != "File system unavailable; try again in 60 seconds." {
+		t.Error("bad reply with the breaker open:", msg)
+	}
+
+	c2, err := textproto.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, msg, err := c2.ReadResponse(421); err != nil {
+		t.Error(err)
+	} else if msg != "Service not available; try again in 60 seconds." {
+		t.Error("bad greeting with the breaker open:", msg)
+	}
+}
+
+func TestRetryHint(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "try again later",
+		time.Second:             "try again in 1 second",
+		90*time.Second + 1:      "try again in 91 seconds",
+		-5 * time.Second:        "try again later",
+		500 * time.Millisecond:  "try again in 1 second",
+		2500 * time.Millisecond: "try again in 3 seconds",
+	} {
+		if got := RetryHint(d); got != want {
+			t.Errorf("RetryHint(%v) = %q, want %q", d, got, want)
+		}
+	}
+
+	now := time.Now()
+	c, done := dialTest(t, &Server{
+		Handler:          &FileHandler{Authorizer: testAuth{}, FileSystem: newTestFS()},
+		MaxLoginFailures: 1,
+		LockoutDuration:  time.Minute,
+		Clock:            func() time.Time { return now },
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 430, "PASS wrong")
+	expect(t, c, 331, "USER foo")
+	if msg := expect(t, c, 421, "PASS bar"); msg != "Too many failed logins; try again in 60 seconds." {
+		t.Error("bad lockout reply:", msg)
+	}
+}
+
+func TestAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	var records []*AuditRecord
+	audit := NewAuditWriter(&buf)
+	s := &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		Auditor: AuditFunc(func(r *AuditRecord) {
+			audit.Audit(r)
+			mu.Lock()
+			records = append(records, r)
+			mu.Unlock()
+		}),
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR a.txt")
+	d.Write([]byte("hello"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 221, "QUIT")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want 5", len(records))
+	}
+	if r := records[1]; r.Cmd != "PASS" || r.Arg != "***" || r.Code != 230 {
+		t.Errorf("bad PASS record: %+v", r)
+	}
+	if r := records[3]; r.Cmd != "STOR" || r.User != "foo" || r.Bytes != 5 || r.Code != 226 {
+		t.Errorf("bad STOR record: %+v", r)
+	}
+	if !strings.Contains(buf.String(), `"cmd":"STOR"`) {
+		t.Error("bad audit log:", buf.String())
+	}
+}
+
+// A chanPublisher is a Publisher sending messages to a channel.
+type chanPublisher chan string
+
+func (p chanPublisher) Publish(topic string, key, value []byte) error {
+	p <- topic + " " + string(key) + " " + string(value)
+	return nil
+}
+
+func TestEventPublisher(t *testing.T) {
+	p := make(chanPublisher, 10)
+	s := &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		Auditor: NewEventPublisher(p, "ftp", nil),
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR a.txt")
+	d.Write([]byte("hello"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 250, "DELE a.txt")
+	expect(t, c, 550, "DELE a.txt")
+
+	for _, want := range []string{
+		`ftp /a.txt {"type":"upload","path":"/a.txt","user":"foo",`,
+		`ftp /a.txt {"type":"delete","path":"/a.txt","user":"foo",`,
+	} {
+		if msg := <-p; !strings.HasPrefix(msg, want) {
+			t.Errorf("got %s, want prefix %s", msg, want)
+		}
+	}
+	if len(p) != 0 {
+		t.Error("unexpected event:", <-p)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	records := make(chan *AuditRecord, 10)
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		Auditor: AuditFunc(func(r *AuditRecord) { records <- r }),
+		Redact: Redaction{
+			Users: RedactHash,
+			Addrs: RedactTruncate,
+			Paths: RedactTruncate,
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 550, "SIZE /dir/secret.txt")
+	<-records
+	<-records
+	r := <-records
+	if r.User == "foo" || !strings.HasPrefix(r.User, "h:") {
+		t.Error("user not redacted:", r.User)
+	}
+	if r.Addr != "127.0.0.0/24" && r.Addr != "::/48" {
+		t.Error("address not redacted:", r.Addr)
+	}
+	if r.Arg != "/dir/*" {
+		t.Error("path not redacted:", r.Arg)
+	}
+}
+
+// A classAuth puts every user in a bandwidth class named after them.
+type classAuth struct{ testAuth }
+
+func (classAuth) AuthorizeAccount(user, pass string) (*Account, error) {
+	return &Account{Class: user}, nil
+}
+
+func TestRedactArgs(t *testing.T) {
+	s := &Session{
+		Server: &Server{Redact: Redaction{Users: RedactTruncate, Paths: RedactRemove}},
+		User:   "élodie",
+	}
+	for _, tt := range []struct {
+		cmd, arg, want string
+	}{
+		{"USER", "élodie", "é*"},
+		{"LIST", "-la /dir/secret.txt", redacted},
+		{"LIST", "-la", "-la"},
+		{"NOOP", "", ""},
+	} {
+		if got := s.logArg(&Command{Cmd: tt.cmd, Msg: tt.arg}); got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.cmd, tt.arg, got, tt.want)
+		}
+	}
+	if got := s.logPath(&Command{Cmd: "LIST", Msg: "-la /dir"}); got != redacted {
+		t.Errorf("got path %q, want %q", got, redacted)
+	}
+
+	s.User = "a"
+	if got, want := s.redactf("user %s: bad password", "a"), "user a*: bad password"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClasses(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write(make([]byte, 2000))
+	f.Close()
+	s := &Server{
+		Handler: &FileHandler{Authorizer: classAuth{}, FileSystem: fs},
+		Classes: map[string]int64{"slow": 10000},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER slow")
+	expect(t, c, 230, "PASS x")
+	d := dialEPSV(t, c, s)
+	start := time.Now()
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 2000 {
+		t.Errorf("got %d bytes, want 2000", len(b))
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("transfer took %v; not limited", d)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	var got []byte
+	s := &Server{Handler: &FileHandler{
+		FileSystem: newTestFS(),
+		Commands: map[string]*Extension{
+			"XGET": {Handle: func(s *Session, c *Command) error {
+				return s.Transfer(func(w io.Writer) error {
+					_, err := io.WriteString(w, "hello")
+					return err
+				})
+			}},
+			"XPUT": {Handle: func(s *Session, c *Command) error {
+				return s.Receive(func(r io.Reader) error {
+					var err error
+					got, err = ioutil.ReadAll(r)
+					return err
+				})
+			}},
+			"XERR": {Handle: func(s *Session, c *Command) error {
+				return s.Transfer(func(w io.Writer) error {
+					return errors.New("oops")
+				})
+			}},
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 425, "XGET")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "XGET")
+	if b, _ := ioutil.ReadAll(d); string(b) != "hello" {
+		t.Errorf("got %q, want %q", b, "hello")
+	}
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+
+	d = dialEPSV(t, c, s)
+	expect(t, c, 150, "XPUT")
+	d.Write([]byte("world"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+
+	d = dialEPSV(t, c, s)
+	expect(t, c, 150, "XERR")
+	d.Close()
+	if _, _, err := c.ReadResponse(451); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An upperConn upper cases what is written to it.
+type upperConn struct {
+	net.Conn
+}
+
+func (c upperConn) Write(b []byte) (int, error) {
+	return c.Conn.Write(bytes.ToUpper(b))
+}
+
+func TestWrapData(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	var wrapped int
+	s := &Server{
+		Handler: &FileHandler{FileSystem: fs},
+		WrapData: func(s *Session, c net.Conn) net.Conn {
+			wrapped++
+			return upperConn{c}
+		},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "HELLO" || wrapped != 1 {
+		t.Errorf("got %q after %d wraps", b, wrapped)
+	}
+}
+
+// A recordConn records what is written to it.
+type recordConn struct {
+	net.Conn
+	mu  *sync.Mutex
+	out *bytes.Buffer
+}
+
+func (c recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.out.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestDrain(t *testing.T) {
+	records := make(chan *AuditRecord, 10)
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Commands: map[string]*Extension{
+				"XDRN": {Handle: func(s *Session, c *Command) error {
+					s.Drain()
+					return s.Reply(200, "Draining.")
+				}},
+			},
+		},
+		Auditor: AuditFunc(func(r *AuditRecord) { records <- r }),
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "XDRN")
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := textproto.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, _, err := c2.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c2, 331, "USER foo")
+	for i := 0; i < 3; i++ {
+		<-records // Commands of the drained session.
+	}
+	if id := (<-records).Session; s.Drain("none") || !s.Drain(id) {
+		t.Fatal("session not found")
+	}
+	if _, _, err := c2.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s := &Server{Handler: &FileHandler{FileSystem: newTestFS()}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	reloads := 0
+	ac, adone := dialTest(t, &Server{Handler: &Admin{
+		Server:     s,
+		Authorizer: testAuth{},
+		Reload:     func() error { reloads++; return nil },
+	}})
+	defer adone()
+	expect(t, ac, 331, "USER foo")
+	expect(t, ac, 430, "PASS wrong")
+	expect(t, ac, 331, "USER foo")
+	expect(t, ac, 230, "PASS bar")
+	expect(t, ac, 257, "PWD")
+
+	list := s.Sessions()
+	if len(list) != 1 || list[0].User != "foo" {
+		t.Fatalf("bad sessions: %+v", list)
+	}
+	if msg := expect(t, ac, 200, "SITE WHO"); !strings.Contains(msg, list[0].ID+" foo ") {
+		t.Error("bad WHO reply:", msg)
+	}
+	expect(t, ac, 200, "SITE LIMIT bulk 1000")
+	if msg := expect(t, ac, 200, "SITE LIMIT"); !strings.Contains(msg, "bulk 1000") {
+		t.Error("bad LIMIT reply:", msg)
+	}
+	if s.classLimiter("bulk") == nil {
+		t.Error("limit not applied")
+	}
+	expect(t, ac, 200, "SITE RELOAD")
+	if reloads != 1 {
+		t.Error("not reloaded")
+	}
+	expect(t, ac, 550, "SITE KICK none")
+	expect(t, ac, 200, "SITE KICK "+list[0].ID)
+	if _, _, err := c.ReadResponse(421); err == nil {
+		t.Error("kicked session replied")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	ac, adone := dialTest(t, &Server{Handler: &Admin{Server: s, Authorizer: testAuth{}}})
+	defer adone()
+	expect(t, ac, 331, "USER foo")
+	expect(t, ac, 230, "PASS bar")
+	expect(t, ac, 200, "SITE READONLY ON Migrating storage.")
+	if msg := expect(t, ac, 200, "SITE READONLY"); msg != "Read-only: Migrating storage." {
+		t.Error("bad READONLY reply:", msg)
+	}
+	for _, cmd := range []string{"MKD b", "DELE a.txt", "RNFR a.txt", "STOR b.txt", "APPE a.txt", "ALLO 10"} {
+		if msg := expect(t, c, 553, cmd); msg != "Migrating storage." {
+			t.Errorf("%s: got %q", cmd, msg)
+		}
+	}
+	if msg := expect(t, c, 250, "MLST a.txt"); !strings.Contains(msg, "perm=r;") {
+		t.Error("bad MLST reply:", msg)
+	}
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q while read-only", b)
+	}
+
+	expect(t, ac, 200, "SITE READONLY OFF")
+	if _, ok := s.ReadOnly(); ok {
+		t.Error("still read-only")
+	}
+	expect(t, c, 257, "MKD b")
+	s.SetReadOnly("")
+	if msg := expect(t, c, 553, "RMD b"); msg != DefaultReadOnly {
+		t.Error("bad RMD reply:", msg)
+	}
+}
+
+func TestHostMux(t *testing.T) {
+	afs, bfs := newTestFS(), newTestFS()
+	f, _ := afs.Create("/a.txt")
+	f.Write([]byte("a"))
+	f.Close()
+	f, _ = bfs.Create("/b.txt")
+	f.Write([]byte("b"))
+	f.Close()
+	m := &HostMux{}
+	m.HandleHost("a.example", &FileHandler{FileSystem: afs})
+	m.HandleHost("B.example", &FileHandler{FileSystem: bfs})
+	s := &Server{Handler: m}
+	c, done := dialTest(t, s)
+	defer done()
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "\n HOST\n") {
+		t.Error("FEAT is missing HOST:", feat)
+	}
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 503, "HOST a.example")
+	expect(t, c, 430, "PASS bar")
+	c.Close()
+
+	for _, tt := range []struct{ host, file, other string }{
+		{"A.example.", "a.txt", "b.txt"},
+		{"b.example", "b.txt", "a.txt"},
+	} {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, c, 504, "HOST c.example")
+		expect(t, c, 220, "HOST "+tt.host)
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		expect(t, c, 213, "SIZE "+tt.file)
+		expect(t, c, 550, "SIZE "+tt.other)
+		expect(t, c, 503, "HOST "+tt.host)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	dial := func(code int, want string) *textproto.Conn {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := c.ReadResponse(code); err != nil || msg != want {
+			t.Errorf("got %q, %v; want %d %s", msg, err, code, want)
+		}
+		return c
+	}
+
+	ac, adone := dialTest(t, &Server{Handler: &Admin{Server: s, Authorizer: testAuth{}}})
+	defer adone()
+	expect(t, ac, 331, "USER foo")
+	expect(t, ac, 230, "PASS bar")
+	if msg := expect(t, ac, 200, "SITE MAINT"); msg != "Not in maintenance." {
+		t.Error("bad MAINT reply:", msg)
+	}
+	expect(t, ac, 501, "SITE MAINT MAYBE")
+	expect(t, ac, 200, "SITE MAINT ON Back at 6.")
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Error("session not drained:", err)
+	}
+	dial(421, "Back at 6.").Close()
+
+	expect(t, ac, 200, "SITE MAINT RO")
+	if msg := expect(t, ac, 200, "SITE MAINT"); msg != "Read-only maintenance: "+DefaultMaintenance {
+		t.Error("bad MAINT reply:", msg)
+	}
+	c = dial(220, DefaultMaintenance)
+	defer c.Close()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 213, "SIZE a.txt")
+	expect(t, c, 550, "MKD b")
+	expect(t, c, 550, "DELE a.txt")
+	if msg := expect(t, c, 250, "MLST a.txt"); !strings.Contains(msg, "perm=r;") {
+		t.Error("bad MLST reply:", msg)
+	}
+
+	expect(t, ac, 200, "SITE MAINT OFF")
+	if _, ok := s.InMaintenance(); ok {
+		t.Error("still in maintenance")
+	}
+	c = dial(220, DefaultGreeting)
+	defer c.Close()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 257, "MKD b")
+}
+
+// An accountAuth authorizes users with the accounts it maps them to.
+type accountAuth map[string]*Account
+
+func (a accountAuth) Authorize(user, pass string) (bool, error) {
+	return a[user] != nil, nil
+}
+
+func (a accountAuth) AuthorizeAccount(user, pass string) (*Account, error) {
+	return a[user], nil
+}
+
+func TestWindows(t *testing.T) {
+	noon := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC) // A Monday.
+	for _, tt := range []struct {
+		w    Window
+		t    time.Time
+		want bool
+	}{
+		{Window{Start: 9 * time.Hour, End: 17 * time.Hour}, noon, true},
+		{Window{Start: 13 * time.Hour, End: 17 * time.Hour}, noon, false},
+		{Window{Days: []time.Weekday{time.Saturday}, Start: 9 * time.Hour, End: 17 * time.Hour}, noon, false},
+		{Window{Days: []time.Weekday{time.Sunday}, Start: 22 * time.Hour, End: 2 * time.Hour}, noon.Add(-11 * time.Hour), true},
+		{Window{Days: []time.Weekday{time.Monday}, Start: 22 * time.Hour, End: 2 * time.Hour}, noon.Add(-11 * time.Hour), false},
+		{Window{Start: 9 * time.Hour, End: 17 * time.Hour, Location: time.FixedZone("", 6*3600)}, noon, false},
+	} {
+		if got := tt.w.Contains(tt.t); got != tt.want {
+			t.Errorf("%+v.Contains(%v) = %v", tt.w, tt.t, got)
+		}
+	}
+
+	start := time.Now()
+	s := &Server{
+		Handler: &FileHandler{
+			Authorizer: accountAuth{
+				"day":   {Windows: []Window{{Start: 11 * time.Hour, End: 12*time.Hour + 200*time.Millisecond, Location: time.UTC}}},
+				"night": {Windows: []Window{{Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC}}},
+			},
+			FileSystem:  newTestFS(),
+			WindowDrain: true,
+		},
+		Clock: func() time.Time { return noon.Add(time.Since(start)) },
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER night")
+	expect(t, c, 530, "PASS x")
+	expect(t, c, 331, "USER day")
+	expect(t, c, 230, "PASS x")
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountState(t *testing.T) {
+	var refused []error
+	s := &Server{Handler: &FileHandler{
+		Authorizer: accountAuth{
+			"expired":  {Expires: time.Now().Add(-time.Hour)},
+			"changing": {PasswordExpired: true},
+			"ok":       {Expires: time.Now().Add(time.Hour)},
+		},
+		FileSystem: newTestFS(),
+		LoginRefused: func(s *Session, err error) {
+			if s.Account == nil && err != ErrLoginIncorrect {
+				t.Errorf("no account for %v", err)
+			}
+			refused = append(refused, err)
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER none")
+	expect(t, c, 430, "PASS x")
+	expect(t, c, 331, "USER expired")
+	expect(t, c, 530, "PASS x")
+	expect(t, c, 331, "USER changing")
+	expect(t, c, 530, "PASS x")
+	expect(t, c, 503, "PASS x")
+	expect(t, c, 331, "USER ok")
+	expect(t, c, 230, "PASS x")
+	want := []error{ErrLoginIncorrect, ErrAccountExpired, ErrPasswordExpired}
+	if fmt.Sprint(refused) != fmt.Sprint(want) {
+		t.Errorf("refused %v, want %v", refused, want)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	s := &Server{Handler: &FileHandler{
+		Authorizer: accountAuth{
+			"a": {Takeover: TakeoverKick},
+			"b": {},
+		},
+		FileSystem: newTestFS(),
+		Takeover:   TakeoverReject,
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER b")
+	expect(t, c, 230, "PASS x")
+
+	dial := func() *textproto.Conn {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c2 := dial()
+	defer c2.Close()
+	expect(t, c2, 331, "USER b")
+	expect(t, c2, 530, "PASS x")
+	expect(t, c2, 331, "USER a")
+	expect(t, c2, 230, "PASS x")
+
+	c3 := dial()
+	defer c3.Close()
+	expect(t, c3, 331, "USER a")
+	expect(t, c3, 230, "PASS x")
+	if _, _, err := c2.ReadResponse(200); err == nil {
+		t.Fatal("old session not closed")
+	}
+	expect(t, c, 200, "NOOP")
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a.txt", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := NewFileJournal(dir + "/journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An upload checkpointed at 4 bytes before a crash.
+	if err := j.Record("/a.txt", "foo", 4); err != nil {
+		t.Fatal(err)
+	}
+	if j, err = NewFileJournal(dir + "/journal"); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: &FileHandler{
+		FileSystem:      &LocalFileSystem{Root: dir},
+		Journal:         j,
+		JournalInterval: 2,
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	d := dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 6")
+	expect(t, c, 554, "STOR a.txt")
+	d.Close()
+
+	d = dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 4")
+	expect(t, c, 150, "STOR a.txt")
+	d.Write([]byte("abc"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/a.txt"); string(b) != "0123abc789" {
+		t.Errorf("got %q, want %q", b, "0123abc789")
+	}
+	if _, _, ok, _ := j.Lookup("/a.txt"); ok {
+		t.Error("journal not cleared")
+	}
+}
+
+// A syncFS counts syncs of the files it creates.
+type syncFS struct {
+	FileSystem
+	syncs int32
+}
+
+func (fs *syncFS) Create(p string) (File, error) {
+	f, err := fs.FileSystem.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	return &countedFile{f, &fs.syncs}, nil
+}
+
+type countedFile struct {
+	File
+	syncs *int32
+}
+
+func (f *countedFile) Sync() error {
+	atomic.AddInt32(f.syncs, 1)
+	return nil
+}
+
+func TestDurability(t *testing.T) {
+	fs := &syncFS{FileSystem: newTestFS()}
+	s := &Server{Handler: &FileHandler{
+		FileSystem: fs,
+		// The caches wrap files created, which must still be synced.
+		StatCacheTTL: time.Minute,
+		ListCacheTTL: time.Minute,
+		DurabilityFor: func(s *Session, path string) Durability {
+			if path == "/a" {
+				return Durability{OnClose: true, Every: 4}
+			}
+			return Durability{}
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	for _, tt := range []struct {
+		name string
+		min  int32
+	}{
+		{"b", 0},
+		{"a", 2},
+	} {
+		atomic.StoreInt32(&fs.syncs, 0)
+		d := dialEPSV(t, c, s)
+		expect(t, c, 150, "STOR "+tt.name)
+		d.Write([]byte("0123456789"))
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&fs.syncs); n < tt.min || tt.min == 0 && n != 0 {
+			t.Errorf("%s: %d syncs, want %d", tt.name, n, tt.min)
+		}
+	}
+}
+
+func TestABOR(t *testing.T) {
+	s := &Server{Handler: &FileHandler{
+		FileSystem: newTestFS(),
+		Generated: map[string]Generator{
+			"/big": func(p string) (io.ReadCloser, os.FileInfo, error) {
+				return ioutil.NopCloser(io.LimitReader(zeros{}, 1<<40)), nil, nil
+			},
+		},
+	}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 226, "ABOR")
+
+	d := dialEPSV(t, c, s)
+	defer d.Close()
+	expect(t, c, 150, "RETR big")
+	if _, err := io.ReadFull(d, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 426, "\xff\xf4\xff\xf2ABOR")
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+
+	d = dialEPSV(t, c, s)
+	defer d.Close()
+	expect(t, c, 150, "STOR a")
+	d.Write([]byte("partial"))
+	expect(t, c, 426, "ABOR")
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 200, "NOOP")
+}
+
+func TestStallTimeout(t *testing.T) {
+	s := &Server{
+		Handler:      &FileHandler{FileSystem: newTestFS()},
+		StallTimeout: 50 * time.Millisecond,
+		ErrorLog:     log.New(ioutil.Discard, "", 0),
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	d := dialEPSV(t, c, s)
+	defer d.Close()
+	expect(t, c, 150, "STOR a")
+	d.Write([]byte("partial"))
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 200, "NOOP")
+}
+
+// A panicReader panics when read.
+type panicReader struct{}
+
+func (panicReader) Read(b []byte) (int, error) { panic("boom") }
+
+func TestTransferPanic(t *testing.T) {
+	errs := make(chan error, 1)
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Generated: map[string]Generator{
+				"/boom": func(p string) (io.ReadCloser, os.FileInfo, error) {
+					return ioutil.NopCloser(panicReader{}), nil, nil
+				},
+			},
+		},
+		ErrorHandler: func(s *Session, err error) { errs <- err },
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	defer d.Close()
+	expect(t, c, 150, "RETR boom")
+	if e, ok := (<-errs).(*PanicError); !ok || e.Value != "boom" {
+		t.Errorf("got %v, want a PanicError", e)
+	}
+
+	// The session is closed while a command is read in the background,
+	// which must neither race nor crash the server. Run with -race.
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		d := dialEPSV(t, c, s)
+		expect(t, c, 150, "RETR boom")
+		<-errs
+		c.ReadResponse(421)
+		d.Close()
+		c.Close()
+	}
+}
+
+func TestSessionsLive(t *testing.T) {
+	s := &Server{Handler: &FileHandler{FileSystem: newTestFS()}}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 257, "MKD d")
+	expect(t, c, 250, "CWD d")
+
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR a")
+	d.Write([]byte("partial"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		list := s.Sessions()
+		if len(list) != 1 {
+			t.Fatal("got", len(list), "sessions")
+		}
+		if si := list[0]; si.Dir == "/d" && si.Cmd == "STOR" && si.Transferred == 7 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("got %+v", si)
+		}
+	}
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An allocFS allocates up to its limit.
+type allocFS struct {
+	FileSystem
+	limit int64
+}
+
+func (fs allocFS) Allocate(size int64) error {
+	if size > fs.limit {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func TestALLO(t *testing.T) {
+	for _, fs := range []FileSystem{newTestFS(), allocFS{newTestFS(), 100}} {
+		// The stat cache wraps the FileSystem, which must forward Allocate.
+		for _, ttl := range []time.Duration{0, time.Minute} {
+			c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs, StatCacheTTL: ttl}})
+			expect(t, c, 331, "USER foo")
+			expect(t, c, 230, "PASS bar")
+			expect(t, c, 200, "ALLO 100")
+			expect(t, c, 200, "ALLO 100 R 512")
+			expect(t, c, 501, "ALLO x")
+			if _, ok := fs.(Allocator); ok {
+				expect(t, c, 552, "ALLO 101")
+			}
+			done()
+		}
+	}
+}
+
+func TestHASH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a.txt", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}},
+	})
+	defer done()
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "HASH SHA-256*;SHA-1;MD5;CRC32") {
+		t.Error("FEAT is missing HASH:", feat)
+	}
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	for _, tt := range []struct {
+		cmds []string
+		want string
+	}{
+		{nil, "SHA-256 0-11 b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 a.txt"},
+		{[]string{"OPTS HASH crc32"}, "CRC32 0-11 0d4a1185 a.txt"},
+		{[]string{"RANG 0 3"}, "CRC32 0-4 1c8600e3 a.txt"},
+		{[]string{"OPTS HASH MD5", "REST 6"}, "MD5 6-11 7d793037a0760186574b0282f2f435e7 a.txt"},
+	} {
+		for _, cmd := range tt.cmds {
+			if strings.HasPrefix(cmd, "REST") || strings.HasPrefix(cmd, "RANG") {
+				expect(t, c, 350, cmd)
+			} else {
+				expect(t, c, 200, cmd)
+			}
+		}
+		if msg := expect(t, c, 213, "HASH a.txt"); msg != tt.want {
+			t.Errorf("HASH after %v = %q, want %q", tt.cmds, msg, tt.want)
+		}
+	}
+	if msg := expect(t, c, 200, "OPTS HASH"); msg != "MD5" {
+		t.Error("bad OPTS HASH reply:", msg)
+	}
+	expect(t, c, 501, "OPTS HASH SHA-512")
+	expect(t, c, 350, "REST 12")
+	expect(t, c, 554, "HASH a.txt")
+	expect(t, c, 550, "HASH b.txt")
+	expect(t, c, 550, "HASH /")
+}
+
+func TestXCRC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a b.txt", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}, HashLimit: 8},
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	for cmd, want := range map[string]string{
+		`XMD5 "a b.txt" 0 5`:     "5D41402ABC4B2A76B9719D911017C592",
+		`XCRC "a b.txt" 6`:       "3A771143",
+		`XSHA1 "a b.txt" 3 3`:    "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709",
+		`XCRC "a b.txt" 4 99999`: "1B6B001A",
+	} {
+		if msg := expect(t, c, 250, cmd); msg != want {
+			t.Errorf("%s = %q, want %q", cmd, msg, want)
+		}
+	}
+	expect(t, c, 550, "XCRC a b.txt")
+	expect(t, c, 550, "HASH a b.txt")
+	expect(t, c, 501, `XMD5 "a b.txt" 5 1`)
+	expect(t, c, 501, `XMD5 "a b.txt`)
+	expect(t, c, 554, `XMD5 "a b.txt" 12`)
+}
+
+func TestReasonCodes(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	c, done := dialTest(t, &Server{
+		Handler:     &FileHandler{FileSystem: fs, HashLimit: 2},
+		ReasonCodes: true,
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	for _, tt := range []struct {
+		code      int
+		cmd, want string
+	}{
+		{550, "SIZE b.txt", "No such file. [ENOENT]"},
+		{550, "SIZE /", "Path specifies a directory. [EISDIR]"},
+		{550, "HASH a.txt", "File too large to hash; the limit is 2 bytes. [EFBIG]"},
+		{550, "CWD a.txt", "Failed to change directory. [ENOTDIR]"},
+		{502, "XYZZY", "Not implemented."},
+	} {
+		if msg := expect(t, c, tt.code, tt.cmd); msg != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.cmd, msg, tt.want)
+		}
+	}
+	if msg := expect(t, c, 213, "SIZE a.txt"); msg != "5" {
+		t.Error("bad SIZE reply:", msg)
+	}
+
+	// Errors of the operating system give their errno names.
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir+"/d/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+	c2, done2 := dialTest(t, &Server{
+		Handler:     &FileHandler{FileSystem: &LocalFileSystem{Root: dir}},
+		ReasonCodes: true,
+	})
+	defer done2()
+	expect(t, c2, 331, "USER foo")
+	expect(t, c2, 230, "PASS bar")
+	if msg := expect(t, c2, 550, "RMD d"); msg != "Could not delete file. [ENOTEMPTY]" {
+		t.Error("bad RMD reply:", msg)
+	}
+}
+
+func TestLANG(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler:     &FileHandler{FileSystem: newTestFS()},
+		ReasonCodes: true,
+		Catalog: Messages{
+			"FR": {
+				"Language set to %s.": "Langue choisie : %s.",
+				"No such file.":       "Fichier introuvable.",
+				"Login successful.":   "Connexion réussie.",
+				"OK.":                 "D'accord.",
+			},
+			"pt-BR": {},
+		},
+	})
+	defer done()
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "LANG EN*;FR;pt-BR\n") {
+		t.Error("bad FEAT reply:", feat)
+	}
+	expect(t, c, 504, "LANG de")
+	for _, tt := range []struct {
+		code      int
+		cmd, want string
+	}{
+		{200, "LANG fr-CA", "Langue choisie : FR."},
+		{331, "USER foo", "Please specify the password."},
+		{230, "PASS bar", "Connexion réussie."},
+		{200, "NOOP", "D'accord."},
+		{550, "SIZE a.txt", "Fichier introuvable. [ENOENT]"},
+		{200, "LANG pt", "Language set to pt-BR."},
+		{200, "LANG", "Language set to EN."},
+	} {
+		if msg := expect(t, c, tt.code, tt.cmd); msg != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.cmd, msg, tt.want)
+		}
+	}
+	expect(t, c, 200, "LANG FR")
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "LANG EN;FR*;pt-BR\n") {
+		t.Error("bad FEAT reply:", feat)
+	}
+}
+
+// A chtimesFS records the access times passed to Chtimes.
+type chtimesFS struct {
+	*LocalFileSystem
+	atime time.Time
+}
+
+func (f *chtimesFS) Chtimes(p string, atime, mtime time.Time) error {
+	f.atime = atime
+	return f.LocalFileSystem.Chtimes(p, atime, mtime)
+}
+
+func TestMFMT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/a b.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &chtimesFS{LocalFileSystem: &LocalFileSystem{Root: dir}}
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: fs, StatCacheTTL: time.Minute},
+	})
+	defer done()
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "MFMT") {
+		t.Error("FEAT is missing MFMT:", feat)
+	}
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 213, "MDTM a b.txt")
+	if msg := expect(t, c, 213, "MFMT 20150102030405.123 a b.txt"); msg != "Modify=20150102030405; a b.txt" {
+		t.Error("bad MFMT reply:", msg)
+	}
+	if msg := expect(t, c, 213, "MDTM a b.txt"); msg != "20150102030405" {
+		t.Error("bad MDTM reply:", msg)
+	}
+	if !fs.atime.IsZero() {
+		t.Error("MFMT changed the access time to", fs.atime)
+	}
+	expect(t, c, 501, "MFMT 2015 a b.txt")
+	expect(t, c, 501, "MFMT 20150102030405")
+	expect(t, c, 550, "MFMT 20150102030405 c.txt")
+
+	c2, done2 := dialTest(t, &Server{Handler: &FileHandler{FileSystem: newTestFS()}})
+	defer done2()
+	expect(t, c2, 331, "USER foo")
+	expect(t, c2, 230, "PASS bar")
+	expect(t, c2, 502, "MFMT 20150102030405 a.txt")
+}
+
+func TestTarpit(t *testing.T) {
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	for _, tt := range []struct {
+		net  *net.IPNet
+		slow bool
+	}{{other, false}, {local, true}} {
+		s := &Server{
+			Handler: &FileHandler{FileSystem: newTestFS()},
+			Tarpit:  TarpitNets(100*time.Millisecond, tt.net),
+		}
+		start := time.Now()
+		c, done := dialTest(t, s)
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		expect(t, c, 200, "NOOP")
+		done()
+		if slow := time.Since(start) >= 300*time.Millisecond; slow != tt.slow {
+			t.Errorf("%v: slow %v, want %v", tt.net, slow, tt.slow)
+		}
+	}
+}
+
+func TestCountryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	country := "DE"
+	var flagged []string
+	p := &CountryPolicy{
+		Lookup: func(ip net.IP) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return country, nil
+		},
+		Deny:  []string{"XX"},
+		Users: map[string][]string{"foo": {"de"}, "baz": {"FR"}},
+		Unexpected: func(user string, ip net.IP, country string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			flagged = append(flagged, user+" "+country)
+			if user == "baz" {
+				return ErrCountry
+			}
+			return nil
+		},
+	}
+	s := &Server{
+		Handler: &FileHandler{
+			Authorizer: accountAuth{"foo": {}, "bar": {}, "baz": {}},
+			FileSystem: newTestFS(),
+		},
+		Access: p,
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS x")
+
+	dial := func(code int) *textproto.Conn {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c2 := dial(220)
+	defer c2.Close()
+	expect(t, c2, 331, "USER baz")
+	expect(t, c2, 530, "PASS x")
+	mu.Lock()
+	if want := "[baz DE]"; fmt.Sprint(flagged) != want {
+		t.Errorf("flagged %v, want %s", flagged, want)
+	}
+	country = "XX"
+	mu.Unlock()
+	dial(421).Close()
+}
+
+func TestWrapControl(t *testing.T) {
+	var mu sync.Mutex
+	var out bytes.Buffer
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		WrapControl: func(c net.Conn) net.Conn {
+			return recordConn{c, &mu, &out}
+		},
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(out.String(), "\r\n230 ") {
+		t.Errorf("control traffic not recorded: %q", out.String())
+	}
+	mu.Unlock()
+
+	// After AUTH TLS, the wrapper still sees plaintext.
+	s := &Server{
+		Handler:     &FileHandler{FileSystem: newTestFS()},
+		TLS:         newTLS(),
+		ExplicitTLS: true,
+		WrapControl: func(c net.Conn) net.Conn {
+			return recordConn{c, &mu, &out}
+		},
+	}
+	_, done2 := dialTest(t, s)
+	defer done2()
+	raw, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	c = textproto.NewConn(raw)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 234, "AUTH TLS")
+	c = textproto.NewConn(tls.Client(raw, &tls.Config{InsecureSkipVerify: true}))
+	mu.Lock()
+	out.Reset()
+	mu.Unlock()
+	expect(t, c, 331, "USER foo")
+	mu.Lock()
+	if !strings.Contains(out.String(), "331 ") {
+		t.Errorf("TLS control traffic not recorded in plaintext: %q", out.String())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var now time.Time
+	s := &Server{
+		Clock:   func() time.Time { return now },
+		Classes: map[string]int64{"bulk": 100},
+		Schedule: []BandwidthWindow{
+			{Start: 9 * time.Hour, End: 17 * time.Hour, Class: "bulk", Rate: 50},
+			{Start: 22 * time.Hour, End: 6 * time.Hour, Rate: 1000},
+		},
+	}
+	for _, test := range []struct {
+		hour  int
+		class string
+		rate  int64
+	}{
+		{10, "bulk", 50},
+		{20, "bulk", 100},
+		{20, "", 0},
+		{23, "", 1000},
+		{3, "", 1000},
+	} {
+		now = time.Date(2016, 1, 1, test.hour, 0, 0, 0, time.UTC)
+		if rate := s.classRate(test.class); rate != test.rate {
+			t.Errorf("%d:00 %q: got rate %d, want %d", test.hour, test.class, rate, test.rate)
+		}
+	}
+	if s.classLimiter("other") != nil || s.classLimiter("") == nil {
+		t.Error("bad limiters")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var l limiter
+	now := time.Now()
+	if c := l.cost(0, now); c != 1 {
+		t.Errorf("alone: got cost %v, want 1", c)
+	}
+	l.cost(2, now)
+	for _, test := range []struct {
+		prio int
+		cost float64
+	}{
+		{2, 1},
+		{1, 4},
+		{0, 16},
+	} {
+		if c := l.cost(test.prio, now); c != test.cost {
+			t.Errorf("priority %d: got cost %v, want %v", test.prio, c, test.cost)
+		}
+	}
+	if c := l.cost(0, now.Add(2*time.Second)); c != 1 {
+		t.Errorf("after idle: got cost %v, want 1", c)
+	}
+}
+
+func TestClientHello(t *testing.T) {
+	dial, done := listenTLS(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Commands: map[string]*Extension{
+				"XSNI": {Public: true, Handle: func(s *Session, c *Command) error {
+					return s.ReplyString(200, s.ClientHello().ServerName)
+				}},
+			},
+		},
+		TLS: newTLS(),
+		ClientHello: func(hello *tls.ClientHelloInfo) error {
+			if hello.ServerName == "bad.example.com" {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+	})
+	defer done()
+
+	if _, err := dial(&tls.Config{ServerName: "bad.example.com", InsecureSkipVerify: true}); err == nil {
+		t.Error("blocked client connected")
+	}
+	c, err := dial(&tls.Config{ServerName: "ftp.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if msg := expect(t, c, 200, "XSNI"); msg != "ftp.example.com" {
+		t.Error("bad server name:", msg)
+	}
+}
+
+func TestDataCertBinding(t *testing.T) {
+	fs := newTestFS()
+	config := newTLS()
+	config.ClientAuth = tls.RequireAnyClientCert
+	s := &Server{
+		Handler:         &FileHandler{FileSystem: fs},
+		TLS:             config,
+		DataCertBinding: true,
+	}
+	dial, done := listenTLS(t, s)
+	defer done()
+
+	cert := newCert()
+	c, err := dial(&tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "PROT P")
+	for i, test := range []struct {
+		cert tls.Certificate
+		ok   bool
+	}{
+		{cert, true},
+		{newCert(), false},
+		{newCert("foo"), true},
+	} {
+		f, _ := fs.Create("/a.txt")
+		f.Write([]byte("hello"))
+		f.Close()
+		d := tls.Client(dialEPSV(t, c, s), &tls.Config{
+			Certificates:       []tls.Certificate{test.cert},
+			InsecureSkipVerify: true,
+		})
+		expect(t, c, 150, "RETR a.txt")
+		b, _ := ioutil.ReadAll(d)
+		d.Close()
+		_, _, err := c.ReadResponse(226)
+		if got := err == nil && string(b) == "hello"; got != test.ok {
+			t.Errorf("%d: got transfer %v, want %v", i, got, test.ok)
+		}
+	}
+}
+
+func TestAuthTLS(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{
+		Handler:     &FileHandler{FileSystem: fs},
+		TLS:         newTLS(),
+		ExplicitTLS: true,
+		RequireTLS:  true,
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	if feat := expect(t, c, 211, "FEAT"); !strings.Contains(feat, "AUTH TLS") {
+		t.Error("FEAT is missing AUTH TLS:", feat)
+	}
+	expect(t, c, 503, "PBSZ 0")
+	expect(t, c, 504, "AUTH KERBEROS_V4")
+	// Commands sent before the handshake must not be taken as protected.
+	if err := c.PrintfLine("AUTH TLS\r\nUSER foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(503); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(530); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 503, "PASS bar")
+
+	raw, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	c = textproto.NewConn(raw)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 234, "AUTH TLS")
+	c = textproto.NewConn(tls.Client(raw, &tls.Config{InsecureSkipVerify: true}))
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 503, "AUTH TLS")
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+	d := tls.Client(dialEPSV(t, c, s), &tls.Config{InsecureSkipVerify: true})
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q over TLS", b)
+	}
+}
+
+func TestCCC(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{
+		Handler:     &FileHandler{FileSystem: fs},
+		TLS:         newTLS(),
+		ExplicitTLS: true,
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 534, "CCC")
+	s.AllowCCC = true
+	expect(t, c, 533, "CCC")
+
+	raw, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	c = textproto.NewConn(raw)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 234, "AUTH TLS")
+	tc := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	c = textproto.NewConn(tc)
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+	expect(t, c, 200, "CCC")
+	if err := tc.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, tc); err != nil {
+		t.Fatal(err)
+	}
+	raw.SetWriteDeadline(time.Time{})
+	// The control connection is plaintext; data connections stay protected.
+	c = textproto.NewConn(raw)
+	expect(t, c, 200, "NOOP")
+	expect(t, c, 533, "CCC")
+	d := tls.Client(dialEPSV(t, c, s), &tls.Config{InsecureSkipVerify: true})
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q over TLS", b)
+	}
+}
+
+func TestPresetHardened(t *testing.T) {
+	dial, done := listenTLS(t, &Server{
+		Handler: &FileHandler{Authorizer: testAuth{}, FileSystem: newTestFS()},
+		TLS:     newTLS(),
+		Preset:  PresetHardened,
+	})
+	defer done()
+
+	if _, err := dial(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Error("TLS 1.1 accepted")
+	}
+	c, err := dial(&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 530, "USER anonymous")
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 502, "PORT 127,0,0,1,100,100")
+	expect(t, c, 521, "EPSV")
+	expect(t, c, 200, "PROT P")
+	expect(t, c, 229, "EPSV")
+	c.Close()
+
+	c, err = dial(&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 430, "PASS wrong")
+	}
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 421, "PASS bar")
+}
+
+func TestValidate(t *testing.T) {
+	good := newTLS()
+	bad := newTLS()
+	bad.Certificates[0].PrivateKey = newCert().PrivateKey
+	for _, test := range []struct {
+		s    *Server
+		want string
+	}{
+		{&Server{Handler: &FileHandler{FileSystem: newTestFS()}, TLS: good}, ""},
+		{&Server{}, "Handler is nil"},
+		{&Server{Handler: &FileHandler{}, TLS: bad}, "doesn't match"},
+		{&Server{Handler: &FileHandler{}, PassivePorts: PortRange{5000, 5009}, MaxSessions: 20}, "10 ports for up to 20 sessions"},
+		{&Server{Handler: &FileHandler{}, PublicIP: net.ParseIP("0.0.0.0")}, "PublicIP"},
+		{&Server{Handler: &FileHandler{}, Preset: PresetHardened}, "requires TLS"},
+	} {
+		err := test.s.Validate()
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("got %v, want %q", err, test.want)
+		}
+	}
+
+	s := &Server{Handler: &FileHandler{FileSystem: newTestFS()}}
+	if err := s.SelfCheck(); err != nil {
+		t.Error(err)
+	}
+	s.Handler = &FileHandler{FileSystem: brokenFS{newTestFS()}}
+	if err := s.SelfCheck(); err == nil {
+		t.Error("broken file system passed")
+	}
+}
+
+// A quotaFS is a FileSystem with a fixed quota.
+type quotaFS struct {
+	FileSystem
+}
+
+func (quotaFS) Quota(user string) (int64, int64, error) {
+	return 300, 1000, nil
+}
+
+func TestQuota(t *testing.T) {
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: quotaFS{newTestFS()}}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 200, "SITE QUOTA"); !strings.Contains(msg, "Remaining: 700 bytes") {
+		t.Error("bad quota:", msg)
+	}
+	expect(t, c, 214, "HELP SITE QUOTA")
+}
+
+// An offlineFS reports every file as being recalled from tape.
+type offlineFS struct {
+	FileSystem
+	retry time.Duration
+}
+
+func (fs offlineFS) Open(p string) (File, error) {
+	return nil, &OfflineError{Path: p, RetryAfter: fs.retry}
+}
+
+func TestOffline(t *testing.T) {
+	for _, test := range []struct {
+		retry time.Duration
+		msg   string
+	}{
+		{0, "try again later."},
+		{1500 * time.Millisecond, "try again in 2 seconds."},
+	} {
+		s := &Server{Handler: &FileHandler{FileSystem: offlineFS{newTestFS(), test.retry}}}
+		c, done := dialTest(t, s)
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		d := dialEPSV(t, c, s)
+		if msg := expect(t, c, 450, "RETR a.txt"); !strings.HasSuffix(msg, test.msg) {
+			t.Error("bad reply:", msg)
+		}
+		d.Close()
+		done()
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/sub/a.txt", []byte("hello"), 0644)
+	s := &Server{Handler: &FileHandler{FileSystem: &LocalFileSystem{Root: dir}, ResumeTTL: time.Minute}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 250, "CWD sub")
+	token := strings.TrimPrefix(expect(t, c, 200, "SITE RESUME"), "Resume token: ")
+	expect(t, c, 350, "RNFR a.txt")
+	c.Close()
+
+	login := func(user string) *textproto.Conn {
+		c, err := textproto.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ReadResponse(220)
+		expect(t, c, 331, "USER "+user)
+		expect(t, c, 230, "PASS bar")
+		return c
+	}
+	c = login("other")
+	expect(t, c, 550, "SITE RESUME "+token)
+	c.Close()
+
+	c = login("foo")
+	defer c.Close()
+	// The dropped session may take a moment to end.
+	for i := 0; ; i++ {
+		c.PrintfLine("SITE RESUME %s", token)
+		if _, _, err := c.ReadResponse(200); err == nil {
+			break
+		} else if i == 10 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect(t, c, 250, "RNTO b.txt")
+	if msg := expect(t, c, 257, "PWD"); !strings.Contains(msg, `"/sub"`) {
+		t.Error("bad directory:", msg)
+	}
+	expect(t, c, 550, "SITE RESUME "+token)
+}
+
+func TestDirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/a/b", 0755)
+	ioutil.WriteFile(dir+"/a/x", make([]byte, 10), 0644)
+	ioutil.WriteFile(dir+"/a/b/y", make([]byte, 10), 0644)
+	fs := &LocalFileSystem{Root: dir}
+	for _, test := range []struct {
+		depth int
+		code  int
+	}{
+		{0, 502},
+		{1, 550},
+		{2, 213},
+	} {
+		c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs, DirSizeDepth: test.depth}})
+		expect(t, c, 331, "USER foo")
+		expect(t, c, 230, "PASS bar")
+		if msg := expect(t, c, test.code, "SITE DSIZ /a"); test.code == 213 && msg != "20" {
+			t.Error("bad size:", msg)
+		}
+		done()
+	}
+}
+
+// A readOnlyAuth permits only reading.
+type readOnlyAuth struct{ testAuth }
+
+func (readOnlyAuth) Permit(user, path string) Perm {
+	return PermEnter | PermList | PermRead
+}
+
+func TestPermitter(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	c, done := dialTest(t, &Server{Handler: &FileHandler{Authorizer: readOnlyAuth{}, FileSystem: fs}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	msg := expect(t, c, 250, "MLST /a.txt")
+	if lines := strings.Split(msg, "\n"); len(lines) != 3 || !strings.Contains(lines[1], "perm=r;") {
+		t.Error("bad perm fact:", msg)
+	}
+	expect(t, c, 550, "DELE /a.txt")
+	expect(t, c, 550, "MKD /dir")
+	expect(t, c, 550, "RNFR /a.txt")
+	expect(t, c, 250, "CWD /")
+}
+
+// A createAuth permits creating files in /in and renaming them, but not
+// overwriting or appending to them.
+type createAuth struct{ testAuth }
+
+func (createAuth) Permit(user, p string) Perm {
+	if p == "/in" {
+		return PermCreate | PermEnter | PermList
+	}
+	return PermRead | PermRename
+}
+
+func TestPermitCreate(t *testing.T) {
+	fs := newTestFS()
+	fs.Mkdir("/in")
+	f, _ := fs.Create("/in/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{Authorizer: createAuth{}, FileSystem: fs}}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	for _, cmd := range []string{"STOR /in/a.txt", "APPE /in/a.txt"} {
+		d := dialEPSV(t, c, s)
+		expect(t, c, 550, cmd)
+		d.Close()
+	}
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR /in/b.txt")
+	d.Write([]byte("new"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 350, "RNFR /in/b.txt")
+	expect(t, c, 550, "RNTO /in/a.txt")
+	expect(t, c, 350, "RNFR /in/b.txt")
+	expect(t, c, 550, "RNTO /c.txt")
+	expect(t, c, 350, "RNFR /in/b.txt")
+	expect(t, c, 250, "RNTO /in/c.txt")
+	if stat, _ := fs.Stat("/in/a.txt"); stat.Size() != 5 {
+		t.Errorf("a.txt was overwritten")
+	}
+}
+
+func TestVirtual(t *testing.T) {
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Virtual: map[string]*VirtualFile{
+				"/README.txt": {Content: func(s *Session) []byte {
+					return []byte("Hello, " + s.User + ".\n")
+				}},
+			},
+		},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 213, "STAT /"); !strings.Contains(msg, "README.txt") {
+		t.Error("virtual file not listed:", msg)
+	}
+	expect(t, c, 213, "SIZE README.txt")
+	expect(t, c, 550, "DELE README.txt")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR README.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Hello, foo.\n" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestGenerated(t *testing.T) {
+	mod := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Generated: map[string]Generator{
+				"/report.csv": func(p string) (io.ReadCloser, os.FileInfo, error) {
+					content := "name,size\n" + p + ",1\n"
+					fi := &stat{size: int64(len(content)), mode: 0444, time: mod}
+					return ioutil.NopCloser(strings.NewReader(content)), fi, nil
+				},
+			},
+		},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 213, "STAT /"); !strings.Contains(msg, "report.csv") {
+		t.Error("generated file not listed:", msg)
+	}
+	if msg := expect(t, c, 213, "SIZE report.csv"); msg != "24" {
+		t.Error("bad SIZE reply:", msg)
+	}
+	if msg := expect(t, c, 213, "MDTM report.csv"); msg != "20160102150405" {
+		t.Error("bad MDTM reply:", msg)
+	}
+	expect(t, c, 550, "DELE report.csv")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 350, "REST 10")
+	expect(t, c, 150, "RETR report.csv")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "/report.csv,1\n" {
+		t.Errorf("got %q", b)
+	}
+}
+
+// A bufferSink is a Sink's WriteCloser recording what was written.
+type bufferSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferSink) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestSinks(t *testing.T) {
+	fs := newTestFS()
+	var got *bufferSink
+	var gotPath string
+	s := &Server{
+		Handler: &FileHandler{
+			FileSystem: fs,
+			Sinks: map[string]Sink{
+				"/queue": func(p string) (io.WriteCloser, error) {
+					got, gotPath = new(bufferSink), p
+					return got, nil
+				},
+			},
+		},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "STOR queue")
+	d.Write([]byte("event"))
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.String() != "event" || !got.closed || gotPath != "/queue" {
+		t.Errorf("sink got %+v for %q", got, gotPath)
+	}
+	expect(t, c, 550, "SIZE queue")
+}
+
+func TestDirMessage(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/.message")
+	f.Write([]byte("Welcome!\r\nUploads go in /incoming.\r\n"))
+	f.Close()
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs, DirMessage: ".message"}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	want := "Welcome!\n Uploads go in /incoming.\nDirectory successfully changed."
+	for i := 0; i < 2; i++ {
+		if msg := expect(t, c, 250, "CWD /"); msg != want {
+			t.Errorf("got %q, want %q", msg, want)
+		}
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{
+			FileSystem: newTestFS(),
+			Welcome: func(s *Session) []string {
+				return []string{"Hello " + s.User + ".", "2 files are awaiting review."}
+			},
+		},
+	})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	want := "Hello foo.\n 2 files are awaiting review.\nLogin successful."
+	if msg := expect(t, c, 230, "PASS bar"); msg != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/caf\u00e9")
+	f.Write([]byte("x"))
+	f.Close()
+	f, _ = fs.Create("/na\u0308ive")
+	f.Write([]byte("x"))
+	f.Close()
+	nfc := strings.NewReplacer("e\u0301", "\u00e9", "a\u0308", "\u00e4").Replace
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs, Normalize: nfc}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 213, "SIZE cafe\u0301")
+	if msg := expect(t, c, 213, "STAT /"); !strings.Contains(msg, "n\u00e4ive") {
+		t.Error("name not normalized:", msg)
+	}
+}
+
+func TestControlChars(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/evil\r\n226 fake")
+	f.Write([]byte("x"))
+	f.Close()
+	f, _ = fs.Create("/good")
+	f.Write([]byte("x"))
+	f.Close()
+
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs}})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 501, "SIZE evil\x01")
+	msg := expect(t, c, 213, "STAT /")
+	if !strings.Contains(msg, "evil??226 fake") || strings.Contains(msg, "\r") {
+		t.Error("name not escaped:", msg)
+	}
+
+	c, done = dialTest(t, &Server{Handler: &FileHandler{FileSystem: fs, ControlChars: ControlOmit}})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	msg = expect(t, c, 213, "STAT /")
+	if strings.Contains(msg, "evil") || !strings.Contains(msg, "good") {
+		t.Error("name not omitted:", msg)
+	}
+}
+
+func TestActiveTarget(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	c, done := dialTest(t, &Server{
+		Handler:         &FileHandler{FileSystem: newTestFS()},
+		ActiveBlocklist: []*net.IPNet{private},
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 504, "PORT 127,0,0,1,0,25")
+	expect(t, c, 504, "EPRT |1|10.1.2.3|2121|")
+	expect(t, c, 504, "EPRT |2|::1|22|")
+}
+
+func TestActivePolicy(t *testing.T) {
+	var got []string
+	c, done := dialTest(t, &Server{
+		Handler: &FileHandler{FileSystem: newTestFS()},
+		ActivePolicy: func(addr net.Addr) error {
+			got = append(got, addr.String())
+			return errors.New("denied")
+		},
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 504, "EPRT |1|169.254.169.254|8080|")
+	expect(t, c, 504, "PORT 127,0,0,1,0,25")
+	if fmt.Sprint(got) != "[169.254.169.254:8080]" {
+		t.Error("bad policy calls:", got)
+	}
+}
+
+func TestReplyPercent(t *testing.T) {
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: newTestFS()}})
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 257, "MKD 100%s%d"); msg != `"/100%s%d" created.` {
+		t.Errorf("bad MKD reply: %q", msg)
+	}
+	if msg := expect(t, c, 502, "HELP %x"); !strings.Contains(msg, "%X") {
+		t.Errorf("bad HELP reply: %q", msg)
+	}
+}
+
+func TestCommandParsing(t *testing.T) {
+	var c Command
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader("site chmod 644 a b\r\n")))
+	if err := c.Decode(r); err != nil {
+		t.Fatal(err)
+	}
+	if c.Raw != "site chmod 644 a b" || c.Cmd != "SITE" {
+		t.Errorf("bad command: %+v", c)
+	}
+	if sub := c.Sub(); sub.Cmd != "CHMOD" || sub.Msg != "644 a b" || sub.Raw != "chmod 644 a b" {
+		t.Errorf("bad subcommand: %+v", sub)
+	}
+
+	for _, test := range []struct {
+		msg, facts, rest string
+	}{
+		{"modify=20160102150405;UNIX.mode=0644; a b", "map[modify:20160102150405 unix.mode:0644]", "a b"},
+		{"type;size;", "map[size: type:]", ""},
+		{"a b", "map[]", "a b"},
+	} {
+		facts, rest := (&Command{Msg: test.msg}).Facts()
+		if fmt.Sprint(facts) != test.facts || rest != test.rest {
+			t.Errorf("%q: got %v, %q", test.msg, facts, rest)
+		}
+	}
+}
+
+func TestShaper(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := (&Shaper{Latency: 10 * time.Millisecond, Bandwidth: 100}).shape(a)
+	defer c.Close()
+
+	// Writes are split into chunks of 1/10th of a second of bandwidth,
+	// each delayed by the latency and its transfer time.
+	start := time.Now()
+	go c.Write([]byte("hello world, slowly"))
+	buf := make([]byte, 64)
+	var got []byte
+	for len(got) < 19 {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 10 {
+			t.Errorf("write chunk of %d bytes, want at most 10", n)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello world, slowly" {
+		t.Errorf("got %q", got)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("19 bytes written in %v, want at least 200ms", d)
+	}
+
+	// Reads return at most one chunk, delayed likewise.
+	go b.Write([]byte("0123456789abcdef"))
+	start = time.Now()
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "0123456789" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+	if d := time.Since(start); d < 110*time.Millisecond {
+		t.Errorf("10 bytes read in %v, want at least 110ms", d)
+	}
+	if nc := c.(interface{ NetConn() net.Conn }).NetConn(); nc != a {
+		t.Error("NetConn didn't return the shaped connection")
+	}
+}
+
+func TestShaperTransfer(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello world"))
+	f.Close()
+	s := &Server{
+		Handler: &FileHandler{FileSystem: fs},
+		Shaper:  &Shaper{Bandwidth: 50},
+	}
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+
+	start := time.Now()
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("got %q", b)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("11 bytes at 50 bytes/s took %v, want at least 200ms", d)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	nc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ActiveConn((&Shaper{}).shape(nc))
+	defer c.Close()
+
+	c.Write([]byte("hi"))
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(peer); string(b) != "hi" {
+		t.Errorf("got %q, want %q", b, "hi")
+	}
+	peer.Write([]byte("ok"))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ok" {
+		t.Errorf("read after CloseWrite: %q, %v", b, err)
+	}
+}
+
+func TestConnAccept(t *testing.T) {
+	// Methods waiting for a connection must return once one is accepted or
+	// accepting fails, rather than waiting forever.
+	wait := func(name string, f func()) {
+		done := make(chan struct{})
+		go func() {
+			f()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal(name, "still waiting for a connection")
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := PassiveConn(l)
+	defer c.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	wait("passive", func() {
+		if addr := c.RemoteAddr(); addr == nil || addr.String() != peer.LocalAddr().String() {
+			t.Errorf("RemoteAddr = %v, want %v", addr, peer.LocalAddr())
+		}
+	})
+	wait("active", func() {
+		if addr := ActiveConn(peer).LocalAddr(); addr != peer.LocalAddr() {
+			t.Errorf("LocalAddr = %v, want %v", addr, peer.LocalAddr())
+		}
+	})
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = PassiveConn(l)
+	l.Close()
+	wait("failed", func() {
+		if err := c.SetDeadline(time.Now()); err == nil {
+			t.Error("SetDeadline succeeded without a connection")
+		}
+	})
+}
+
+func TestFaults(t *testing.T) {
+	fs := newTestFS()
+	f, _ := fs.Create("/a.txt")
+	f.Write([]byte("hello world"))
+	f.Close()
+	s := &Server{Handler: &FileHandler{FileSystem: fs, Faults: []Fault{
+		{Cmd: "mkd", Code: 450},
+		{Cmd: "RETR", Path: "/reset*", ResetAfter: 3},
+		{Cmd: "RETR", Path: "/a.txt", TruncateAt: 5},
+		{Cmd: "SIZE", Path: "/a.txt", Code: 451, Msg: "Try again later."},
+	}}}
+	f, _ = fs.Create("/reset.txt")
+	f.Write([]byte("hello world"))
+	f.Close()
+	c, done := dialTest(t, s)
+	defer done()
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	expect(t, c, 200, "TYPE I")
+
+	if msg := expect(t, c, 450, "MKD b"); msg != "Injected fault." {
+		t.Error("bad MKD reply:", msg)
+	}
+	if msg := expect(t, c, 451, "SIZE a.txt"); msg != "Try again later." {
+		t.Error("bad SIZE reply:", msg)
+	}
+	expect(t, c, 213, "SIZE reset.txt")
+
+	d := dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR a.txt")
+	b, _ := ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("truncated RETR got %q, want %q", b, "hello")
+	}
+
+	d = dialEPSV(t, c, s)
+	expect(t, c, 150, "RETR reset.txt")
+	b, _ = ioutil.ReadAll(d)
+	d.Close()
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hel" {
+		t.Errorf("reset RETR got %q, want %q", b, "hel")
+	}
+
+	// A fault replying to a transfer closes its data connection.
+	d = dialEPSV(t, c, s)
+	expect(t, c, 450, "MKD c")
+	d.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := d.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("data connection not closed:", err)
+	}
+	d.Close()
+}
+
+func TestMux(t *testing.T) {
+	root, reports := newTestFS(), newTestFS()
+	f, _ := root.Create("/top.txt")
+	f.Write([]byte("x"))
+	f.Close()
+	f, _ = reports.Create("/daily.csv")
+	f.Write([]byte("a,b\n"))
+	f.Close()
+	m := &Mux{Root: root}
+	m.Mount("/reports", reports)
+	m.Mount("/deep/er", newTestFS())
+	c, done := dialTest(t, &Server{Handler: &FileHandler{FileSystem: m}})
+	defer done()
+
+	expect(t, c, 331, "USER foo")
+	expect(t, c, 230, "PASS bar")
+	if msg := expect(t, c, 213, "STAT /"); !strings.Contains(msg, "top.txt") ||
+		!strings.Contains(msg, "reports") || !strings.Contains(msg, "deep") {
+		t.Error("mounts not listed:", msg)
+	}
+	expect(t, c, 250, "CWD reports")
+	if msg := expect(t, c, 257, "PWD"); msg != `"/reports" is the current directory.` {
+		t.Error("bad PWD reply:", msg)
+	}
+	if msg := expect(t, c, 213, "SIZE daily.csv"); msg != "4" {
+		t.Error("bad SIZE reply:", msg)
+	}
+	expect(t, c, 550, "SIZE /top.txt/daily.csv")
+	expect(t, c, 350, "RNFR daily.csv")
+	expect(t, c, 550, "RNTO /daily.csv")
+	expect(t, c, 250, "CWD /deep")
+	if msg := expect(t, c, 213, "STAT /deep"); !strings.Contains(msg, " er") {
+		t.Error("mount not listed:", msg)
+	}
+	expect(t, c, 250, "CWD er")
+	expect(t, c, 550, "DELE /reports")
+}
+
+// Log in to a new session of s, send a NOOP, and quit.
+func benchSession(s *Server) error {
+	c, err := textproto.Dial("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+	for _, cmd := range []struct {
+		code int
+		cmd  string
+	}{{331, "USER foo"}, {230, "PASS bar"}, {200, "NOOP"}, {2, "QUIT"}} {
+		if _, err := c.Cmd("%s", cmd.cmd); err != nil {
+			return err
+		}
+		if _, _, err := c.ReadResponse(cmd.code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkSessions(b *testing.B) {
+	s := &Server{Handler: &FileHandler{FileSystem: newTestFS()}, ProfileLabels: true}
+	_, done := dialTest(b, s)
+	defer done()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := benchSession(s); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSmallFiles(b *testing.B) {
+	s := &Server{Handler: &FileHandler{FileSystem: newTestFS()}}
+	c, done := dialTest(b, s)
+	defer done()
+	expect(b, c, 331, "USER foo")
+	expect(b, c, 230, "PASS bar")
+	data := make([]byte, 1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := dialEPSV(b, c, s)
+		expect(b, c, 150, "STOR "+strconv.Itoa(i))
+		d.Write(data)
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A zeros reads zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	const size = 1 << 30
+	s := &Server{Handler: &FileHandler{
+		FileSystem: newTestFS(),
+		Generated: map[string]Generator{
+			"/big": func(p string) (io.ReadCloser, os.FileInfo, error) {
+				return ioutil.NopCloser(io.LimitReader(zeros{}, size)), &stat{name: "big", size: size, mode: 0444}, nil
+			},
+		},
+	}}
+	c, done := dialTest(b, s)
+	defer done()
+	expect(b, c, 331, "USER foo")
+	expect(b, c, 230, "PASS bar")
+	expect(b, c, 200, "TYPE I")
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := dialEPSV(b, c, s)
+		expect(b, c, 150, "RETR big")
+		if n, err := io.Copy(ioutil.Discard, d); err != nil || n != size {
+			b.Fatal(n, err)
+		}
+		d.Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
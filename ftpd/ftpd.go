@@ -18,6 +18,10 @@ func main() {
 			FileSystem: &ftp.LocalFileSystem{},
 		},
 	}
+	if err := server.Validate(); err != nil {
+		fmt.Println(err)
+		return
+	}
 	_, err := server.ListenAndServe(false)
 	fmt.Println(err)
 }
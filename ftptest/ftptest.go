@@ -0,0 +1,264 @@
+// Package ftptest provides a conformance harness for ftp.Handler
+// implementations. It runs scripted command and reply exchanges covering RFC
+// 959, 2389, 2428, and 3659 behaviors against a live server.
+package ftptest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/igneous-systems/ftp"
+)
+
+// An Exchange is a single command and the reply codes acceptable in response.
+type Exchange struct {
+	Cmd   string // Cmd is the full command line to send.
+	Codes []int  // Codes are the acceptable final reply codes.
+
+	// Data opens a passive data connection before sending Cmd, unless one
+	// was opened by a previous exchange and has not been used yet. If the
+	// server sends a preliminary reply, Upload is written to the data
+	// connection, or if Upload is nil the data connection is read until EOF.
+	// Setting Data on REST allows the connection to be opened before REST
+	// rather than between REST and the transfer.
+	Data   bool
+	Upload []byte
+
+	// Download is compared with the data read, if non-nil.
+	Download []byte
+}
+
+// A Script is a named sequence of exchanges run on a fresh connection.
+type Script struct {
+	Name      string
+	Login     bool // Login before running the exchanges.
+	Exchanges []Exchange
+}
+
+// Scripts is the standard conformance suite. Handlers are expected to serve
+// an empty, writable directory as the root for the logged in user.
+var Scripts = []Script{
+	{"RFC959/Unknown", false, []Exchange{
+		{Cmd: "XYZZY", Codes: []int{500, 502, 530}},
+	}},
+	{"RFC959/LoginRequired", false, []Exchange{
+		{Cmd: "PWD", Codes: []int{530}},
+	}},
+	{"RFC959/PassBeforeUser", false, []Exchange{
+		{Cmd: "PASS foo", Codes: []int{503}},
+	}},
+	{"RFC959/Basics", true, []Exchange{
+		{Cmd: "NOOP", Codes: []int{200}},
+		{Cmd: "SYST", Codes: []int{215}},
+		{Cmd: "PWD", Codes: []int{257}},
+		{Cmd: "TYPE I", Codes: []int{200}},
+		{Cmd: "TYPE A", Codes: []int{200}},
+		{Cmd: "TYPE Q", Codes: []int{501, 504}},
+		{Cmd: "MODE S", Codes: []int{200}},
+		{Cmd: "MODE Q", Codes: []int{501, 504}},
+		{Cmd: "HELP", Codes: []int{211, 214}},
+		{Cmd: "STAT", Codes: []int{211, 212, 213}},
+	}},
+	{"RFC959/Directories", true, []Exchange{
+		{Cmd: "MKD ftptest", Codes: []int{257}},
+		{Cmd: "CWD ftptest", Codes: []int{250}},
+		{Cmd: "CDUP", Codes: []int{200, 250}},
+		{Cmd: "CWD ftptest-missing", Codes: []int{550}},
+		{Cmd: "RMD ftptest", Codes: []int{250}},
+	}},
+	{"RFC959/Transfer", true, []Exchange{
+		{Cmd: "TYPE I", Codes: []int{200}},
+		{Cmd: "STOR ftptest.txt", Codes: []int{226, 250}, Data: true, Upload: []byte("ftptest\n")},
+		{Cmd: "RETR ftptest.txt", Codes: []int{226, 250}, Data: true, Download: []byte("ftptest\n")},
+		{Cmd: "TYPE A", Codes: []int{200}},
+		{Cmd: "LIST", Codes: []int{226, 250}, Data: true},
+		{Cmd: "NLST", Codes: []int{226, 250}, Data: true, Download: []byte("ftptest.txt\r\n")},
+		{Cmd: "RETR ftptest-missing.txt", Codes: []int{450, 550}, Data: true},
+		{Cmd: "DELE ftptest.txt", Codes: []int{250}},
+	}},
+	{"RFC959/Rename", true, []Exchange{
+		{Cmd: "RNTO ftptest.txt", Codes: []int{503}},
+		{Cmd: "STOR ftptest.txt", Codes: []int{226, 250}, Data: true, Upload: []byte{}},
+		{Cmd: "RNFR ftptest.txt", Codes: []int{350}},
+		{Cmd: "RNTO ftptest2.txt", Codes: []int{250}},
+		{Cmd: "DELE ftptest2.txt", Codes: []int{250}},
+	}},
+	{"RFC959/Quit", true, []Exchange{
+		{Cmd: "QUIT", Codes: []int{221}},
+	}},
+	{"RFC2389/FEAT", false, []Exchange{
+		{Cmd: "FEAT", Codes: []int{211}},
+	}},
+	{"RFC2389/OPTS", true, []Exchange{
+		{Cmd: "OPTS XYZZY", Codes: []int{501}},
+	}},
+	{"RFC2428/EPSV", true, []Exchange{
+		{Cmd: "EPSV", Codes: []int{229}},
+		{Cmd: "EPSV 3", Codes: []int{522}},
+		{Cmd: "EPRT |3|x|1|", Codes: []int{501, 522}},
+	}},
+	{"RFC3659/SIZE", true, []Exchange{
+		{Cmd: "TYPE I", Codes: []int{200}},
+		{Cmd: "STOR ftptest.txt", Codes: []int{226, 250}, Data: true, Upload: []byte("12345")},
+		{Cmd: "SIZE ftptest.txt", Codes: []int{213}},
+		{Cmd: "MDTM ftptest.txt", Codes: []int{213}},
+		{Cmd: "SIZE ftptest-missing.txt", Codes: []int{550}},
+		{Cmd: "MDTM ftptest-missing.txt", Codes: []int{550}},
+		{Cmd: "REST 2", Codes: []int{350}, Data: true},
+		{Cmd: "RETR ftptest.txt", Codes: []int{226, 250}, Data: true, Download: []byte("345")},
+		{Cmd: "REST x", Codes: []int{501}},
+		{Cmd: "DELE ftptest.txt", Codes: []int{250}},
+	}},
+	{"RFC3659/MLST", true, []Exchange{
+		{Cmd: "MLST /", Codes: []int{250}},
+		{Cmd: "MLST ftptest-missing", Codes: []int{550}},
+	}},
+}
+
+// Run runs scripts against s, returning an error for each failed script.
+// Scripts that log in use user and pass. The server is served on a loopback
+// address for the duration of the run.
+func Run(s *ftp.Server, user, pass string, scripts []Script) []error {
+	s.Addr = "localhost:0"
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		return []error{err}
+	}
+	defer li.Close()
+
+	var errs []error
+	for _, sc := range scripts {
+		if err := run(li.Addr().String(), user, pass, &sc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", sc.Name, err))
+		}
+	}
+	return errs
+}
+
+// Test runs Scripts against s as subtests of t.
+func Test(t *testing.T, s *ftp.Server, user, pass string) {
+	s.Addr = "localhost:0"
+	li, err := s.ListenAndServe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+
+	for _, sc := range Scripts {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			if err := run(li.Addr().String(), user, pass, &sc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Run one script against the server at addr.
+func run(addr, user, pass string, sc *Script) error {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c := &client{Conn: conn}
+	defer c.close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return fmt.Errorf("greeting: %v", err)
+	}
+	if sc.Login {
+		login := []Exchange{
+			{Cmd: "USER " + user, Codes: []int{230, 331}},
+			{Cmd: "PASS " + pass, Codes: []int{230, 202}},
+		}
+		if err := c.exchange(&login[0]); err != nil {
+			return err
+		}
+		if err := c.exchange(&login[1]); err != nil {
+			return err
+		}
+	}
+	for i := range sc.Exchanges {
+		if err := c.exchange(&sc.Exchanges[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A client running a script.
+type client struct {
+	*textproto.Conn
+	data net.Conn // Pending data connection, if any.
+}
+
+func (c *client) close() {
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.Close()
+}
+
+// Perform a single exchange.
+func (c *client) exchange(e *Exchange) error {
+	if e.Data && c.data == nil {
+		var err error
+		if c.data, err = c.passive(); err != nil {
+			return fmt.Errorf("%s: %v", e.Cmd, err)
+		}
+	}
+	if err := c.PrintfLine("%s", e.Cmd); err != nil {
+		return err
+	}
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		return fmt.Errorf("%s: %v", e.Cmd, err)
+	}
+	if data := c.data; code < 200 && data != nil {
+		c.data = nil
+		var got []byte
+		if e.Upload != nil {
+			_, err = data.Write(e.Upload)
+		} else {
+			got, err = ioutil.ReadAll(data)
+		}
+		data.Close()
+		if err != nil {
+			return fmt.Errorf("%s: data: %v", e.Cmd, err)
+		}
+		if e.Download != nil && !bytes.Equal(got, e.Download) {
+			return fmt.Errorf("%s: got data %q, want %q", e.Cmd, got, e.Download)
+		}
+		if code, msg, err = c.ReadResponse(0); err != nil {
+			return fmt.Errorf("%s: %v", e.Cmd, err)
+		}
+	}
+	for _, want := range e.Codes {
+		if code == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: got %d %s, want one of %v", e.Cmd, code,
+		strings.Replace(msg, "\n", " ", -1), e.Codes)
+}
+
+// Open a passive data connection.
+func (c *client) passive() (net.Conn, error) {
+	if err := c.PrintfLine("PASV"); err != nil {
+		return nil, err
+	}
+	_, msg, err := c.ReadResponse(227)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := ftp.ParsePASV(msg)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", addr.String())
+}
@@ -0,0 +1,25 @@
+package ftptest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/igneous-systems/ftp"
+)
+
+func TestFileHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &ftp.Server{
+		Strict: true,
+		Handler: &ftp.FileHandler{
+			FileSystem: &ftp.LocalFileSystem{Root: dir},
+		},
+	}
+	Test(t, s, "anonymous", "ftptest")
+}
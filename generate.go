@@ -0,0 +1,74 @@
+package ftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// A Generator produces a generated file on demand, such as a report or a
+// database dump, returning its content and a FileInfo whose size and
+// modification time are reported for it. Generators are called for each
+// Stat as well as each download, so the content should be produced as it
+// is read.
+type Generator func(path string) (io.ReadCloser, os.FileInfo, error)
+
+// generatedFiles are the generated files, keyed by cleaned absolute path.
+type generatedFiles map[string]Generator
+
+func (g generatedFiles) has(p string) bool { return g[p] != nil }
+
+func (g generatedFiles) stat(p string) (os.FileInfo, error) {
+	rc, fi, err := g[p](p)
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	if fi == nil {
+		return &stat{name: path.Base(p), mode: 0444}, nil
+	}
+	return &namedFileInfo{fi, path.Base(p)}, nil
+}
+
+func (g generatedFiles) open(p string) (File, error) {
+	rc, _, err := g[p](p)
+	if err != nil {
+		return nil, err
+	}
+	return &generatedFile{rc: rc}, nil
+}
+
+func (g generatedFiles) paths() []string {
+	list := make([]string, 0, len(g))
+	for p := range g {
+		list = append(list, p)
+	}
+	return list
+}
+
+// A generatedFile is a File reading generated content. It can only seek
+// forward from the start, by discarding content, which is enough for REST.
+type generatedFile struct {
+	rc  io.ReadCloser
+	off int64
+}
+
+func (f *generatedFile) Read(b []byte) (int, error) {
+	n, err := f.rc.Read(b)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *generatedFile) Seek(off int64, whence int) (int64, error) {
+	if whence != io.SeekStart || off < f.off {
+		return f.off, errNotSupported
+	}
+	n, err := io.CopyN(ioutil.Discard, f.rc, off-f.off)
+	f.off += n
+	return f.off, err
+}
+
+func (f *generatedFile) Write(b []byte) (int, error)          { return 0, os.ErrPermission }
+func (f *generatedFile) Close() error                         { return f.rc.Close() }
+func (f *generatedFile) Readdir(n int) ([]os.FileInfo, error) { return nil, errNotSupported }
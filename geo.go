@@ -0,0 +1,101 @@
+package ftp
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrCountry is returned by CountryPolicy for clients from countries that
+// aren't allowed.
+var ErrCountry = errors.New("country not allowed")
+
+// An AccessPolicy decides whether clients may connect and log in by their
+// address, for example by the country it is in.
+type AccessPolicy interface {
+	// Connect is called before the greeting. Returning an error closes the
+	// connection with a 421 reply.
+	Connect(ip net.IP) error
+
+	// Login is called once the user is authorized. Returning an error
+	// refuses the login with a 530 reply.
+	Login(user string, ip net.IP) error
+}
+
+// Return the IP address of a client address, or nil.
+func clientIP(addr net.Addr) net.IP {
+	return net.ParseIP(clientHost(addr))
+}
+
+// A CountryPolicy is an AccessPolicy by the country of the client, as found
+// by Lookup. Lookup is typically backed by a MaxMind GeoIP2 or GeoLite2
+// database; with github.com/oschwald/geoip2-golang, for example:
+//
+//	Lookup: func(ip net.IP) (string, error) {
+//		c, err := db.Country(ip)
+//		if err != nil {
+//			return "", err
+//		}
+//		return c.Country.IsoCode, nil
+//	}
+//
+// Countries are ISO 3166-1 alpha-2 codes. Clients whose country can't be
+// found have the code "".
+type CountryPolicy struct {
+	Lookup func(ip net.IP) (string, error)
+
+	Allow []string // Countries that may connect, or all if empty.
+	Deny  []string // Countries that may not connect.
+
+	// Users are the countries each user is expected to log in from. Logins
+	// from elsewhere are passed to Unexpected, or refused if it is nil.
+	Users      map[string][]string
+	Unexpected func(user string, ip net.IP, country string) error
+}
+
+var _ AccessPolicy = (*CountryPolicy)(nil)
+
+// Return the country of ip, or "" if unknown.
+func (p *CountryPolicy) country(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	c, err := p.Lookup(ip)
+	if err != nil {
+		return ""
+	}
+	return c
+}
+
+// Connect implements AccessPolicy.
+func (p *CountryPolicy) Connect(ip net.IP) error {
+	c := p.country(ip)
+	if hasCountry(p.Deny, c) || len(p.Allow) > 0 && !hasCountry(p.Allow, c) {
+		return ErrCountry
+	}
+	return nil
+}
+
+// Login implements AccessPolicy.
+func (p *CountryPolicy) Login(user string, ip net.IP) error {
+	expected, ok := p.Users[user]
+	if !ok {
+		return nil
+	}
+	if c := p.country(ip); !hasCountry(expected, c) {
+		if p.Unexpected != nil {
+			return p.Unexpected(user, ip, c)
+		}
+		return ErrCountry
+	}
+	return nil
+}
+
+func hasCountry(list []string, c string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,16 @@ package ftp
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/igneous-systems/ftp/listfmt"
 )
 
 const mdtmFormat = "20060102150405"
@@ -16,8 +21,8 @@ var errNoDataConn = errors.New("no data channel connection")
 // A Handler for a session.
 type Handler interface {
 	// Handle a session. It is optional to send a greeting or reply to a QUIT.
-	// The session is closed by the Server on return. The return value is for
-	// composing Handlers and is ignored by the Server.
+	// The session is closed by the Server on return. Errors other than
+	// io.EOF are reported to the Server's ErrorHandler.
 	Handle(*Session) error
 }
 
@@ -29,372 +34,1442 @@ type Authorizer interface {
 	Authorize(user, pass string) (bool, error)
 }
 
+// An Account describes a user, as returned by an AccountAuthorizer.
+type Account struct {
+	Class string // Bandwidth class, a key of the Server's Classes.
+
+	// Priority orders transfers sharing a bandwidth limit. While transfers
+	// of a higher priority are in progress, those of lower priorities get a
+	// smaller share of the bandwidth. The default is 0.
+	Priority int
+
+	// Windows, if set, are the periods in which the user may log in. See
+	// FileHandler.WindowDrain for sessions outlasting them.
+	Windows []Window
+
+	// Expires, if not zero, is when the account expires. Later logins are
+	// refused.
+	Expires time.Time
+
+	// PasswordExpired refuses the login until the password is changed by
+	// other means, such as the identity system it came from.
+	PasswordExpired bool
+
+	// Takeover overrides FileHandler.Takeover for the user.
+	Takeover Takeover
+}
+
+// An AccountAuthorizer is an Authorizer that also describes the user's
+// account. FileHandler uses this in place of Authorize if implemented.
+type AccountAuthorizer interface {
+	Authorizer
+
+	// AuthorizeAccount authorizes the user, returning nil if login fails.
+	// Returning an error closes the session.
+	AuthorizeAccount(user, pass string) (*Account, error)
+}
+
 // A FileHandler serves from a FileSystem.
 type FileHandler struct {
 	Authorizer // Authorizer for login. If nil, accept all.
 	FileSystem // FileSystem to serve.
+
+	// Commands are custom commands, keyed by upper case name. These take
+	// precedence over built-in commands.
+	Commands map[string]*Extension
+
+	// LongNLST makes NLST produce long lines like LIST rather than bare
+	// names. Some older clients expect this.
+	LongNLST bool
+
+	// Faults are injected into matching commands to test client resilience.
+	// This should not be used in production.
+	Faults []Fault
+
+	// Site are custom SITE subcommands, keyed by upper case name. The
+	// Command passed to these has the subcommand name in Cmd.
+	Site map[string]*Extension
+
+	// Options are custom OPTS handlers, keyed by upper case command name.
+	// These take precedence over built-in handlers. The Command passed to
+	// these has the command name in Cmd and its options in Msg.
+	Options map[string]*Extension
+
+	// ListCacheTTL, if positive, caches directory listings for this long.
+	// This helps backends where Readdir is expensive. Changes made through
+	// this handler invalidate the affected listings; others go unnoticed
+	// until the entry expires.
+	ListCacheTTL time.Duration
+
+	// StatCacheTTL, if positive, caches the results of Stat within each
+	// session for this long, so that clients issuing SIZE and MDTM before
+	// RETR cause a single backend call. Changes made by the session
+	// invalidate the affected entries.
+	StatCacheTTL time.Duration
+
+	// OpTimeout, if positive, limits how long each FileSystem operation may
+	// take, so that a hung backend fails the command with a 451 reply
+	// rather than stalling the session. The operation is cancelled if the
+	// FileSystem implements ContextFileSystem.
+	OpTimeout time.Duration
+
+	// Retries is how many times failed Stat and Open calls are retried,
+	// waiting RetryDelay before the first retry and doubling it after each.
+	Retries    int
+	RetryDelay time.Duration
+
+	// DirSizeDepth enables SITE DSIZ for a FileSystem that isn't a DirSizer
+	// by walking directories, to at most this depth. DirSizeTimeout, if
+	// positive, limits the time spent walking.
+	DirSizeDepth   int
+	DirSizeTimeout time.Duration
+
+	// HashLimit, if positive, is the most bytes that HASH, XCRC, XMD5, and
+	// XSHA1 hash at once, bounding the CPU time a client can demand.
+	HashLimit int64
+
+	// SizeDirs makes SIZE report the size of directories, as the MLST size
+	// fact does, for clients that rely on it. Otherwise SIZE fails with 550
+	// for directories. MDTM and MLST always report on directories.
+	SizeDirs bool
+
+	// Welcome, if set, is called after login for lines to include in the
+	// reply, such as the user's recent files or pending items.
+	Welcome func(s *Session) []string
+
+	// LoginRefused, if set, is called when a login is refused, with one of
+	// the errors ErrLoginIncorrect, ErrAccountExpired, ErrPasswordExpired,
+	// ErrOutsideWindow, or ErrLoggedIn, or the error of the Server's
+	// AccessPolicy, and with the session's User and Account set to those
+	// of the refused login.
+	LoginRefused func(s *Session, err error)
+
+	// Takeover is the policy for a user logging in while logged in to
+	// another session of the Server. The default allows both sessions.
+	Takeover Takeover
+
+	// SparseRestart allows uploads to restart beyond the end of the file,
+	// extending it to the offset with a hole, as some backup tools expect.
+	// The file must have a Truncate method like *os.File. Otherwise, such
+	// restarts are refused.
+	SparseRestart bool
+
+	// Journal, if set, records the progress of uploads, checkpointing every
+	// JournalInterval bytes, or every MiB if 0. Restarts of uploads beyond
+	// the last checkpoint are refused, so that data lost in a crash can't
+	// leave a hole in a resumed upload.
+	Journal         Journal
+	JournalInterval int64
+
+	// Durability is the policy for syncing uploads. DurabilityFor, if set,
+	// overrides it by user and path.
+	Durability    Durability
+	DurabilityFor func(s *Session, path string) Durability
+
+	// WindowDrain drains sessions when their account's login windows close,
+	// so that they end after the transfer in progress, if any.
+	WindowDrain bool
+
+	// DirMessage, if set, names a file whose contents are included in the
+	// reply to CWD into its directory, like .message files of wu-ftpd.
+	// Files larger than DirMessageSize bytes, or 4096 if 0, are ignored.
+	DirMessage     string
+	DirMessageSize int64
+
+	// Normalize, if set, is applied to path arguments and to the names in
+	// directory listings, so that a file is addressable however a client
+	// encodes its name. For example, norm.NFC.String from
+	// golang.org/x/text/unicode/norm matches the decomposed names sent by
+	// macOS clients with composed names on disk.
+	Normalize func(string) string
+
+	// ControlChars is the policy for control characters in file names.
+	ControlChars ControlPolicy
+
+	// Virtual are read-only files generated by the server, keyed by clean
+	// absolute path. They are listed in their directory, which must exist
+	// in the FileSystem, and hide any real file of the same name.
+	Virtual map[string]*VirtualFile
+
+	// Generated are read-only files produced on demand by Generators, keyed
+	// by clean absolute path. Like Virtual files, they are listed in their
+	// directory, which must exist in the FileSystem.
+	Generated map[string]Generator
+
+	// Sinks consume uploads to the paths they are keyed by, which are clean
+	// and absolute, instead of the FileSystem.
+	Sinks map[string]Sink
+
+	// Breaker, if set, fails commands fast once the FileSystem has failed
+	// repeatedly.
+	Breaker *Breaker
+
+	// NoopTimeout, if positive, closes sessions that have sent nothing but
+	// NOOP for this long, so that clients can't keep idle connections open
+	// forever with keepalives.
+	NoopTimeout time.Duration
+
+	// ResumeTTL, if positive, enables SITE RESUME, which lets a client on a
+	// flaky link reconnect and restore the working directory, REST offset,
+	// and pending RNFR of its previous session. A session's state is kept
+	// for this long after it ends.
+	ResumeTTL time.Duration
+
+	lists    listCache
+	messages dirMessages
+	resumes  resumeStore
 }
 
 // Handle implements Handler.
 func (h *FileHandler) Handle(s *Session) error {
+	if h.Breaker.tripped() {
+		s.Reply(421, "Service not available; %s.", RetryHint(h.Breaker.RetryAfter()))
+		return io.EOF
+	}
 	fs := fileSession{
 		FileHandler: h,
+		FileSystem:  h.sessionFS(s),
 		Session:     s,
 	}
 	return fs.Handle()
 }
 
+// Return the FileSystem used by a session, wrapped as configured.
+func (h *FileHandler) sessionFS(s *Session) FileSystem {
+	fs := h.FileSystem
+	if h.OpTimeout > 0 || h.Retries > 0 {
+		fs = BindContext(&timeoutFS{
+			fs:      WithContext(fs),
+			ctx:     s.Ctx(),
+			timeout: h.OpTimeout,
+			retries: h.Retries,
+			delay:   h.RetryDelay,
+		}, s.Ctx())
+	} else if c, ok := fs.(ContextFileSystem); ok {
+		fs = BindContext(c, s.Ctx())
+	}
+	if h.Breaker != nil {
+		fs = &breakerFS{wrappedFS{fs}, h.Breaker}
+	}
+	if h.ListCacheTTL > 0 {
+		fs = &listCacheFS{wrappedFS: wrappedFS{fs}, cache: &h.lists, ttl: h.ListCacheTTL}
+	}
+	if h.StatCacheTTL > 0 {
+		fs = &statCacheFS{wrappedFS: wrappedFS{fs}, ttl: h.StatCacheTTL}
+	}
+	if len(h.Generated) > 0 {
+		fs = &overlayFS{wrappedFS: wrappedFS{fs}, files: generatedFiles(h.Generated)}
+	}
+	if len(h.Sinks) > 0 {
+		fs = &sinkFS{wrappedFS: wrappedFS{fs}, sinks: h.Sinks}
+	}
+	if len(h.Virtual) > 0 {
+		fs = &overlayFS{wrappedFS: wrappedFS{fs}, files: &virtualFiles{h.Virtual, s}}
+	}
+	if h.Normalize != nil {
+		fs = &normFS{wrappedFS{fs}, h.Normalize}
+	}
+	if h.ControlChars != ControlAllow {
+		fs = &controlFS{wrappedFS{fs}, h.ControlChars}
+	}
+	return fs
+}
+
 // A fileSession wraps session state for a FileHandler.
 type fileSession struct {
 	*FileHandler
+	FileSystem // The handler's FileSystem, wrapped for this session.
 	*Session
 
-	authed   bool   // Whether we're done with auth.
-	renaming string // The file we're renaming, if any.
-	epsvOnly bool   // Whether we saw "EPSV ALL".
-	restart  int64  // Restart offset.
+	authed   bool      // Whether we're done with auth.
+	renaming string    // The file we're renaming, if any.
+	epsvOnly bool      // Whether we saw "EPSV ALL".
+	restart  int64     // Restart offset.
+	rangeEnd int64     // End of the byte range set by RANG, exclusive, or 0.
+	held     *heldFile // File opened by OpenStat, if any.
+	fault    *Fault    // Fault injected into the current command, if any.
+
+	resumeToken string    // Token given by SITE RESUME, if any.
+	resumed     bool      // Whether the current command restored a session.
+	active      time.Time // When the last command other than NOOP was received.
+
+	windowDone chan struct{} // Closed to stop watching login windows, if watched.
 }
 
 func (s *fileSession) Handle() error {
+	defer s.closeHeld()
+	defer s.saveResume()
+	defer func() {
+		if s.windowDone != nil {
+			close(s.windowDone)
+		}
+	}()
+	s.active = time.Now()
 	for {
 		c, err := s.Command()
 		if err != nil {
 			return err
 		}
+		if c.Cmd != "NOOP" {
+			s.active = s.start
+		}
 		if err := s.handle(c); err != nil {
 			return err
 		}
 		if c.Cmd == "QUIT" {
+			s.resumeToken = "" // Only dropped sessions are resumed.
 			return io.EOF
 		}
+		if s.resumed {
+			s.resumed = false
+			continue
+		}
 		if c.Cmd != "RNFR" {
 			s.renaming = ""
 		}
-		if c.Cmd != "REST" {
-			s.restart = 0
+		if c.Cmd != "REST" && c.Cmd != "RANG" {
+			s.restart, s.rangeEnd = 0, 0
+		}
+		if !keepsHeld(c.Cmd) {
+			s.closeHeld()
 		}
 	}
 }
 
 func (s *fileSession) handle(c *Command) error {
-	if !s.authed {
-		return s.handlePreAuth(c)
+	if s.Server.Strict && !validCommandName(c.Cmd) {
+		return s.Reply(500, "Syntax error, command unrecognized.")
+	}
+	cmd := s.command(c.Cmd)
+	if cmd == nil && s.Quirks&QuirkNoSpace != 0 {
+		cmd = s.splitCommand(c)
+	}
+	if cmd == nil {
+		if s.Server.Strict {
+			return s.Reply(500, "Syntax error, command unrecognized.")
+		}
+		if !s.authed {
+			return s.Reply(530, "Log in with USER and PASS.")
+		}
+		return s.Reply(502, "Not implemented.")
 	}
-	return s.handlePostAuth(c)
+	if s.Server.Strict && !cmd.args.valid(c.Msg) {
+		return s.Reply(501, "Syntax error in parameters or arguments.")
+	}
+	if !cmd.public && !s.authed {
+		return s.Reply(530, "Log in with USER and PASS.")
+	}
+	if msg, ok := s.Server.ReadOnly(); ok && writeCommands[c.Cmd] {
+		return s.ReplyString(553, msg)
+	}
+	if s.Normalize != nil && pathCommands[c.Cmd] {
+		c.Msg = s.Normalize(c.Msg)
+	}
+	if s.ControlChars != ControlAllow && pathCommands[c.Cmd] && hasControl(c.Msg) {
+		return s.Reply(501, "Path names may not contain control characters.")
+	}
+	if len(s.Faults) > 0 {
+		if handled, err := s.injectFault(c); handled || err != nil {
+			return err
+		}
+	}
+	return cmd.handle(s, c)
+}
+
+// Whether msg is a valid argument according to a.
+func (a argSpec) valid(msg string) bool {
+	switch a {
+	case argRequired:
+		return msg != ""
+	case argNone:
+		return msg == ""
+	}
+	return true
 }
 
-func (s *fileSession) handlePreAuth(c *Command) error {
-	switch c.Cmd {
-	case "USER":
-		if s.authed {
-			return s.Reply(530, "Cannot change user.")
+// Whether name is syntactically a command name. RFC 959 commands are three or
+// four alphabetic characters.
+func validCommandName(name string) bool {
+	if len(name) < 3 || len(name) > 4 {
+		return false
+	}
+	for _, c := range name {
+		if c < 'A' || c > 'Z' {
+			return false
 		}
-		if c.Msg == "" {
-			return s.Reply(504, "A user name is required.")
+	}
+	return true
+}
+
+// Whether a command takes an argument.
+type argSpec int
+
+const (
+	argOptional argSpec = iota
+	argRequired
+	argNone
+)
+
+// A fileCommand is a command understood by a FileHandler.
+type fileCommand struct {
+	handle func(*fileSession, *Command) error // Handle the command.
+	help   string                             // Syntax shown by HELP.
+	args   argSpec                            // Whether an argument is expected.
+	feat   string                             // Feature advertised by FEAT.
+	avail  func(*fileSession) bool            // Whether the command is available.
+	public bool                               // Whether login is not required.
+}
+
+// An Extension is a custom command registered with a FileHandler.
+type Extension struct {
+	Handle  func(*Session, *Command) error // Handle the command.
+	Help    string                         // Help shown by HELP, if any.
+	Feature string                         // Feature advertised by FEAT, if any.
+	Public  bool                           // Public commands do not require login.
+}
+
+// Built-in commands, keyed by name. This is populated by init to avoid an
+// initialization loop through FEAT.
+var fileCommands map[string]*fileCommand
+
+// Built-in SITE subcommands, keyed by name.
+var siteCommands = map[string]*fileCommand{
+	"QUOTA":  {handle: (*fileSession).handleQUOTA, help: "SITE QUOTA", args: argNone, avail: hasQuota},
+	"DSIZ":   {handle: (*fileSession).handleDSIZ, help: "SITE DSIZ [<sp> pathname]", avail: hasDirSize},
+	"RESUME": {handle: (*fileSession).handleRESUME, help: "SITE RESUME [<sp> token]", avail: hasResume},
+}
+
+func init() {
+	fileCommands = map[string]*fileCommand{
+		"USER": {handle: (*fileSession).handleUSER, help: "USER <sp> username", args: argRequired, public: true},
+		"PASS": {handle: (*fileSession).handlePASS, help: "PASS <sp> password", public: true},
+		"CLNT": {handle: (*fileSession).handleCLNT, help: "CLNT <sp> client-name", args: argRequired, public: true},
+		"HOST": {handle: (*fileSession).handleHOST, help: "HOST <sp> hostname", args: argRequired, feat: "HOST", avail: hasHosts, public: true},
+		"FEAT": {handle: (*fileSession).handleFEAT, help: "FEAT (list features)", args: argNone, public: true},
+		"QUIT": {handle: (*fileSession).handleQUIT, help: "QUIT (terminate session)", args: argNone, public: true},
+		"SYST": {handle: (*fileSession).handleSYST, help: "SYST (get system type)", args: argNone},
+		"TYPE": {handle: (*fileSession).handleTYPE, help: "TYPE <sp> type-code (A, I, L 8)", args: argRequired},
+		"MODE": {handle: (*fileSession).handleMODE, help: "MODE <sp> mode-code (S)", args: argRequired},
+		"PWD":  {handle: (*fileSession).handlePWD, help: "PWD (print working directory)", args: argNone},
+		"CWD":  {handle: (*fileSession).handleCWD, help: "CWD <sp> pathname", args: argRequired},
+		"CDUP": {handle: (*fileSession).handleCDUP, help: "CDUP (change to parent directory)", args: argNone},
+		"MKD":  {handle: (*fileSession).handleMKD, help: "MKD <sp> pathname", args: argRequired},
+		"SIZE": {handle: (*fileSession).handleSIZE, help: "SIZE <sp> pathname", args: argRequired, feat: "SIZE"},
+		"MDTM": {handle: (*fileSession).handleMDTM, help: "MDTM <sp> pathname", args: argRequired, feat: "MDTM"},
+		"HASH": {handle: (*fileSession).handleHASH, help: "HASH <sp> pathname", args: argRequired, feat: hashFeature("")},
+		"MFMT": {handle: (*fileSession).handleMFMT, help: "MFMT <sp> time-val <sp> pathname", args: argRequired, feat: "MFMT", avail: hasChtimes},
+		"DELE": {handle: (*fileSession).handleDELE, help: "DELE <sp> pathname", args: argRequired},
+		"RMD":  {handle: (*fileSession).handleDELE, help: "RMD <sp> pathname", args: argRequired},
+		"RNFR": {handle: (*fileSession).handleRNFR, help: "RNFR <sp> pathname", args: argRequired},
+		"RNTO": {handle: (*fileSession).handleRNTO, help: "RNTO <sp> pathname", args: argRequired},
+		"PASV": {handle: (*fileSession).handlePASV, help: "PASV (enter passive mode)", args: argNone, feat: "PASV"},
+		"EPSV": {handle: (*fileSession).handleEPSV, help: "EPSV [<sp> net-prt | ALL]", feat: "EPSV"},
+		"PORT": {handle: (*fileSession).handlePORT, help: "PORT <sp> h1,h2,h3,h4,p1,p2", args: argRequired, avail: hasActive},
+		"EPRT": {handle: (*fileSession).handleEPRT, help: "EPRT <sp> |net-prt|net-addr|tcp-port|", args: argRequired, feat: "EPRT", avail: hasActive},
+		"REST": {handle: (*fileSession).handleREST, help: "REST <sp> offset", args: argRequired, feat: "REST STREAM"},
+		"RANG": {handle: (*fileSession).handleRANG, help: "RANG <sp> start <sp> end", args: argRequired, feat: "RANG STREAM"},
+		"MLST": {handle: (*fileSession).handleMLST, help: "MLST [<sp> pathname]", feat: mlstFeature(mlstFacts)},
+		"MLSD": {handle: (*fileSession).handleMLSD, help: "MLSD [<sp> pathname]"},
+		"STAT": {handle: (*fileSession).handleSTAT, help: "STAT [<sp> pathname]"},
+		"LIST": {handle: (*fileSession).handleLIST, help: "LIST [<sp> pathname]"},
+		"NLST": {handle: (*fileSession).handleLIST, help: "NLST [<sp> pathname]"},
+		"RETR": {handle: (*fileSession).handleRETR, help: "RETR <sp> pathname", args: argRequired},
+		"STOR": {handle: (*fileSession).handleSTOR, help: "STOR <sp> pathname", args: argRequired},
+		"APPE": {handle: (*fileSession).handleSTOR, help: "APPE <sp> pathname", args: argRequired},
+		"ALLO": {handle: (*fileSession).handleALLO, help: "ALLO <sp> size [<sp> R <sp> max-record-size]", args: argRequired},
+		"AUTH": {handle: (*fileSession).handleAUTH, help: "AUTH <sp> mechanism (TLS)", args: argRequired, feat: "AUTH TLS", avail: hasTLS, public: true},
+		"CCC":  {handle: (*fileSession).handleCCC, help: "CCC (clear command channel)", args: argNone, avail: hasTLS},
+		"PBSZ": {handle: (*fileSession).handlePBSZ, help: "PBSZ <sp> 0", args: argRequired, feat: "PBSZ", avail: hasTLS, public: true},
+		"PROT": {handle: (*fileSession).handlePROT, help: "PROT <sp> protection-level (C, P)", args: argRequired, feat: "PROT", avail: hasTLS, public: true},
+		"OPTS": {handle: (*fileSession).handleOPTS, help: "OPTS <sp> command [<sp> options]", args: argRequired, feat: "UTF8"},
+		"LANG": {handle: (*fileSession).handleLANG, help: "LANG [<sp> language-tag]", feat: "LANG", avail: hasCatalog, public: true},
+		"HELP": {handle: (*fileSession).handleHELP, help: "HELP [<sp> command]"},
+		"NOOP": {handle: (*fileSession).handleNOOP, help: "NOOP (no operation)", args: argNone},
+		"ABOR": {handle: (*fileSession).handleABOR, help: "ABOR (abort transfer)", args: argNone},
+		"SITE": {handle: (*fileSession).handleSITE, help: "SITE <sp> command [<sp> arguments]", args: argRequired, avail: hasSite},
+
+		// Checksum commands of older Windows clients.
+		"XCRC":  {handle: (*fileSession).handleXCRC, help: "XCRC <sp> pathname [<sp> start [<sp> end]]", args: argRequired, feat: "XCRC"},
+		"XMD5":  {handle: (*fileSession).handleXCRC, help: "XMD5 <sp> pathname [<sp> start [<sp> end]]", args: argRequired, feat: "XMD5"},
+		"XSHA1": {handle: (*fileSession).handleXCRC, help: "XSHA1 <sp> pathname [<sp> start [<sp> end]]", args: argRequired, feat: "XSHA1"},
+	}
+}
+
+// Built-in OPTS handlers, keyed by command name.
+var optsCommands = map[string]func(*fileSession, *Command) error{
+	"UTF8": (*fileSession).optsUTF8,
+	"MLST": (*fileSession).optsMLST,
+	"HASH": (*fileSession).optsHASH,
+}
+
+// Commands whose argument is a path.
+var pathCommands = map[string]bool{
+	"APPE": true, "CWD": true, "DELE": true, "HASH": true, "LIST": true,
+	"MDTM": true, "MKD": true, "MLSD": true, "MLST": true, "NLST": true,
+	"RETR": true, "RMD": true, "RNFR": true, "RNTO": true, "SIZE": true,
+	"STAT": true, "STOR": true, "STOU": true, "XCWD": true, "XMKD": true,
+	"XRMD": true,
+}
+
+// Commands changing files, refused while the server is read-only.
+var writeCommands = map[string]bool{
+	"ALLO": true, "APPE": true, "DELE": true, "MFMT": true, "MKD": true,
+	"RMD": true, "RNFR": true, "RNTO": true, "STOR": true, "STOU": true,
+	"XMKD": true, "XRMD": true,
+}
+
+// Return the command with the given name, or nil if it is not available.
+// Extensions take precedence over built-in commands.
+func (s *fileSession) command(name string) *fileCommand {
+	if e := s.Commands[name]; e != nil {
+		return &fileCommand{
+			handle: func(s *fileSession, c *Command) error {
+				return e.Handle(s.Session, c)
+			},
+			help:   e.Help,
+			feat:   e.Feature,
+			public: e.Public,
 		}
-		s.User = c.Msg
-		return s.Reply(331, "Please specify the password.")
-	case "PASS":
-		if s.authed {
-			return s.Reply(230, "Already logged in.")
+	}
+	cmd := fileCommands[name]
+	if cmd == nil || cmd.avail != nil && !cmd.avail(s) {
+		return nil
+	}
+	return cmd
+}
+
+// Return the SITE subcommand with the given name, or nil if it is not
+// available. Site extensions take precedence over built-in subcommands.
+func (s *fileSession) siteCommand(name string) *fileCommand {
+	if e := s.Site[name]; e != nil {
+		return &fileCommand{
+			handle: func(s *fileSession, c *Command) error {
+				return e.Handle(s.Session, c)
+			},
+			help: e.Help,
 		}
-		if s.User == "" {
-			return s.Reply(503, "Log in with USER first.")
+	}
+	cmd := siteCommands[name]
+	if cmd == nil || cmd.avail != nil && !cmd.avail(s) {
+		return nil
+	}
+	return cmd
+}
+
+// Return the names of all available SITE subcommands in sorted order.
+func (s *fileSession) siteNames() []string {
+	var names []string
+	for name := range siteCommands {
+		if s.Site[name] == nil && s.siteCommand(name) != nil {
+			names = append(names, name)
 		}
-		if s.Authorizer != nil {
-			if ok, err := s.Authorize(s.User, c.Msg); err != nil {
-				s.User = ""
-				return err
-			} else if !ok {
-				s.User = ""
-				return s.Reply(430, "Invalid user name or password.")
-			}
+	}
+	for name := range s.Site {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Split a command missing the space after its name, as in "CWDfoo". This
+// returns the command and rewrites c if exactly one known command name
+// prefixes it. Words in capitals, such as "MKDIR", are taken as unknown
+// commands rather than split.
+func (s *fileSession) splitCommand(c *Command) *fileCommand {
+	capitals := strings.IndexFunc(c.Raw, func(r rune) bool { return r < 'A' || r > 'Z' }) < 0
+	if c.Msg != "" || capitals {
+		return nil
+	}
+	var cmd *fileCommand
+	var name string
+	for _, n := range []int{4, 3} {
+		if len(c.Raw) <= n {
+			continue
 		}
-		s.Password = c.Msg
-		s.authed = true
-		return s.Reply(230, "Login successful.")
-	case "FEAT":
-		msg := []string{"Extensions supported:"}
-		msg = append(msg, s.features()...)
-		msg = append(msg, "End.")
-		return s.Reply(211, strings.Join(msg, "\n"))
-	case "QUIT":
-		return s.Reply(211, "Goodbye.")
-	default:
-		if !s.authed {
-			return s.Reply(530, "Log in with USER and PASS.")
+		prefix := strings.ToUpper(c.Raw[:n])
+		if found := s.command(prefix); found != nil && cmd != nil {
+			return nil // Ambiguous.
+		} else if found != nil {
+			cmd, name = found, prefix
 		}
-		return s.Reply(502, "Not implemented.")
 	}
+	if cmd != nil {
+		c.Cmd, c.Msg = name, c.Raw[len(name):]
+	}
+	return cmd
 }
 
-func (s *fileSession) handlePostAuth(c *Command) error {
-	switch c.Cmd {
-	case "SYST":
-		return s.Reply(215, "UNIX Type: L8")
-	case "TYPE":
-		if err := s.SetType(c.Msg); err != nil {
-			return s.Reply(504, err.Error())
-		}
-		return s.Reply(200, "Type switched successfully.")
-	case "MODE":
-		if err := s.SetMode(c.Msg); err != nil {
-			return s.Reply(504, err.Error())
-		}
-		return s.Reply(200, "Mode switched successfully.")
-	case "PWD":
-		path := s.Path("")
-		return s.Reply(257, "%s is the current directory.", quote(path))
-	case "CWD":
-		if c.Msg == "" {
-			return s.Reply(550, "Failed to change directory.")
-		}
-		path := s.Path(c.Msg)
-		if stat, err := s.Stat(path); isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such directory.")
-		} else if err != nil || !stat.IsDir() {
-			return s.Reply(550, "Failed to change directory.")
-		}
-		s.Dir = path
-		return s.Reply(250, "Directory successfully changed.")
-	case "CDUP":
-		path := s.Path("..")
-		if stat, err := s.Stat(path); isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such directory.")
-		} else if err != nil || !stat.IsDir() {
-			return s.Reply(550, "Failed to change directory.")
-		}
-		s.Dir = path
-		return s.Reply(250, "Directory successfully changed.")
-	case "MKD":
-		path := s.Path(c.Msg)
-		if err := s.Mkdir(path); err != nil {
-			return s.Reply(550, "Failed to create directory.")
-		}
-		return s.Reply(257, "%s created.", quote(path))
-	case "SIZE":
-		path := s.Path(c.Msg)
-		stat, err := s.Stat(path)
-		if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file.")
-		} else if err != nil {
-			return s.Reply(550, "Could not get size.")
-		} else if stat.IsDir() {
-			return s.Reply(550, "Path specifies a directory.")
-		}
-		size := strconv.FormatInt(stat.Size(), 10)
-		return s.Reply(213, size)
-	case "MDTM":
-		path := s.Path(c.Msg)
-		stat, err := s.Stat(path)
-		if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file or directory.")
-		} else if err != nil || stat.IsDir() {
-			return s.Reply(550, "Could not get size.")
-		}
-		mdtm := stat.ModTime().Format(mdtmFormat)
-		return s.Reply(213, mdtm)
-	case "DELE", "RMD":
-		if c.Msg == "" {
-			return s.Reply(501, "A file name is required.")
-		}
-		path := s.Path(c.Msg)
-		if err := s.Remove(path); isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file.")
-		} else if err != nil {
-			return s.Reply(550, "Could not delete file.")
-		}
-		return s.Reply(250, "Successfully deleted file.")
-	case "RNFR":
-		if c.Msg == "" {
-			return s.Reply(501, "A file name is required.")
-		}
-		s.renaming = s.Path(c.Msg)
-		return s.Reply(350, "Call RNTO to specify destination.")
-	case "RNTO":
-		if c.Msg == "" {
-			return s.Reply(501, "A file name is required.")
-		} else if s.renaming == "" {
-			return s.Reply(503, "Call RNFR first.")
-		}
-		old, new := s.renaming, s.Path(c.Msg)
-		if err := s.Rename(old, new); isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file.")
-		} else if err != nil {
-			return s.Reply(550, "Could not rename file.")
-		}
-		return s.Reply(250, "Successfully renamed file.")
-	case "PASV":
-		if s.epsvOnly {
-			return s.Reply(550, "PASV is disallowed.")
-		}
-		if err := s.Passive("tcp4"); err != nil {
-			println(err.Error())
-			return s.Reply(425, "Can't open data connection.")
-		}
-		hp := s.Data.HostPort()
-		return s.Reply(227, "Entering Passive Mode (%s).", hp)
-	case "EPSV":
-		if msg := strings.ToUpper(c.Msg); msg == "ALL" {
-			s.epsvOnly = true
-			return s.Reply(200, "EPSV ALL ok.")
-		}
-		var nw string
-		switch c.Msg {
-		case "1":
-			nw = "tcp4"
-		case "2":
-			nw = "tcp6"
-		case "":
-			nw = s.Addr.Network()
-		default:
-			return s.Reply(522, "Unsupported protocol.")
-		}
-		if err := s.Passive(nw); err != nil {
-			return s.Reply(425, "Can't open data connection.")
-		}
-		p := s.Data.Port()
-		return s.Reply(229, "Entering Extended Passive Mode (|||%d|)", p)
-	case "PORT":
-		if s.epsvOnly {
-			return s.Reply(550, "PORT is disallowed.")
-		}
-		addr, err := ParsePORT(c.Msg)
-		if err != nil {
-			return s.Reply(501, "Invalid syntax.")
+// Return the names of all available commands in sorted order.
+func (s *fileSession) commandNames() []string {
+	var names []string
+	for name := range fileCommands {
+		if s.Commands[name] == nil && s.command(name) != nil {
+			names = append(names, name)
+		}
+	}
+	for name := range s.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return supported features. These are derived from the available commands so
+// that FEAT always matches what the session will actually accept.
+func (s *fileSession) features() []string {
+	var f []string
+	seen := make(map[string]bool)
+	for _, name := range s.commandNames() {
+		feat := s.command(name).feat
+		if name == "MLST" && s.Commands[name] == nil {
+			feat = mlstFeature(s.selectedFacts())
 		}
-		if err := s.Active(addr); err != nil {
-			return s.Reply(550, "Failed to connect.")
+		if name == "HASH" && s.Commands[name] == nil {
+			feat = hashFeature(s.hashAlg())
 		}
-		return s.Reply(200, "OK")
-	case "EPRT":
-		if s.epsvOnly {
-			return s.Reply(550, "EPRT is disallowed.")
+		if name == "LANG" && s.Commands[name] == nil {
+			feat = langFeature(s.Server.Catalog.Languages(), s.lang)
 		}
-		addr, err := ParseEPRT(c.Msg)
+		if feat != "" && !seen[feat] {
+			seen[feat] = true
+			f = append(f, feat)
+		}
+	}
+	sort.Strings(f)
+	return f
+}
+
+// Whether any SITE commands are available.
+func hasSite(s *fileSession) bool {
+	return len(s.siteNames()) > 0
+}
+
+// Whether directory sizes can be reported.
+func hasDirSize(s *fileSession) bool {
+	_, ok := s.FileHandler.FileSystem.(DirSizer)
+	return ok || s.DirSizeDepth > 0
+}
+
+// Whether the FileSystem reports quotas.
+func hasQuota(s *fileSession) bool {
+	_, ok := s.FileHandler.FileSystem.(Quotaer)
+	return ok
+}
+
+// Whether active data connections are allowed.
+func hasActive(s *fileSession) bool {
+	return !s.Server.passiveOnly()
+}
+
+// Whether modification times can be set.
+func hasChtimes(s *fileSession) bool {
+	_, ok := s.FileHandler.FileSystem.(Chtimeser)
+	return ok
+}
+
+// Whether TLS is configured for the server.
+func hasTLS(s *fileSession) bool {
+	return s.Server.TLS != nil
+}
+
+func (s *fileSession) handleUSER(c *Command) error {
+	if s.authed {
+		return s.Reply(530, "Cannot change user.")
+	}
+	if c.Msg == "" {
+		return s.Reply(504, "A user name is required.")
+	}
+	if s.Server.requireTLS() && (!s.secure() || s.cleared) {
+		return s.Reply(530, "TLS is required; use AUTH TLS.")
+	}
+	if s.Server.denyAnonymous() && isAnonymous(c.Msg) {
+		return s.Reply(530, "Anonymous login is not allowed.")
+	}
+	s.User = c.Msg
+	s.updateQuirks()
+	return s.Reply(331, "Please specify the password.")
+}
+
+func (s *fileSession) handleCLNT(c *Command) error {
+	s.Client = c.Msg
+	s.updateQuirks()
+	return s.Reply(200, "Noted.")
+}
+
+func (s *fileSession) handlePASS(c *Command) error {
+	if s.authed {
+		return s.Reply(230, "Already logged in.")
+	}
+	if s.User == "" {
+		return s.Reply(503, "Log in with USER first.")
+	}
+	if s.Server.requireTLS() && (!s.secure() || s.cleared) {
+		return s.Reply(530, "TLS is required; use AUTH TLS.")
+	}
+	if d := s.Server.lockedOut(s.Addr); d > 0 {
+		s.Reply(421, "Too many failed logins; %s.", RetryHint(d))
+		return io.EOF
+	}
+	if a, ok := s.Authorizer.(AccountAuthorizer); ok {
+		acct, err := a.AuthorizeAccount(s.User, c.Msg)
 		if err != nil {
-			return s.Reply(501, "Invalid syntax.")
-		}
-		if err := s.Active(addr); err != nil {
-			return s.Reply(550, "Failed to connect.")
-		}
-		return s.Reply(200, "OK")
-	case "REST":
-		n, err := strconv.ParseInt(c.Msg, 10, 64)
-		if err != nil || n < 0 {
-			return s.Reply(501, "Invalid syntax.")
-		}
-		s.restart = n
-		return s.Reply(350, "Restart position accepted (%d).", n)
-	case "STAT":
-		if c.Msg == "" {
-			return s.Reply(211, "Looks good to me.")
-		}
-		list, err := s.stat(c.Msg)
-		if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file or directory.")
-		} else if err != nil {
-			return s.Reply(550, "Error retrieving status.")
-		}
-		msg := []string{"Status:"}
-		msg = append(msg, listLines(list)...)
-		msg = append(msg, "End.")
-		return s.Reply(213, strings.Join(msg, "\n"))
-	case "LIST", "NLST":
-		if err := s.list(c); err == errNoDataConn {
-			return s.Reply(425, "Use PORT or PASV first.")
-		} else if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such directory.")
-		} else if err != nil {
-			return s.Reply(550, "Error listing directory.")
-		}
-		return s.Reply(226, "Directory send OK.")
-	case "RETR":
-		if err := s.retrieve(c); err == errNoDataConn {
-			return s.Reply(425, "Use PORT or PASV first.")
-		} else if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if isNotExist(err) {
-			return s.Reply(550, "No such file.")
-		} else if err != nil {
-			return s.Reply(550, "Error retrieving file.")
-		}
-		return s.Reply(226, "Transfer complete.")
-	case "STOR":
-		if err := s.store(c); err == errNoDataConn {
-			return s.Reply(425, "Use PORT or PASV first.")
-		} else if isPermission(err) {
-			return s.Reply(550, "Insufficient permissions.")
-		} else if err != nil {
-			return s.Reply(550, "Error storing file.")
-		}
-		return s.Reply(226, "Transfer complete.")
-	case "PBSZ":
-		if s.Server.TLS == nil {
-			return s.Reply(502, "Not implemented.")
-		}
-		if c.Msg == "0" {
-			return s.Reply(200, "OK.")
-		}
-		return s.Reply(534, "Unacceptable buffer size. PBSZ=0")
-	case "PROT":
-		if s.Server.TLS == nil {
-			return s.Reply(502, "Not implemented.")
-		}
-		switch c.Msg {
-		case "P":
-			s.TLS = s.Server.TLS
-		case "C":
-			s.TLS = nil
-		default:
-			return s.Reply(504, "Unsupported protection level.")
-		}
-		return s.Reply(200, "Protection level changed.")
-	case "OPTS":
-		if msg := strings.ToUpper(c.Msg); msg == "UTF8 ON" {
-			return s.Reply(200, "Always in UTF8 mode.")
+			s.User = ""
+			return err
+		} else if acct == nil {
+			return s.refuseLogin(ErrLoginIncorrect)
 		}
-		return s.Reply(501, "Option not understood.")
-	case "HELP":
-		return s.Reply(214,
-			`The following commands are recognized.
-CDUP CWD  DELE EPRT EPSV FEAT HELP LIST MDTM MKD  MODE NLST NOOP OPTS
-PASS PASV PBSZ PORT PROT PWD  QUIT REST RETR RMD  RNFR RNTO SIZE STAT
-STOR SYST TYPE USER
-Help OK.`)
-	case "NOOP":
+		s.Account = acct
+		if err := s.checkAccount(); err != nil {
+			return s.refuseLogin(err)
+		}
+	} else if s.Authorizer != nil {
+		if ok, err := s.Authorize(s.User, c.Msg); err != nil {
+			s.User = ""
+			return err
+		} else if !ok {
+			return s.refuseLogin(ErrLoginIncorrect)
+		}
+	}
+	if a := s.Server.Access; a != nil {
+		if err := a.Login(s.User, clientIP(s.Addr)); err != nil {
+			return s.refuseLogin(err)
+		}
+	}
+	others, ok := s.Server.loggedIn(s.Session, s.takeover())
+	if !ok {
+		return s.refuseLogin(ErrLoggedIn)
+	}
+	for _, ss := range others {
+		s.Server.Kick(ss.ID)
+	}
+	s.Server.recordLogin(s.Addr, true)
+	s.Password = c.Msg
+	s.authed = true
+	s.watchWindow()
+	if s.Welcome != nil {
+		if lines := s.Welcome(s.Session); len(lines) > 0 {
+			lines = append(lines, "Login successful.")
+			return s.ReplyLines(230, lines)
+		}
+	}
+	return s.Reply(230, "Login successful.")
+}
+
+func (s *fileSession) handleFEAT(c *Command) error {
+	msg := []string{"Extensions supported:"}
+	msg = append(msg, s.features()...)
+	msg = append(msg, "End.")
+	return s.ReplyLines(211, msg)
+}
+
+func (s *fileSession) handleQUIT(c *Command) error {
+	return s.done("Goodbye.")
+}
+
+func (s *fileSession) handleSYST(c *Command) error {
+	return s.Reply(215, "UNIX Type: L8")
+}
+
+func (s *fileSession) handleTYPE(c *Command) error {
+	if err := s.SetType(c.Msg); err != nil {
+		return s.ReplyString(504, err.Error())
+	}
+	return s.done("Type switched successfully.")
+}
+
+func (s *fileSession) handleMODE(c *Command) error {
+	if err := s.SetMode(c.Msg); err != nil {
+		return s.ReplyString(504, err.Error())
+	}
+	return s.done("Mode switched successfully.")
+}
+
+func (s *fileSession) handlePWD(c *Command) error {
+	path := s.Path("")
+	return s.done(quote(path) + " is the current directory.")
+}
+
+func (s *fileSession) handleCWD(c *Command) error {
+	if c.Msg == "" {
+		return s.replyErr(550, os.ErrInvalid, "Failed to change directory.")
+	}
+	path := s.Path(c.Msg)
+	if !s.permit(path, PermEnter) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	if stat, err := s.Stat(path); isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Failed to change directory.")
+	} else if !stat.IsDir() {
+		return s.replyErr(550, errNotDir, "Failed to change directory.")
+	}
+	s.SetDir(path)
+	return s.replyCWD(path)
+}
+
+func (s *fileSession) handleCDUP(c *Command) error {
+	path := s.Path("..")
+	if !s.permit(path, PermEnter) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	if stat, err := s.Stat(path); isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Failed to change directory.")
+	} else if !stat.IsDir() {
+		return s.replyErr(550, errNotDir, "Failed to change directory.")
+	}
+	s.SetDir(path)
+	return s.replyCWD(path)
+}
+
+func (s *fileSession) handleMKD(c *Command) error {
+	path := s.Path(c.Msg)
+	if !s.permit(parentDir(path), PermMkdir) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	if err := s.Mkdir(path); isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if err != nil {
+		return s.replyErr(550, err, "Failed to create directory.")
+	}
+	return s.done(quote(path) + " created.")
+}
+
+func (s *fileSession) handleSIZE(c *Command) error {
+	path := s.Path(c.Msg)
+	stat, err := s.statHeld(path)
+	if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not get size.")
+	} else if stat.IsDir() && !s.SizeDirs {
+		return s.replyErr(550, errIsDir, "Path specifies a directory.")
+	}
+	size := strconv.FormatInt(stat.Size(), 10)
+	return s.ReplyString(213, size)
+}
+
+func (s *fileSession) handleMDTM(c *Command) error {
+	path := s.Path(c.Msg)
+	stat, err := s.statHeld(path)
+	if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file or directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not get modification time.")
+	}
+	mdtm := stat.ModTime().UTC().Format(mdtmFormat)
+	return s.ReplyString(213, mdtm)
+}
+
+// MFMT sets the modification time of a file, as proposed in
+// draft-somers-ftp-mfxx. The time is in UTC, with optional fractional seconds
+// that are dropped.
+func (s *fileSession) handleMFMT(c *Command) error {
+	i := strings.IndexByte(c.Msg, ' ')
+	if i < 0 {
+		return s.Reply(501, "Syntax error in parameters or arguments.")
+	}
+	val, name := c.Msg[:i], c.Msg[i+1:]
+	if j := strings.IndexByte(val, '.'); j >= 0 {
+		val = val[:j]
+	}
+	mtime, err := time.Parse(mdtmFormat, val)
+	if err != nil {
+		return s.Reply(501, "Invalid time.")
+	}
+	path := s.Path(name)
+	if !s.permit(path, PermWrite) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	// The zero access time leaves it unchanged.
+	err = s.FileSystem.(Chtimeser).Chtimes(path, time.Time{}, mtime)
+	if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file or directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not set modification time.")
+	}
+	return s.ReplyString(213, "Modify="+mtime.Format(mdtmFormat)+"; "+name)
+}
+
+// Handler for DELE and RMD.
+func (s *fileSession) handleDELE(c *Command) error {
+	if c.Msg == "" {
+		return s.Reply(501, "A file name is required.")
+	}
+	path := s.Path(c.Msg)
+	if !s.permit(path, PermDelete) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	if err := s.Remove(path); isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not delete file.")
+	}
+	return s.done("Successfully deleted file.")
+}
+
+func (s *fileSession) handleRNFR(c *Command) error {
+	if c.Msg == "" {
+		return s.Reply(501, "A file name is required.")
+	}
+	path := s.Path(c.Msg)
+	if !s.permit(path, PermRename) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	s.renaming = path
+	return s.Reply(350, "Call RNTO to specify destination.")
+}
+
+func (s *fileSession) handleRNTO(c *Command) error {
+	if c.Msg == "" {
+		return s.Reply(501, "A file name is required.")
+	} else if s.renaming == "" {
+		return s.Reply(503, "Call RNFR first.")
+	}
+	old, new := s.renaming, s.Path(c.Msg)
+	if !s.permitWrite(new, PermWrite) {
+		return s.replyErr(550, os.ErrPermission, "Insufficient permissions.")
+	}
+	if err := s.Rename(old, new); isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not rename file.")
+	}
+	return s.done("Successfully renamed file.")
+}
+
+func (s *fileSession) handlePASV(c *Command) error {
+	if s.epsvOnly {
+		return s.Reply(550, "PASV is disallowed.")
+	}
+	// The PASV reply can only express an IPv4 address. Over IPv6, we can
+	// only offer PASV if an IPv4 address is configured to advertise.
+	if ip, _ := s.Server.passiveAddr(s.Session); s.ipv6() && ip.To4() == nil {
+		return s.Reply(425, "PASV is unavailable over IPv6; use EPSV.")
+	}
+	if err := s.Passive("tcp4"); err == errNetworkNotAllowed {
+		return s.Reply(425, "PASV is unavailable; use EPSV.")
+	} else if err == errProtRequired {
+		return s.Reply(521, "Data connections must be protected; use PROT P.")
+	} else if err != nil {
+		s.logf("passive: %v", err)
+		return s.Reply(425, "Can't open data connection.")
+	}
+	hp := HostPort(s.PassiveAddr())
+	return s.replyPassive(227, "Entering Passive Mode (%s).", hp)
+}
+
+func (s *fileSession) handleEPSV(c *Command) error {
+	if msg := strings.ToUpper(c.Msg); msg == "ALL" {
+		s.epsvOnly = true
+		return s.Reply(200, "EPSV ALL ok.")
+	}
+	var nw string
+	switch c.Msg {
+	case "1":
+		nw = "tcp4"
+	case "2":
+		nw = "tcp6"
+	case "":
+		nw = s.Addr.Network()
+		if s.Server.DataNetwork != "" {
+			nw = s.Server.DataNetwork
+		}
+	default:
+		return s.Reply(522, "Unsupported protocol, use %s.", s.epsvProtocols())
+	}
+	if err := s.Passive(nw); err == errNetworkNotAllowed {
+		return s.Reply(522, "Unsupported protocol, use %s.", s.epsvProtocols())
+	} else if err == errProtRequired {
+		return s.Reply(521, "Data connections must be protected; use PROT P.")
+	} else if err != nil {
+		return s.Reply(425, "Can't open data connection.")
+	}
+	p := s.Data.Port()
+	return s.replyPassive(229, "Entering Extended Passive Mode (|||%d|)", p)
+}
+
+// Reply to PASV or EPSV, using the server's PassiveReply if set.
+func (s *fileSession) replyPassive(code int, msg string, args ...interface{}) error {
+	if f := s.Server.PassiveReply; f != nil {
+		if text := f(s.Session, code, s.PassiveAddr()); text != "" {
+			return s.ReplyString(code, text)
+		}
+	}
+	return s.Reply(code, msg, args...)
+}
+
+// Return the EPSV network protocols allowed, as in "(1,2)".
+func (s *fileSession) epsvProtocols() string {
+	switch s.Server.DataNetwork {
+	case "tcp4":
+		return "(1)"
+	case "tcp6":
+		return "(2)"
+	}
+	return "(1,2)"
+}
+
+func (s *fileSession) handlePORT(c *Command) error {
+	if s.epsvOnly {
+		return s.Reply(550, "PORT is disallowed.")
+	}
+	msg := c.Msg
+	if s.Quirks&QuirkDottedPORT != 0 {
+		msg = strings.Replace(msg, ".", ",", -1)
+	}
+	addr, err := ParsePORT(msg)
+	if err != nil {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	if err := s.Active(addr); err == errNetworkNotAllowed {
+		return s.Reply(522, "Unsupported protocol, use %s.", s.epsvProtocols())
+	} else if err == errTargetNotAllowed {
+		return s.Reply(504, "Address not allowed.")
+	} else if err == errProtRequired {
+		return s.Reply(521, "Data connections must be protected; use PROT P.")
+	} else if err != nil {
+		return s.Reply(550, "Failed to connect.")
+	}
+	return s.done("OK")
+}
+
+func (s *fileSession) handleEPRT(c *Command) error {
+	if s.epsvOnly {
+		return s.Reply(550, "EPRT is disallowed.")
+	}
+	addr, err := ParseEPRT(c.Msg)
+	if err != nil {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	if err := s.Active(addr); err == errNetworkNotAllowed {
+		return s.Reply(522, "Unsupported protocol, use %s.", s.epsvProtocols())
+	} else if err == errTargetNotAllowed {
+		return s.Reply(504, "Address not allowed.")
+	} else if err == errProtRequired {
+		return s.Reply(521, "Data connections must be protected; use PROT P.")
+	} else if err != nil {
+		return s.Reply(550, "Failed to connect.")
+	}
+	return s.done("OK")
+}
+
+func (s *fileSession) handleREST(c *Command) error {
+	n, err := ParseRestart(c.Msg)
+	if err != nil {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	s.restart, s.rangeEnd = n, 0
+	return s.Reply(350, "Restart position accepted (%d).", n)
+}
+
+// RANG sets an inclusive byte range for the next RETR or STOR, which start
+// at the range as at a REST offset and stop at its end, so that a range from
+// 0 replaces the file as STOR does. "RANG 1 0" resets the range.
+func (s *fileSession) handleRANG(c *Command) error {
+	args := c.Args()
+	if len(args) != 2 {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	start, err := ParseRestart(args[0])
+	if err != nil {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	end, err := ParseRestart(args[1])
+	if err != nil {
+		return s.Reply(501, "Invalid syntax.")
+	}
+	if start == 1 && end == 0 {
+		s.restart, s.rangeEnd = 0, 0
+		return s.Reply(350, "Byte range reset.")
+	} else if end < start || end == math.MaxInt64 {
+		return s.Reply(501, "Invalid byte range.")
+	}
+	s.restart, s.rangeEnd = start, end+1
+	return s.Reply(350, "Restarting at %d. End byte range at %d.", start, end)
+}
+
+func (s *fileSession) handleSTAT(c *Command) error {
+	if c.Msg == "" {
+		return s.ReplyLines(211, s.status())
+	}
+	list, err := s.stat(c.Msg)
+	if err == errMemoryLimit {
+		return s.replyErr(451, errMemoryLimit, "Listing exceeds the memory limit.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file or directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error retrieving status.")
+	}
+	msg := []string{"Status:"}
+	if s.Server.Deterministic {
+		sort.Sort(byName(list))
+	}
+	msg = append(msg, s.listFormat().Lines(list)...)
+	msg = append(msg, "End.")
+	return s.ReplyLines(213, msg)
+}
+
+// MLST replies with the facts for a single path over the control channel. The
+// fact line is sent as the indented middle line of a multi-line reply.
+func (s *fileSession) handleMLST(c *Command) error {
+	path := s.Path(c.Msg)
+	stat, err := s.Stat(path)
+	if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file or directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error retrieving status.")
+	}
+	msg := []string{"Listing " + path, mlstLine(stat, path, s.selectedFacts(), s.perm(path, stat)), "End."}
+	return s.ReplyLines(250, msg)
+}
+
+// Handler for LIST and NLST.
+func (s *fileSession) handleLIST(c *Command) error {
+	if err := s.list(c); err == errNoDataConn {
+		return s.Reply(425, "Use PORT or PASV first.")
+	} else if isAborted(err) {
+		return s.Reply(426, "Connection closed; transfer aborted.")
+	} else if err == errMemoryLimit {
+		return s.replyErr(451, errMemoryLimit, "Listing exceeds the memory limit.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error listing directory.")
+	}
+	return s.done("Directory send OK.")
+}
+
+func (s *fileSession) handleRETR(c *Command) error {
+	if err := s.retrieve(c); err == errNoDataConn {
+		return s.Reply(425, "Use PORT or PASV first.")
+	} else if isAborted(err) {
+		return s.Reply(426, "Connection closed; transfer aborted.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if e := isOffline(err); e != nil {
+		return s.replyOffline(e)
+	} else if err == ErrRestartRange {
+		return s.replyErr(554, ErrRestartRange, "Restart offset beyond end of file.")
+	} else if err == ErrRestartASCII {
+		return s.replyErr(554, ErrRestartASCII, "Restart is not supported in ASCII mode.")
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error retrieving file.")
+	}
+	return s.done("Transfer complete.")
+}
+
+// Reply to a RETR of a file being recalled from offline storage.
+func (s *fileSession) replyOffline(e *OfflineError) error {
+	return s.replyErr(450, e, "File is being recalled from offline storage; %s.", RetryHint(e.RetryAfter))
+}
+
+func (s *fileSession) handleSTOR(c *Command) error {
+	if err := s.store(c); err == errNoDataConn {
+		return s.Reply(425, "Use PORT or PASV first.")
+	} else if isAborted(err) {
+		return s.Reply(426, "Connection closed; transfer aborted.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if err == ErrQuotaExceeded {
+		return s.replyErr(552, ErrQuotaExceeded, "Disk quota exceeded.")
+	} else if err == ErrRestartRange {
+		return s.replyErr(554, ErrRestartRange, "Restart offset beyond end of file.")
+	} else if err == ErrRestartASCII {
+		return s.replyErr(554, ErrRestartASCII, "Restart is not supported in ASCII mode.")
+	} else if err == errNotSupported && c.Cmd == "APPE" {
+		return s.Reply(504, "Appending is not supported by the file system.")
+	} else if err == errNotSupported {
+		return s.Reply(504, "Restarting uploads is not supported by the file system.")
+	} else if err == errRangeExceeded {
+		return s.Reply(552, "Data exceeds the byte range.")
+	} else if e, ok := err.(*journalError); ok {
+		return s.replyErr(554, err, "Restart offset beyond stored data; restart at %d or earlier.", e.off)
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error storing file.")
+	}
+	return s.done("Transfer complete.")
+}
+
+func (s *fileSession) handleAUTH(c *Command) error {
+	switch strings.ToUpper(c.Msg) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		return s.Reply(504, "Unsupported security mechanism.")
+	}
+	err := s.StartTLS("AUTH TLS successful.")
+	if err == errTLSActive {
+		return s.Reply(503, "Already using TLS.")
+	} else if err == errPipelined {
+		return s.Reply(503, "Commands may not follow AUTH before the TLS handshake.")
+	} else if err == errNoTLS {
+		return s.Reply(502, "TLS is not available.")
+	}
+	return err
+}
+
+func (s *fileSession) handleCCC(c *Command) error {
+	err := s.ClearTLS("Control connection cleared.")
+	if err == errCCCRefused {
+		return s.Reply(534, "CCC is not allowed.")
+	} else if err == errNotAuthTLS {
+		return s.Reply(533, "Control connection is not protected by AUTH TLS.")
+	} else if err == errPipelined {
+		return s.Reply(503, "Commands may not follow CCC before TLS is closed.")
+	}
+	return err
+}
+
+func (s *fileSession) handlePBSZ(c *Command) error {
+	if !s.secure() {
+		return s.Reply(503, "Use AUTH TLS first.")
+	}
+	if c.Msg == "0" {
 		return s.Reply(200, "OK.")
+	}
+	return s.Reply(534, "Unacceptable buffer size. PBSZ=0")
+}
+
+func (s *fileSession) handlePROT(c *Command) error {
+	if !s.secure() {
+		return s.Reply(503, "Use AUTH TLS first.")
+	}
+	switch c.Msg {
+	case "P":
+		s.TLS = s.dataTLS()
+	case "C":
+		s.TLS = nil
 	default:
-		return s.handlePreAuth(c)
+		return s.Reply(504, "Unsupported protection level.")
 	}
+	return s.Reply(200, "Protection level changed.")
 }
 
-// Return supported features.
-func (s *fileSession) features() []string {
-	f := []string{
-		"EPRT", "EPSV", "MDTM", "PASV", "REST STREAM", "SIZE", "UTF8",
+func (s *fileSession) handleOPTS(c *Command) error {
+	oc := c.Sub()
+	if e := s.Options[oc.Cmd]; e != nil {
+		return e.Handle(s.Session, oc)
 	}
-	if s.Server.TLS != nil {
-		f = append(f, "PBSZ", "PROT")
+	if h := optsCommands[oc.Cmd]; h != nil {
+		return h(s, oc)
 	}
-	sort.Strings(f)
-	return f
+	return s.Reply(501, "Option not understood.")
+}
+
+func (s *fileSession) optsUTF8(c *Command) error {
+	if strings.ToUpper(c.Msg) != "ON" {
+		return s.Reply(501, "Option not understood.")
+	}
+	s.utf8 = true
+	return s.Reply(200, "Always in UTF8 mode.")
+}
+
+func (s *fileSession) optsMLST(c *Command) error {
+	s.facts = parseFacts(c.Msg)
+	if len(s.facts) == 0 {
+		return s.Reply(200, "MLST OPTS")
+	}
+	return s.ReplyString(200, "MLST OPTS "+strings.Join(s.facts, ";")+";")
+}
+
+func (s *fileSession) handleHELP(c *Command) error {
+	args := c.Args()
+	if len(args) == 0 {
+		msg := []string{"The following commands are recognized."}
+		msg = append(msg, helpColumns(s.commandNames())...)
+		msg = append(msg, "Help OK.")
+		return s.ReplyLines(214, msg)
+	}
+	name := strings.ToUpper(args[0])
+	if name == "SITE" && len(args) > 1 {
+		sc := s.siteCommand(strings.ToUpper(args[1]))
+		if sc == nil {
+			return s.Reply(502, "Unknown SITE command.")
+		}
+		return s.ReplyString(214, helpText(sc.help, "SITE "+strings.ToUpper(args[1])))
+	}
+	cmd := s.command(name)
+	if cmd == nil {
+		return s.ReplyString(502, "Unknown command "+name+".")
+	}
+	if name == "SITE" {
+		msg := []string{"Syntax: " + cmd.help, "The following SITE commands are recognized."}
+		msg = append(msg, helpColumns(s.siteNames())...)
+		msg = append(msg, "Help OK.")
+		return s.ReplyLines(214, msg)
+	}
+	return s.ReplyString(214, helpText(cmd.help, name))
+}
+
+// Format help text for a command, falling back to its name.
+func helpText(help, name string) string {
+	if help == "" {
+		help = name
+	}
+	return "Syntax: " + help
+}
+
+// Arrange command names into columns for HELP.
+func helpColumns(names []string) []string {
+	var lines []string
+	for i := 0; i < len(names); i += 8 {
+		j := i + 8
+		if j > len(names) {
+			j = len(names)
+		}
+		line := make([]string, 0, 8)
+		for _, name := range names[i:j] {
+			line = append(line, fmt.Sprintf("%-4s", name))
+		}
+		lines = append(lines, strings.TrimRight(strings.Join(line, " "), " "))
+	}
+	return lines
+}
+
+func (s *fileSession) handleNOOP(c *Command) error {
+	if s.NoopTimeout > 0 && time.Since(s.active) > s.NoopTimeout {
+		s.Reply(421, "Idle too long; closing connection.")
+		return io.EOF
+	}
+	return s.done("OK.")
+}
+
+func (s *fileSession) handleSITE(c *Command) error {
+	sc := c.Sub()
+	cmd := s.siteCommand(sc.Cmd)
+	if cmd == nil {
+		return s.Reply(502, "Unknown SITE command.")
+	}
+	if s.Server.Strict && !cmd.args.valid(sc.Msg) {
+		return s.Reply(501, "Syntax error in parameters or arguments.")
+	}
+	return cmd.handle(s, sc)
+}
+
+// SITE DSIZ reports the cumulative size of a directory.
+func (s *fileSession) handleDSIZ(c *Command) error {
+	path := s.Path(c.Msg)
+	var size int64
+	err := errNotSupported
+	if ds, ok := s.FileSystem.(DirSizer); ok {
+		size, err = ds.DirSize(path)
+	}
+	if err == errNotSupported {
+		size, err = s.walkSize(path)
+	}
+	if err == errDirSizeLimit {
+		return s.replyErr(550, errDirSizeLimit, "Directory too large to size.")
+	} else if err == errMemoryLimit {
+		return s.replyErr(451, errMemoryLimit, "Listing exceeds the memory limit.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Could not get directory size.")
+	}
+	return s.ReplyString(213, strconv.FormatInt(size, 10))
+}
+
+// SITE QUOTA reports the user's storage usage and limit.
+func (s *fileSession) handleQUOTA(c *Command) error {
+	used, limit, err := s.FileSystem.(Quotaer).Quota(s.User)
+	if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if err != nil {
+		return s.Reply(550, "Could not get quota.")
+	}
+	msg := []string{"Disk quota for " + s.User + ":", fmt.Sprintf("Used: %d bytes", used)}
+	if limit < 0 {
+		msg = append(msg, "Limit: none")
+	} else {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		msg = append(msg,
+			fmt.Sprintf("Limit: %d bytes", limit),
+			fmt.Sprintf("Remaining: %d bytes", remaining))
+	}
+	msg = append(msg, "End.")
+	return s.ReplyLines(200, msg)
+}
+
+// ALLO announces the size of the next upload, with an optional maximum
+// record or page size, which is ignored.
+func (s *fileSession) handleALLO(c *Command) error {
+	args := c.Args()
+	if len(args) != 1 && (len(args) != 3 || args[1] != "R") {
+		return s.Reply(501, "Syntax error in parameters or arguments.")
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return s.Reply(501, "Invalid size.")
+	}
+	a, ok := s.FileSystem.(Allocator)
+	if !ok {
+		return s.Reply(200, "No allocation necessary.")
+	}
+	if err := a.Allocate(size); err == errNotSupported {
+		return s.Reply(200, "No allocation necessary.")
+	} else if err == ErrQuotaExceeded {
+		return s.replyErr(552, ErrQuotaExceeded, "Disk quota exceeded.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if err != nil {
+		return s.replyErr(452, err, "Insufficient storage space.")
+	}
+	return s.Reply(200, "Space allocated.")
 }
 
 // Handler for RETR.
@@ -403,62 +1478,242 @@ func (s *fileSession) retrieve(c *Command) error {
 		return errNoDataConn
 	}
 	path := s.Path(c.Msg)
-	file, err := s.Open(path)
-	if err != nil {
+	if !s.permit(path, PermRead) {
+		s.CloseData()
+		return os.ErrPermission
+	}
+	if err := s.checkRestart(path, false); err != nil {
 		s.CloseData()
 		return err
 	}
-	if err := s.Reply(150, "Here comes the file."); err != nil {
-		file.Close()
+	file, seek, err := s.openAt(path, s.restart)
+	if err != nil {
 		s.CloseData()
 		return err
 	}
-	if s.restart > 0 {
-		if _, err := file.Seek(s.restart, io.SeekStart); err != nil {
-			file.Close()
-			s.CloseData()
+	defer file.Close()
+	return s.transfer("Here comes the file.", true, func() error {
+		if seek > 0 {
+			if err := seekTo(file, seek); err != nil {
+				return err
+			}
+		}
+		var src io.Reader = file
+		if s.rangeEnd > 0 {
+			src = io.LimitReader(file, s.rangeEnd-s.restart)
+		}
+		_, err := s.copyData(dataIO{s.Session}, src)
+		return err
+	})
+}
+
+// A heldFile is a File opened by OpenStat, kept for a following RETR.
+type heldFile struct {
+	path string
+	file File
+	stat os.FileInfo
+}
+
+// Stat path, opening it with OpenStat if the FileSystem supports that.
+func (s *fileSession) statHeld(path string) (os.FileInfo, error) {
+	if s.held != nil && s.held.path == path {
+		return s.held.stat, nil
+	}
+	fs, ok := s.FileSystem.(OpenStater)
+	if !ok {
+		return s.Stat(path)
+	}
+	s.closeHeld()
+	file, stat, err := fs.OpenStat(path)
+	if err == errNotSupported {
+		return s.Stat(path)
+	} else if err != nil {
+		return nil, err
+	}
+	s.held = &heldFile{path, file, stat}
+	return stat, nil
+}
+
+// Open path, reusing the held file if it is the same path.
+func (s *fileSession) openHeld(path string) (File, error) {
+	if h := s.held; h != nil && h.path == path {
+		s.held = nil
+		return h.file, nil
+	}
+	return s.Open(path)
+}
+
+// Open path for reading from off, using OpenAt if the FileSystem supports
+// that. This returns the offset the caller must still seek to.
+func (s *fileSession) openAt(path string, off int64) (File, int64, error) {
+	if fs, ok := s.FileSystem.(OpenAter); ok && off > 0 {
+		if file, err := fs.OpenAt(path, off); err != errNotSupported {
+			s.closeHeld()
+			return file, 0, err
+		}
+	}
+	file, err := s.openHeld(path)
+	return file, off, err
+}
+
+// Check the restart offset for a transfer of path. For uploads, the file
+// need not exist.
+func (s *fileSession) checkRestart(path string, upload bool) error {
+	if s.rangeEnd > 0 && s.Type == "A" {
+		return ErrRestartASCII
+	} else if s.restart == 0 {
+		return nil
+	}
+	var size int64
+	if upload {
+		stat, err := s.Stat(path)
+		if err != nil && !isNotExist(err) {
 			return err
+		} else if err == nil {
+			size = stat.Size()
 		}
+	} else {
+		stat, err := s.statHeld(path)
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
 	}
-	if _, err := io.Copy(s.Data, file); err != nil {
-		file.Close()
-		s.CloseData()
+	if err := CheckRestart(s.restart, size, s.Type); err != nil || !upload {
 		return err
 	}
-	file.Close()
-	return s.CloseData()
+	return s.checkJournal(path)
+}
+
+// Return the size of path, or 0 if it doesn't exist.
+func (s *fileSession) size(path string) (int64, error) {
+	stat, err := s.Stat(path)
+	if isNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Extend file to size, leaving a hole in file systems supporting sparse
+// files.
+func extend(file File, size int64) error {
+	t, ok := file.(interface{ Truncate(int64) error })
+	if !ok {
+		return ErrRestartRange
+	}
+	return t.Truncate(size)
+}
+
+// Close a file whose upload failed with err, so that a FileSystem that can
+// tell, like the HTTPHandler's, discards the incomplete file.
+func closeFailed(file File, err error) error {
+	if c, ok := file.(interface{ CloseWithError(error) error }); ok {
+		return c.CloseWithError(err)
+	}
+	return file.Close()
+}
+
+// Close the held file, if any.
+func (s *fileSession) closeHeld() {
+	if s.held != nil {
+		s.held.file.Close()
+		s.held = nil
+	}
 }
 
-// Handler for STOR.
+// Return whether a held file should be kept after cmd, which is the case for
+// commands that commonly come between SIZE or MDTM and RETR.
+func keepsHeld(cmd string) bool {
+	switch cmd {
+	case "SIZE", "MDTM", "REST", "RANG", "TYPE", "MODE", "STRU",
+		"PASV", "EPSV", "PORT", "EPRT", "NOOP":
+		return true
+	}
+	return false
+}
+
+// Handler for STOR and APPE. APPE writes from the end of the file, as if
+// restarted there.
 func (s *fileSession) store(c *Command) error {
 	if s.Data == nil {
 		return errNoDataConn
 	}
 	path := s.Path(c.Msg)
-	file, err := s.Create(path)
+	perm := PermWrite
+	if c.Cmd == "APPE" {
+		perm = PermAppend
+	}
+	if !s.permitWrite(path, perm) {
+		s.CloseData()
+		return os.ErrPermission
+	}
+	var err error
+	var sparse bool
+	if c.Cmd == "APPE" {
+		// APPE writes at the end of the file, so a range set by RANG
+		// doesn't apply.
+		s.rangeEnd = 0
+		if s.restart, err = s.size(path); err == nil {
+			err = s.checkJournal(path)
+		}
+	} else {
+		err = s.checkRestart(path, true)
+		if sparse = err == ErrRestartRange && s.SparseRestart; sparse {
+			err = s.checkJournal(path)
+		}
+	}
 	if err != nil {
 		s.CloseData()
 		return err
 	}
-	if err := s.Reply(150, "Awaiting file data."); err != nil {
-		file.Close()
+	file, err := CreateAt(s.FileSystem, path, s.restart)
+	if err != nil {
 		s.CloseData()
 		return err
 	}
-	if s.restart > 0 {
-		if _, err := file.Seek(s.restart, io.SeekStart); err != nil {
+	if sparse {
+		if err := extend(file, s.restart); err != nil {
 			file.Close()
 			s.CloseData()
 			return err
 		}
 	}
-	if _, err := io.Copy(file, s.Data); err != nil {
+	d := s.durability(path)
+	if d.Every > 0 {
+		file = &durableFile{File: file, every: d.Every}
+	}
+	jf, err := s.journal(file, path)
+	if err != nil {
 		file.Close()
 		s.CloseData()
 		return err
 	}
-	err = file.Close()
-	s.CloseData()
+	file = jf
+	err = s.transfer("Awaiting file data.", false, func() error {
+		var dst io.Writer = file
+		if s.rangeEnd > 0 {
+			dst = &rangeWriter{file, s.rangeEnd - s.restart}
+		}
+		_, err := s.copyData(dst, dataIO{s.Session})
+		return err
+	})
+	if err == nil && d.OnClose {
+		err = syncFile(file)
+	}
+	if jf, ok := jf.(*journalFile); ok && err != nil {
+		// On failure, the last checkpoint remains valid.
+		jf.checkpoint()
+	}
+	if err != nil {
+		closeFailed(file, err)
+	} else {
+		err = file.Close()
+	}
+	if err == nil && s.Journal != nil {
+		err = s.Journal.Clear(path)
+	}
 	return err
 }
 
@@ -475,11 +1730,14 @@ func (s *fileSession) stat(p string) ([]os.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	list, err := file.Readdir(0)
+	list, cost, err := readdir(file, s.Session)
 	if err != nil {
 		file.Close()
 		return nil, err
 	}
+	// The listing is released once the reply is formatted, which happens
+	// before the next command can reserve memory.
+	s.release(cost)
 	file.Close()
 	return list, nil
 }
@@ -489,28 +1747,64 @@ func (s *fileSession) list(c *Command) error {
 	if s.Data == nil {
 		return errNoDataConn
 	}
-	path := s.Path(stripListFlags(c.Msg))
-	file, err := s.Open(path)
-	if err != nil {
+	arg := c.Msg
+	if s.Quirks&QuirkListFlags != 0 {
+		arg = stripListFlags(arg)
+	}
+	path := s.Path(arg)
+	if !s.permit(path, PermList|PermRead) {
 		s.CloseData()
-		return err
+		return os.ErrPermission
 	}
-	if err := s.Reply(150, "Here comes the list."); err != nil {
-		file.Close()
+	stat, err := s.Stat(path)
+	if err != nil {
 		s.CloseData()
 		return err
 	}
+	var file File
+	if stat.IsDir() {
+		if file, err = s.Open(path); err != nil {
+			s.CloseData()
+			return err
+		}
+	} else {
+		// Listing a file produces just that file, named as given.
+		file = &dirFile{list: []os.FileInfo{stat}}
+		arg = pathDir(arg)
+	}
+	defer file.Close()
+	f := s.listFormat()
 	list := Lister{
-		File: file,
-		Cmd:  c.Cmd,
+		File:     file,
+		Cmd:      c.Cmd,
+		Dir:      arg,
+		Long:     s.LongNLST,
+		Now:      f.Now,
+		Location: f.Location,
+		Sort:     s.Server.Deterministic,
+		acct:     s.Session,
 	}
-	if _, err := list.WriteTo(s.Data); err != nil {
-		file.Close()
-		s.CloseData()
+	return s.transfer("Here comes the list.", true, func() error {
+		_, err := list.WriteTo(s.Data)
 		return err
+	})
+}
+
+// Return the directory part of a path argument, or "" if there is none.
+func pathDir(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i+1]
 	}
-	file.Close()
-	return s.CloseData()
+	return ""
+}
+
+// Return the format for long listings.
+func (s *fileSession) listFormat() listfmt.Format {
+	f := listfmt.Format{Now: s.Server.now()}
+	if s.Server.Deterministic {
+		f.Location = time.UTC
+	}
+	return f
 }
 
 // Some clients assume LIST accepts flags like ls. This removes those.
@@ -537,6 +1831,17 @@ func isPermission(err error) bool {
 	return os.IsPermission(err)
 }
 
+// Check if an error implies the file system is unavailable.
+func isUnavailable(err error) bool {
+	return err == errFSTimeout || err == errBreakerOpen
+}
+
+// Return the OfflineError err is, or nil.
+func isOffline(err error) *OfflineError {
+	e, _ := err.(*OfflineError)
+	return e
+}
+
 // Check if an error implies a file does not exist.
 func isNotExist(err error) bool {
 	return os.IsNotExist(err)
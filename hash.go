@@ -0,0 +1,201 @@
+package ftp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	errIsDir     = errors.New("is a directory")
+	errHashLimit = errors.New("file too large to hash")
+)
+
+// Hash algorithms for HASH, in the order FEAT lists them.
+var hashAlgs = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"SHA-256", sha256.New},
+	{"SHA-1", sha1.New},
+	{"MD5", md5.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// Return the FEAT line for HASH, marking the selected algorithm.
+func hashFeature(selected string) string {
+	var algs []string
+	for _, a := range hashAlgs {
+		if a.name == selected {
+			algs = append(algs, a.name+"*")
+		} else {
+			algs = append(algs, a.name)
+		}
+	}
+	return "HASH " + strings.Join(algs, ";")
+}
+
+// Return the hash algorithm selected with OPTS HASH, or SHA-256.
+func (s *fileSession) hashAlg() string {
+	if s.hash == "" {
+		return hashAlgs[0].name
+	}
+	return s.hash
+}
+
+func (s *fileSession) optsHASH(c *Command) error {
+	if c.Msg == "" {
+		return s.ReplyString(200, s.hashAlg())
+	}
+	for _, a := range hashAlgs {
+		if strings.EqualFold(a.name, c.Msg) {
+			s.hash = a.name
+			return s.ReplyString(200, a.name)
+		}
+	}
+	return s.Reply(501, "Unknown algorithm.")
+}
+
+// HASH replies with the digest of a file, or of the part of it from the
+// offset given by REST or in the range given by RANG, as proposed in
+// draft-bryan-ftpext-hash. This lets clients verify transfers without
+// downloading files again.
+func (s *fileSession) handleHASH(c *Command) error {
+	start, end := s.restart, int64(-1)
+	if s.rangeEnd > 0 {
+		end = s.rangeEnd
+	}
+	end, sum, err := s.hashFile(s.hashAlg(), s.Path(c.Msg), start, end)
+	if err != nil {
+		return s.replyHashError(err)
+	}
+	return s.ReplyString(213, fmt.Sprintf("%s %d-%d %s %s", s.hashAlg(), start, end, sum, c.Msg))
+}
+
+// Hash algorithms of the legacy checksum commands.
+var checksumAlgs = map[string]string{
+	"XCRC":  "CRC32",
+	"XMD5":  "MD5",
+	"XSHA1": "SHA-1",
+}
+
+// Handler for XCRC, XMD5, and XSHA1, the checksum commands of older Windows
+// clients, which take a file name, quoted if it is followed by optional start
+// and end offsets.
+func (s *fileSession) handleXCRC(c *Command) error {
+	name, start, end, err := parseChecksum(c.Msg)
+	if err != nil {
+		return s.Reply(501, "Syntax error in parameters or arguments.")
+	}
+	_, sum, err := s.hashFile(checksumAlgs[c.Cmd], s.Path(name), start, end)
+	if err != nil {
+		return s.replyHashError(err)
+	}
+	return s.ReplyString(250, strings.ToUpper(sum))
+}
+
+// Parse the arguments of a checksum command. The end is -1 if not given.
+func parseChecksum(msg string) (name string, start, end int64, err error) {
+	if !strings.HasPrefix(msg, `"`) {
+		return msg, 0, -1, nil
+	}
+	i := strings.IndexByte(msg[1:], '"')
+	if i < 0 {
+		return "", 0, 0, errors.New("unterminated file name")
+	}
+	name, args := msg[1:i+1], strings.Fields(msg[i+2:])
+	end = -1
+	if len(args) > 2 {
+		return "", 0, 0, errors.New("too many arguments")
+	}
+	if len(args) > 0 {
+		if start, err = ParseRestart(args[0]); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if len(args) > 1 {
+		if end, err = ParseRestart(args[1]); err != nil {
+			return "", 0, 0, err
+		}
+		if end < start {
+			return "", 0, 0, errors.New("end before start")
+		}
+	}
+	return name, start, end, nil
+}
+
+// Reply to a failure to hash a file.
+func (s *fileSession) replyHashError(err error) error {
+	if err == errIsDir {
+		return s.replyErr(550, errIsDir, "Path specifies a directory.")
+	} else if err == errHashLimit {
+		return s.replyErr(550, errHashLimit, "File too large to hash; the limit is %d bytes.", s.HashLimit)
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if err == ErrRestartRange {
+		return s.replyErr(554, ErrRestartRange, "Restart offset beyond end of file.")
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such file.")
+	}
+	return s.replyErr(550, err, "Could not compute hash.")
+}
+
+// Hash the bytes of path from start to end, or to the end of the file if end
+// is negative or beyond it, with alg. This returns the end and the digest in
+// hex. Digests are of the stored bytes, whatever the transfer type.
+func (s *fileSession) hashFile(alg, path string, start, end int64) (int64, string, error) {
+	if !s.permit(path, PermRead) {
+		return 0, "", os.ErrPermission
+	}
+	stat, err := s.statHeld(path)
+	if err != nil {
+		return 0, "", err
+	} else if stat.IsDir() {
+		return 0, "", errIsDir
+	}
+	if size := stat.Size(); end < 0 || end > size {
+		end = size
+	}
+	if start > stat.Size() {
+		return 0, "", ErrRestartRange
+	}
+	if s.HashLimit > 0 && end-start > s.HashLimit {
+		return 0, "", errHashLimit
+	}
+	sum, err := s.digest(alg, path, start, end)
+	return end, sum, err
+}
+
+// Return the hex digest with alg of the bytes of path from start to end.
+func (s *fileSession) digest(alg, path string, start, end int64) (string, error) {
+	var h hash.Hash
+	for _, a := range hashAlgs {
+		if a.name == alg {
+			h = a.new()
+		}
+	}
+	file, seek, err := s.openAt(path, start)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if seek > 0 {
+		if err := seekTo(file, seek); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.CopyN(h, file, end-start); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+package ftp
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Returned by a FileHandler when HOST selects another Handler.
+var errHostChanged = errors.New("host changed")
+
+// A HostMux is a Handler that routes sessions to Handlers by the host name
+// clients give with HOST (RFC 7151), so that one listener can serve several
+// virtual hosts, much as an http.ServeMux routes requests. Sessions are
+// handled by Default until they send HOST, which must precede USER.
+//
+// HOST is implemented by FileHandler, and by the Handlers wrapping one.
+type HostMux struct {
+	// Default handles sessions that haven't sent HOST. If nil, logins are
+	// refused until HOST selects a Handler.
+	Default Handler
+
+	mu    sync.RWMutex
+	hosts map[string]Handler // Keyed by canonical host name.
+}
+
+var _ Handler = (*HostMux)(nil)
+
+// Handles before HOST when a HostMux has no Default.
+var noHost = &FileHandler{Authorizer: denyAuth{}, FileSystem: emptyFS{}}
+
+// HandleHost routes sessions giving host to h, replacing any Handler routed
+// to before. Host names are compared without regard to case.
+func (m *HostMux) HandleHost(host string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hosts == nil {
+		m.hosts = make(map[string]Handler)
+	}
+	m.hosts[canonicalHost(host)] = h
+}
+
+// Return the Handler for host, or nil.
+func (m *HostMux) handler(host string) Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.hosts[canonicalHost(host)]
+}
+
+// Handle implements Handler.
+func (m *HostMux) Handle(s *Session) error {
+	s.hosts = m
+	h := m.Default
+	if h == nil {
+		h = noHost
+	}
+	for {
+		err := h.Handle(s)
+		if err != errHostChanged {
+			return err
+		}
+		h = m.handler(s.Host)
+	}
+}
+
+// Return host in lower case, without brackets around an IP address or a
+// trailing dot.
+func canonicalHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Whether the session can select a virtual host.
+func hasHosts(s *fileSession) bool {
+	return s.hosts != nil
+}
+
+func (s *fileSession) handleHOST(c *Command) error {
+	if s.User != "" {
+		return s.Reply(503, "HOST must precede USER.")
+	}
+	if s.hosts.handler(c.Msg) == nil {
+		return s.Reply(504, "Unknown host.")
+	}
+	s.Host = canonicalHost(c.Msg)
+	if err := s.Reply(220, "Host accepted."); err != nil {
+		return err
+	}
+	return errHostChanged
+}
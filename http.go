@@ -0,0 +1,308 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An HTTPHandler serves an HTTP server's resources to FTP clients. RETR maps
+// to GET, STOR to PUT, DELE and RMD to DELETE, MKD to MKCOL, and RNFR/RNTO to
+// MOVE. Directory listings are parsed from the links in index pages served
+// for URLs ending in a slash.
+type HTTPHandler struct {
+	Authorizer // Authorizer for login. If nil, accept all.
+
+	URL    string       // URL the FTP root maps to.
+	Header http.Header  // Header added to every request, e.g. Authorization.
+	Client *http.Client // Client for requests, or http.DefaultClient if nil.
+}
+
+var _ Handler = (*HTTPHandler)(nil)
+
+// Handle implements Handler.
+func (h *HTTPHandler) Handle(s *Session) error {
+	fh := FileHandler{
+		Authorizer: h.Authorizer,
+		FileSystem: &httpFileSystem{h, s.Ctx()},
+	}
+	return fh.Handle(s)
+}
+
+// Links in an index page.
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*"([^"]*)"`)
+
+// An httpFileSystem is a FileSystem backed by an HTTPHandler's server.
+type httpFileSystem struct {
+	*HTTPHandler
+	ctx context.Context // Context for requests.
+}
+
+// Return the URL for p.
+func (f *httpFileSystem) url(p string, dir bool) string {
+	p = path.Join("/", p)
+	if dir && p != "/" {
+		p += "/"
+	}
+	u := &url.URL{Path: p}
+	return strings.TrimSuffix(f.URL, "/") + u.EscapedPath()
+}
+
+// Perform a request, returning an error matching os package errors for
+// failure statuses.
+func (f *httpFileSystem) do(method, url string, body io.Reader, h http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(f.ctx)
+	for k, v := range f.Header {
+		req.Header[k] = v
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return nil, os.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, os.ErrPermission
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+}
+
+// Stat implements FileSystem.
+func (f *httpFileSystem) Stat(p string) (os.FileInfo, error) {
+	name := path.Base(path.Join("/", p))
+	if path.Join("/", p) == "/" {
+		return &stat{name: name, mode: os.ModeDir | 0755}, nil
+	}
+	resp, err := f.do("HEAD", f.url(p, false), nil, nil)
+	if os.IsNotExist(err) {
+		if resp, err = f.do("HEAD", f.url(p, true), nil, nil); err == nil {
+			resp.Body.Close()
+			return &stat{name: name, mode: os.ModeDir | 0755}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return httpStat(name, resp), nil
+}
+
+// Return the stat for a file response.
+func httpStat(name string, resp *http.Response) *stat {
+	fi := &stat{name: name, mode: 0644}
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		fi.size = n
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		fi.time = t
+	}
+	return fi
+}
+
+// Open implements FileSystem.
+func (f *httpFileSystem) Open(p string) (File, error) {
+	fi, err := f.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return &httpFile{fs: f, url: f.url(p, false)}, nil
+	}
+	resp, err := f.do("GET", f.url(p, true), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFile{fs: f, list: parseIndex(b)}, nil
+}
+
+// Parse the entries of an index page from its relative links.
+func parseIndex(b []byte) []os.FileInfo {
+	var list []os.FileInfo
+	seen := make(map[string]bool)
+	for _, m := range hrefPattern.FindAllSubmatch(b, -1) {
+		href, err := url.PathUnescape(string(m[1]))
+		if err != nil || href == "" || strings.ContainsAny(href, "?#:") ||
+			strings.HasPrefix(href, "/") || strings.HasPrefix(href, ".") {
+			continue
+		}
+		dir := strings.HasSuffix(href, "/")
+		name := strings.TrimSuffix(href, "/")
+		if strings.Contains(name, "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		fi := &stat{name: name, mode: 0644}
+		if dir {
+			fi.mode = os.ModeDir | 0755
+		}
+		list = append(list, fi)
+	}
+	return list
+}
+
+// Create implements FileSystem. The upload is streamed to a PUT request,
+// which completes when the returned File is closed.
+func (f *httpFileSystem) Create(p string) (File, error) {
+	r, w := io.Pipe()
+	file := &httpFile{fs: f, w: w, done: make(chan error, 1)}
+	go func() {
+		resp, err := f.do("PUT", f.url(p, false), r, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		r.CloseWithError(err)
+		file.done <- err
+	}()
+	return file, nil
+}
+
+// Mkdir implements FileSystem.
+func (f *httpFileSystem) Mkdir(p string) error {
+	return f.close(f.do("MKCOL", f.url(p, true), nil, nil))
+}
+
+// Remove implements FileSystem.
+func (f *httpFileSystem) Remove(p string) error {
+	return f.close(f.do("DELETE", f.url(p, false), nil, nil))
+}
+
+// Rename implements FileSystem.
+func (f *httpFileSystem) Rename(old, new string) error {
+	h := http.Header{"Destination": {f.url(new, false)}}
+	return f.close(f.do("MOVE", f.url(old, false), nil, h))
+}
+
+// Close a response body, returning err.
+func (f *httpFileSystem) close(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// An httpFile is a File for an httpFileSystem. Reads are performed with a GET
+// request made on the first read, using a Range header for any prior seek.
+type httpFile struct {
+	fs   *httpFileSystem
+	url  string
+	off  int64
+	body io.ReadCloser
+	list []os.FileInfo
+
+	w    *io.PipeWriter
+	done chan error
+}
+
+// Read implements File.
+func (f *httpFile) Read(b []byte) (int, error) {
+	if f.url == "" {
+		return 0, errNotSupported
+	}
+	if f.body == nil {
+		var h http.Header
+		if f.off > 0 {
+			h = http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.off)}}
+		}
+		resp, err := f.fs.do("GET", f.url, nil, h)
+		if err != nil {
+			return 0, err
+		}
+		if f.off > 0 && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, errors.New("server does not support ranges")
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(b)
+	f.off += int64(n)
+	return n, err
+}
+
+// Write implements File.
+func (f *httpFile) Write(b []byte) (int, error) {
+	if f.w == nil {
+		return 0, errNotSupported
+	}
+	return f.w.Write(b)
+}
+
+// Seek implements File. Only seeking before the first read is supported.
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	if f.body != nil || f.w != nil || whence != io.SeekStart {
+		return 0, errNotSupported
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Readdir implements File.
+func (f *httpFile) Readdir(n int) ([]os.FileInfo, error) {
+	if n <= 0 {
+		list := f.list
+		f.list = nil
+		return list, nil
+	}
+	if len(f.list) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.list) {
+		n = len(f.list)
+	}
+	list := f.list[:n]
+	f.list = f.list[n:]
+	return list, nil
+}
+
+// CloseWithError ends an upload with err, failing its PUT request so that
+// the incomplete file isn't stored.
+func (f *httpFile) CloseWithError(err error) error {
+	if f.w == nil {
+		return f.Close()
+	}
+	f.w.CloseWithError(err)
+	f.w = nil
+	return <-f.done
+}
+
+// Close implements File.
+func (f *httpFile) Close() error {
+	if f.w != nil {
+		f.w.Close()
+		f.w = nil
+		return <-f.done
+	}
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package ftp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Default bytes between journal checkpoints of an upload.
+const defaultJournalInterval = 1 << 20
+
+// A Journal persists the progress of uploads, so that an upload interrupted
+// by a crash can only be restarted from data known to have reached storage.
+// Its methods are called from session goroutines, so they must be safe for
+// concurrent use.
+type Journal interface {
+	// Record that the upload by user to path has stored off bytes.
+	Record(path, user string, off int64) error
+
+	// Clear the record of path, once its upload completes.
+	Clear(path string) error
+
+	// Lookup the record of path, returning ok false if there is none.
+	Lookup(path string) (user string, off int64, ok bool, err error)
+}
+
+// A journalError refuses a restart beyond the data journalled as stored.
+type journalError struct {
+	off int64 // Bytes known to be stored.
+}
+
+func (e *journalError) Error() string {
+	return "restart offset beyond journalled data"
+}
+
+// Check a restart of an upload to path against the journal.
+func (s *fileSession) checkJournal(path string) error {
+	if s.Journal == nil || s.restart == 0 {
+		return nil
+	}
+	_, off, ok, err := s.Journal.Lookup(path)
+	if err != nil {
+		return err
+	}
+	if ok && s.restart > off {
+		return &journalError{off}
+	}
+	return nil
+}
+
+// Return a File recording the progress of an upload to path in the journal,
+// or file if there is no journal.
+func (s *fileSession) journal(file File, path string) (File, error) {
+	if s.Journal == nil {
+		return file, nil
+	}
+	if err := s.Journal.Record(path, s.User, s.restart); err != nil {
+		return nil, err
+	}
+	interval := s.JournalInterval
+	if interval <= 0 {
+		interval = defaultJournalInterval
+	}
+	return &journalFile{
+		File:     file,
+		j:        s.Journal,
+		path:     path,
+		user:     s.User,
+		off:      s.restart,
+		next:     s.restart + interval,
+		interval: interval,
+	}, nil
+}
+
+// A journalFile is a File being uploaded, recording its progress in a
+// Journal. Progress is only recorded after syncing the file, if it has a
+// Sync method like *os.File.
+type journalFile struct {
+	File
+	j          Journal
+	path, user string
+	off        int64 // Bytes written.
+	next       int64 // Offset of the next checkpoint.
+	interval   int64
+}
+
+// Write implements File, checkpointing every interval bytes.
+func (f *journalFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.off += int64(n)
+	if err == nil && f.off >= f.next {
+		err = f.checkpoint()
+		f.next = f.off + f.interval
+	}
+	return n, err
+}
+
+// Sync syncs the file, if it can be synced.
+func (f *journalFile) Sync() error {
+	return syncFile(f.File)
+}
+
+// CloseWithError closes the file, passing on the error that failed the
+// upload.
+func (f *journalFile) CloseWithError(err error) error {
+	return closeFailed(f.File, err)
+}
+
+// Record the bytes written once they are stored.
+func (f *journalFile) checkpoint() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.j.Record(f.path, f.user, f.off)
+}
+
+// Sync f if it can be synced.
+func syncFile(f File) error {
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// NewFileJournal returns a Journal kept in the file at path as JSON, loading
+// any records left by a previous process. The file is replaced atomically on
+// every change, which suits servers with few concurrent uploads.
+func NewFileJournal(path string) (Journal, error) {
+	j := &fileJournal{path: path, m: make(map[string]journalRecord)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(b, &j.m); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+type fileJournal struct {
+	path string
+	mu   sync.Mutex
+	m    map[string]journalRecord
+}
+
+type journalRecord struct {
+	User string `json:"user"`
+	Off  int64  `json:"off"`
+}
+
+func (j *fileJournal) Record(path, user string, off int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.m[path] = journalRecord{user, off}
+	return j.save()
+}
+
+func (j *fileJournal) Clear(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.m[path]; !ok {
+		return nil
+	}
+	delete(j.m, path)
+	return j.save()
+}
+
+func (j *fileJournal) Lookup(path string) (string, int64, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r, ok := j.m[path]
+	return r.User, r.Off, ok, nil
+}
+
+// Write the records to a temporary file, sync it, and rename it over the
+// journal.
+func (j *fileJournal) save() error {
+	b, err := json.Marshal(j.m)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// A Durability is a policy for syncing uploads to storage, for FileSystems
+// whose files have a Sync method like *os.File. Syncing trades throughput
+// for the assurance that stored data survives a crash.
+type Durability struct {
+	// OnClose syncs each upload before the reply that it completed, so that
+	// the reply means the file is stored.
+	OnClose bool
+
+	// Every, if positive, syncs an upload after every this many bytes,
+	// bounding the data at risk in a long transfer.
+	Every int64
+}
+
+// Return the durability policy for an upload to path.
+func (s *fileSession) durability(path string) Durability {
+	if s.DurabilityFor != nil {
+		return s.DurabilityFor(s.Session, path)
+	}
+	return s.Durability
+}
+
+// A durableFile is a File being uploaded, synced every so many bytes.
+type durableFile struct {
+	File
+	every int64
+	n     int64 // Bytes written since the last sync.
+}
+
+// Write implements File, syncing every so many bytes.
+func (f *durableFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.n += int64(n)
+	if err == nil && f.n >= f.every {
+		err = f.Sync()
+	}
+	return n, err
+}
+
+// Sync syncs the file, if it can be synced.
+func (f *durableFile) Sync() error {
+	f.n = 0
+	return syncFile(f.File)
+}
+
+// CloseWithError closes the file like journalFile.CloseWithError.
+func (f *durableFile) CloseWithError(err error) error {
+	return closeFailed(f.File, err)
+}
@@ -0,0 +1,106 @@
+package ftp
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Catalog supplies localized reply messages for LANG (RFC 2640).
+type Catalog interface {
+	// Languages returns the supported language tags, such as "EN" or
+	// "pt-BR". The first is the default, used until the client sends LANG.
+	Languages() []string
+
+	// Message returns the reply format, as passed to Session.Reply, in
+	// language lang, or "" to send it untranslated. Translations must
+	// keep the format's verbs in order.
+	Message(lang, format string) string
+}
+
+// Messages is a Catalog of reply formats by language tag. The formats
+// themselves are English, the default language.
+type Messages map[string]map[string]string
+
+// Languages implements Catalog.
+func (m Messages) Languages() []string {
+	langs := []string{"EN"}
+	for lang := range m {
+		if !strings.EqualFold(lang, "EN") {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs[1:])
+	return langs
+}
+
+// Message implements Catalog.
+func (m Messages) Message(lang, format string) string {
+	return m[lang][format]
+}
+
+// Return the translation of a reply format into the session's language.
+func (s *Session) localize(format string) string {
+	c := s.Server.Catalog
+	if c == nil {
+		return format
+	}
+	lang := s.lang
+	if lang == "" {
+		lang = c.Languages()[0]
+	}
+	if msg := c.Message(lang, format); msg != "" {
+		return msg
+	}
+	return format
+}
+
+// Return the supported language matching tag, comparing the primary
+// subtags if none matches exactly, or "" if none does.
+func matchLanguage(langs []string, tag string) string {
+	for _, lang := range langs {
+		if strings.EqualFold(lang, tag) {
+			return lang
+		}
+	}
+	primary := func(tag string) string {
+		return strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+	}
+	for _, lang := range langs {
+		if primary(lang) == primary(tag) {
+			return lang
+		}
+	}
+	return ""
+}
+
+// Return the LANG feature, listing the supported languages and marking
+// the current one.
+func langFeature(langs []string, current string) string {
+	var f []string
+	for i, lang := range langs {
+		if lang == current || current == "" && i == 0 {
+			lang += "*"
+		}
+		f = append(f, lang)
+	}
+	return "LANG " + strings.Join(f, ";")
+}
+
+// Whether replies can be localized.
+func hasCatalog(s *fileSession) bool {
+	return s.Server.Catalog != nil
+}
+
+func (s *fileSession) handleLANG(c *Command) error {
+	langs := s.Server.Catalog.Languages()
+	if c.Msg == "" {
+		s.lang = ""
+		return s.Reply(200, "Language set to %s.", langs[0])
+	}
+	lang := matchLanguage(langs, c.Msg)
+	if lang == "" {
+		return s.Reply(504, "Language not supported.")
+	}
+	s.lang = lang
+	return s.Reply(200, "Language set to %s.", lang)
+}
@@ -2,17 +2,34 @@ package ftp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"sort"
 	"time"
+
+	"github.com/igneous-systems/ftp/listfmt"
 )
 
-// A Lister produces listing output similar to ls.
+var errNotSupported = errors.New("operation not supported")
+
+// A Lister produces listing output similar to ls. For NLST, this produces bare
+// names one per line as RFC 959 intends, so that clients can use the output
+// for mget.
 type Lister struct {
 	File
-	Cmd string
-	buf *bytes.Buffer
+	Cmd  string
+	Dir  string // Dir is joined with each NLST name, if non-empty.
+	Long bool   // Long makes NLST produce long lines like LIST.
+
+	Now      time.Time      // Now is the current time, or time.Now() if zero.
+	Location *time.Location // Location for times, or time.Local if nil.
+	Sort     bool           // Sort entries by name.
+
+	buf  *bytes.Buffer
+	acct *Session // Session to account listing memory against.
 }
 
 // Read implements io.Reader.
@@ -29,64 +46,50 @@ func (l *Lister) WriteTo(w io.Writer) (n int64, err error) {
 	if l.buf != nil {
 		return l.buf.WriteTo(w)
 	}
-	list, err := l.Readdir(0)
+	list, cost, err := readdir(l.File, l.acct)
 	if err != nil {
 		return 0, err
 	}
+	defer l.acct.release(cost)
+	if l.Sort {
+		sort.Sort(byName(list))
+	}
 
-	if l.Cmd != "NLST" {
-		nn, err := fmt.Fprintln(w, "total", len(list))
-		n += int64(nn)
-		if err != nil {
-			return n, err
+	var lines []string
+	if l.names() {
+		lines = make([]string, len(list))
+		for i, fi := range list {
+			lines[i] = path.Join(l.Dir, fi.Name())
 		}
+	} else {
+		lines = append([]string{fmt.Sprint("total ", len(list))}, l.format().Lines(list)...)
 	}
-
-	for _, fi := range list {
-		nn, err := l.writeLine(w, fi)
+	for _, line := range lines {
+		nn, err := fmt.Fprintln(w, line)
 		n += int64(nn)
 		if err != nil {
 			return n, err
 		}
 	}
-
 	return n, nil
 }
 
-func (l *Lister) writeLine(w io.Writer, fi os.FileInfo) (n int, err error) {
-	if l.Cmd == "NLST" {
-		return fmt.Fprintln(w, fi.Name())
-	}
-	return fmt.Fprintln(w, listLine(fi))
+// Return the format of long lines for l.
+func (l *Lister) format() listfmt.Format {
+	return listfmt.Format{Now: l.Now, Location: l.Location}
 }
 
-func listLines(fi []os.FileInfo) []string {
-	l := make([]string, len(fi))
-	for i, fi := range fi {
-		l[i] = listLine(fi)
-	}
-	return l
+// Whether to produce bare names rather than long lines.
+func (l *Lister) names() bool {
+	return l.Cmd == "NLST" && !l.Long
 }
 
-func listLine(fi os.FileInfo) string {
-	mode := fi.Mode()
-	nlinks := 1
-	user := "user"
-	group := "group"
-	size := fi.Size()
-	time := formatTime(fi.ModTime())
-	name := fi.Name()
-
-	return fmt.Sprintf("%10s %d %6s %6s %7d %12s %s",
-		mode, nlinks, user, group, size, time, name)
-}
+// Sort FileInfos by name.
+type byName []os.FileInfo
 
-func formatTime(t time.Time) string {
-	if t.Year() == time.Now().Year() {
-		return t.Format("Jan _2 15:04")
-	}
-	return t.Format("Jan _2 2006")
-}
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 
 type stat struct {
 	name string
@@ -101,3 +104,31 @@ func (s *stat) ModTime() time.Time { return s.time }
 func (s *stat) Mode() os.FileMode  { return s.mode }
 func (s *stat) IsDir() bool        { return s.mode.IsDir() }
 func (s *stat) Sys() interface{}   { return nil }
+
+// A dirFile is a File listing entries held in memory.
+type dirFile struct {
+	list []os.FileInfo
+}
+
+func (f *dirFile) Read(b []byte) (int, error)     { return 0, errNotSupported }
+func (f *dirFile) Write(b []byte) (int, error)    { return 0, errNotSupported }
+func (f *dirFile) Seek(int64, int) (int64, error) { return 0, errNotSupported }
+func (f *dirFile) Close() error                   { return nil }
+
+// Readdir implements File.
+func (f *dirFile) Readdir(n int) ([]os.FileInfo, error) {
+	if n <= 0 {
+		list := f.list
+		f.list = nil
+		return list, nil
+	}
+	if len(f.list) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.list) {
+		n = len(f.list)
+	}
+	list := f.list[:n]
+	f.list = f.list[n:]
+	return list, nil
+}
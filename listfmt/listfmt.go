@@ -0,0 +1,78 @@
+// Package listfmt formats directory listings in the long format of ls, as
+// the ftp package does for LIST and STAT, so that custom Handlers can produce
+// the same output.
+package listfmt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Listings show the time rather than the year of entries modified within
+// this long, half an average Gregorian year, as ls does.
+const recent = 15778476 * time.Second
+
+// Minimum width of the size column.
+const sizeWidth = 7
+
+// A Format formats long listing lines relative to a point in time.
+type Format struct {
+	Now      time.Time      // Now is the current time, or time.Now() if zero.
+	Location *time.Location // Location for times, or time.Local if nil.
+
+	// User and Group are shown as the owner of every entry, or "user" and
+	// "group" if empty.
+	User, Group string
+}
+
+// Line returns the long listing line for fi, without a line ending.
+func (f Format) Line(fi os.FileInfo) string {
+	return f.line(fi, sizeWidth)
+}
+
+// Lines returns the long listing lines for list, with the size column as wide
+// as the largest size.
+func (f Format) Lines(list []os.FileInfo) []string {
+	width := sizeWidth
+	for _, fi := range list {
+		if n := len(strconv.FormatInt(fi.Size(), 10)); n > width {
+			width = n
+		}
+	}
+	l := make([]string, len(list))
+	for i, fi := range list {
+		l[i] = f.line(fi, width)
+	}
+	return l
+}
+
+func (f Format) line(fi os.FileInfo, width int) string {
+	user, group := f.User, f.Group
+	if user == "" {
+		user = "user"
+	}
+	if group == "" {
+		group = "group"
+	}
+	return fmt.Sprintf("%10s %d %6s %6s %*d %12s %s",
+		fi.Mode(), 1, user, group, width, fi.Size(), f.Time(fi.ModTime()), fi.Name())
+}
+
+// Time formats a modification time as ls does: with the time of day if it is
+// within the last six months, or else with the year.
+func (f Format) Time(t time.Time) string {
+	now, loc := f.Now, f.Location
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	if !t.After(now) && now.Sub(t) < recent {
+		return t.Format("Jan _2 15:04")
+	}
+	return t.Format("Jan _2 2006")
+}
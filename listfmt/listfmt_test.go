@@ -0,0 +1,59 @@
+package listfmt
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type stat struct {
+	name string
+	size int64
+	time time.Time
+}
+
+func (s *stat) Name() string       { return s.name }
+func (s *stat) Size() int64        { return s.size }
+func (s *stat) ModTime() time.Time { return s.time }
+func (s *stat) Mode() os.FileMode  { return 0644 }
+func (s *stat) IsDir() bool        { return false }
+func (s *stat) Sys() interface{}   { return nil }
+
+func TestTime(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := Format{Now: now, Location: time.UTC}
+	for _, tt := range []struct {
+		t    time.Time
+		want string
+	}{
+		{now.Add(-time.Hour), "Mar  1 11:00"},
+		{time.Date(2014, 12, 24, 8, 30, 0, 0, time.UTC), "Dec 24 08:30"},
+		{time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC), "Jun  1 2014"},
+		{now.Add(time.Hour), "Mar  1 2015"},
+	} {
+		if got := f.Time(tt.t); got != tt.want {
+			t.Errorf("Time(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := Format{Now: now, Location: time.UTC, User: "ftp"}
+	got := f.Lines([]os.FileInfo{
+		&stat{"a", 5, now},
+		&stat{"b", 123456789012, now},
+	})
+	want := []string{
+		"-rw-r--r-- 1    ftp  group            5 Mar  1 12:00 a",
+		"-rw-r--r-- 1    ftp  group 123456789012 Mar  1 12:00 b",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+	if got, want := f.Line(&stat{"a", 5, now}), "-rw-r--r-- 1    ftp  group       5 Mar  1 12:00 a"; got != want {
+		t.Errorf("Line = %q, want %q", got, want)
+	}
+}
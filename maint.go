@@ -0,0 +1,91 @@
+package ftp
+
+// DefaultMaintenance is the default message for connections during
+// maintenance.
+var DefaultMaintenance = "Down for maintenance."
+
+// Maintenance is a maintenance mode, entered with Server.StartMaintenance.
+type Maintenance struct {
+	// Message is sent to new connections in place of the greeting. If
+	// empty, DefaultMaintenance is used.
+	Message string
+
+	// ReadOnly admits new connections without permission to change files,
+	// instead of refusing them with 421.
+	ReadOnly bool
+}
+
+// Return the message for new connections.
+func (m *Maintenance) message() string {
+	if m.Message == "" {
+		return DefaultMaintenance
+	}
+	return m.Message
+}
+
+// StartMaintenance puts the server into maintenance mode m, or changes the
+// mode if it is already in one. Sessions in progress are drained, closing
+// once their current commands, such as transfers, complete.
+func (s *Server) StartMaintenance(m Maintenance) {
+	s.maintMu.Lock()
+	s.maint = &m
+	s.maintMu.Unlock()
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, si := range s.sessions {
+		si.ss.Drain()
+	}
+}
+
+// EndMaintenance takes the server out of maintenance mode. Sessions admitted
+// read-only remain so until they end.
+func (s *Server) EndMaintenance() {
+	s.maintMu.Lock()
+	defer s.maintMu.Unlock()
+	s.maint = nil
+}
+
+// InMaintenance returns the server's maintenance mode, and whether it is in
+// one.
+func (s *Server) InMaintenance() (Maintenance, bool) {
+	s.maintMu.Lock()
+	defer s.maintMu.Unlock()
+	if s.maint == nil {
+		return Maintenance{}, false
+	}
+	return *s.maint, true
+}
+
+// DefaultReadOnly is the default message refusing changes to files while
+// the server is read-only.
+var DefaultReadOnly = "Server is read-only; try again later."
+
+// SetReadOnly makes the server read-only, as during a storage migration:
+// commands changing files, such as STOR, DELE, MKD and RNTO, are refused
+// with 553 and msg, or DefaultReadOnly if empty, while downloads continue.
+// Unlike maintenance, sessions in progress are kept, and uploads already
+// under way complete.
+func (s *Server) SetReadOnly(msg string) {
+	if msg == "" {
+		msg = DefaultReadOnly
+	}
+	s.maintMu.Lock()
+	defer s.maintMu.Unlock()
+	s.readOnly = msg
+}
+
+// ClearReadOnly lets clients change files again after SetReadOnly.
+func (s *Server) ClearReadOnly() {
+	s.maintMu.Lock()
+	defer s.maintMu.Unlock()
+	s.readOnly = ""
+}
+
+// ReadOnly returns the message refusing changes to files, and whether the
+// server is read-only.
+func (s *Server) ReadOnly() (string, bool) {
+	s.maintMu.Lock()
+	defer s.maintMu.Unlock()
+	return s.readOnly, s.readOnly != ""
+}
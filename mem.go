@@ -0,0 +1,67 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errMemoryLimit = errors.New("session memory limit exceeded")
+
+// Estimated memory held by one directory entry, excluding its name.
+const direntCost = 256
+
+// Number of directory entries read at once when memory is limited.
+const direntBatch = 256
+
+// Reserve n bytes of the session's memory allowance. This fails with
+// errMemoryLimit if the server's MaxSessionMemory would be exceeded.
+func (s *Session) reserve(n int64) error {
+	if s == nil || s.Server.MaxSessionMemory <= 0 {
+		return nil
+	}
+	if s.mem+n > s.Server.MaxSessionMemory {
+		return errMemoryLimit
+	}
+	s.mem += n
+	return nil
+}
+
+// Release n bytes reserved with reserve.
+func (s *Session) release(n int64) {
+	if s != nil && s.Server.MaxSessionMemory > 0 {
+		s.mem -= n
+	}
+}
+
+// Read all entries of f, accounting for them against the memory allowance of
+// s if it is non-nil. When memory is limited, entries are read in batches so
+// that reading stops as soon as the limit is reached. The returned cost must
+// be released by the caller.
+func readdir(f File, s *Session) ([]os.FileInfo, int64, error) {
+	if s == nil || s.Server.MaxSessionMemory <= 0 {
+		list, err := f.Readdir(0)
+		return list, 0, err
+	}
+	var list []os.FileInfo
+	var cost int64
+	for {
+		batch, err := f.Readdir(direntBatch)
+		var n int64
+		for _, fi := range batch {
+			n += direntCost + int64(len(fi.Name()))
+		}
+		if rerr := s.reserve(n); rerr != nil {
+			s.release(cost)
+			return nil, 0, rerr
+		}
+		cost += n
+		list = append(list, batch...)
+		if err == io.EOF || err == nil && len(batch) == 0 {
+			return list, cost, nil
+		} else if err != nil {
+			s.release(cost)
+			return nil, 0, err
+		}
+	}
+}
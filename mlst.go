@@ -0,0 +1,149 @@
+package ftp
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// Facts supported by MLST, in the order they are written.
+var mlstFacts = []string{"type", "size", "modify", "perm"}
+
+// Return the FEAT line for MLST listing the supported facts, with those
+// selected marked.
+func mlstFeature(selected []string) string {
+	f := "MLST "
+	for _, fact := range mlstFacts {
+		f += fact
+		if hasFact(selected, fact) {
+			f += "*"
+		}
+		f += ";"
+	}
+	return f
+}
+
+// Return the supported facts in msg, a list given to OPTS MLST.
+func parseFacts(msg string) []string {
+	facts := []string{}
+	for _, fact := range mlstFacts {
+		for _, f := range strings.Split(msg, ";") {
+			if strings.EqualFold(f, fact) {
+				facts = append(facts, fact)
+				break
+			}
+		}
+	}
+	return facts
+}
+
+func hasFact(facts []string, fact string) bool {
+	for _, f := range facts {
+		if f == fact {
+			return true
+		}
+	}
+	return false
+}
+
+// Format fi as an RFC 3659 fact line for name, with the given facts and
+// permissions.
+func mlstLine(fi os.FileInfo, name string, facts []string, perm Perm) string {
+	var b []byte
+	for _, fact := range facts {
+		var v string
+		switch fact {
+		case "type":
+			v = "file"
+			if fi.IsDir() {
+				v = "dir"
+			}
+		case "size":
+			v = strconv.FormatInt(fi.Size(), 10)
+		case "modify":
+			v = fi.ModTime().UTC().Format(mdtmFormat)
+		case "perm":
+			v = perm.String()
+		}
+		b = append(b, fact...)
+		b = append(b, '=')
+		b = append(b, v...)
+		b = append(b, ';')
+	}
+	b = append(b, ' ')
+	b = append(b, name...)
+	return string(b)
+}
+
+// Handler for MLSD.
+func (s *fileSession) handleMLSD(c *Command) error {
+	if err := s.mlsd(c); err == errNoDataConn {
+		return s.Reply(425, "Use PORT or PASV first.")
+	} else if isAborted(err) {
+		return s.Reply(426, "Connection closed; transfer aborted.")
+	} else if err == errNotDir {
+		return s.replyErr(501, errNotDir, "Not a directory.")
+	} else if err == errMemoryLimit {
+		return s.replyErr(451, errMemoryLimit, "Listing exceeds the memory limit.")
+	} else if isUnavailable(err) {
+		return s.replyUnavailable()
+	} else if isPermission(err) {
+		return s.replyErr(550, err, "Insufficient permissions.")
+	} else if isNotExist(err) {
+		return s.replyErr(550, err, "No such directory.")
+	} else if err != nil {
+		return s.replyErr(550, err, "Error listing directory.")
+	}
+	return s.done("Directory send OK.")
+}
+
+// Send the fact lines of the entries of a directory over the data
+// connection, named relative to it, as RFC 3659 section 7 describes.
+func (s *fileSession) mlsd(c *Command) error {
+	if s.Data == nil {
+		return errNoDataConn
+	}
+	dir := s.Path(c.Msg)
+	if !s.permit(dir, PermList) {
+		s.CloseData()
+		return os.ErrPermission
+	}
+	stat, err := s.Stat(dir)
+	if err == nil && !stat.IsDir() {
+		err = errNotDir
+	}
+	if err != nil {
+		s.CloseData()
+		return err
+	}
+	file, err := s.Open(dir)
+	if err != nil {
+		s.CloseData()
+		return err
+	}
+	list, cost, err := readdir(file, s.Session)
+	file.Close()
+	if err != nil {
+		s.CloseData()
+		return err
+	}
+	defer s.release(cost)
+	if s.Server.Deterministic {
+		sort.Sort(byName(list))
+	}
+	facts := s.selectedFacts()
+	return s.transfer("Here comes the listing.", true, func() error {
+		w := bufio.NewWriter(dataIO{s.Session})
+		for _, fi := range list {
+			line := mlstLine(fi, fi.Name(), facts, s.perm(path.Join(dir, fi.Name()), fi))
+			w.WriteString(line + "\r\n")
+		}
+		return w.Flush()
+	})
+}
@@ -0,0 +1,212 @@
+package ftp
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var errCrossMount = errors.New("rename across mounts")
+
+// A Mux is a FileSystem that routes paths to FileSystems mounted at path
+// prefixes, such as a report generator at /reports and a LocalFileSystem at
+// /files. The longest matching prefix wins, and the mounted FileSystem sees
+// paths relative to its mount point. Mount points are listed as directories
+// in their parent directories, so CWD and PWD work across mounts.
+type Mux struct {
+	Root FileSystem // Root serves paths outside any mount, if non-nil.
+
+	mu     sync.RWMutex
+	mounts map[string]FileSystem // Keyed by cleaned absolute path.
+}
+
+var _ FileSystem = (*Mux)(nil)
+
+// Mount fs at prefix, replacing any FileSystem mounted there.
+func (m *Mux) Mount(prefix string, fs FileSystem) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mounts == nil {
+		m.mounts = make(map[string]FileSystem)
+	}
+	m.mounts[path.Clean("/"+prefix)] = fs
+}
+
+// Return the FileSystem serving p, which may be nil, and the path within it.
+func (m *Mux) route(p string) (FileSystem, string) {
+	fs, rel, _ := m.mount(p)
+	return fs, rel
+}
+
+// Like route, but also return the mount point, or "" for the Root.
+func (m *Mux) mount(p string) (FileSystem, string, string) {
+	p = path.Clean("/" + p)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for pre := p; ; pre = path.Dir(pre) {
+		if fs := m.mounts[pre]; fs != nil {
+			return fs, "/" + strings.TrimPrefix(strings.TrimPrefix(p, pre), "/"), pre
+		}
+		if pre == "/" {
+			return m.Root, p, ""
+		}
+	}
+}
+
+// Return the names of the entries directly below dir that lead to mount
+// points, in no particular order.
+func (m *Mux) children(dir string) []string {
+	dir = path.Clean("/" + dir)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[string]bool)
+	var names []string
+	for p := range m.mounts {
+		if p == dir || !strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(p, strings.TrimSuffix(dir, "/")+"/"), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Return whether p is a mount point.
+func (m *Mux) mounted(p string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mounts[path.Clean("/"+p)] != nil
+}
+
+// Return the stat of a directory leading to mount points.
+func mountStat(name string) os.FileInfo {
+	return &stat{name: name, mode: os.ModeDir | 0555}
+}
+
+// Stat implements FileSystem.
+func (m *Mux) Stat(p string) (os.FileInfo, error) {
+	fs, rel := m.route(p)
+	err := error(os.ErrNotExist)
+	if fs != nil {
+		var fi os.FileInfo
+		if fi, err = fs.Stat(rel); err == nil {
+			if m.mounted(p) {
+				fi = &namedFileInfo{fi, path.Base(path.Clean("/" + p))}
+			}
+			return fi, nil
+		}
+	}
+	if isNotExist(err) && len(m.children(p)) > 0 {
+		return mountStat(path.Base(path.Clean("/" + p))), nil
+	}
+	return nil, err
+}
+
+// Open implements FileSystem. Directories leading to mount points list them
+// after their own entries, hiding entries of the same name.
+func (m *Mux) Open(p string) (File, error) {
+	fs, rel := m.route(p)
+	var file File
+	err := error(os.ErrNotExist)
+	if fs != nil {
+		file, err = fs.Open(rel)
+	}
+	names := m.children(p)
+	if len(names) == 0 {
+		return file, err
+	}
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+	var extra []os.FileInfo
+	for _, name := range names {
+		fi, err := m.Stat(path.Join("/", p, name))
+		if err != nil {
+			fi = mountStat(name)
+		}
+		extra = append(extra, fi)
+	}
+	if file == nil {
+		return &dirFile{list: extra}, nil
+	}
+	return &virtualDir{File: file, extra: extra}, nil
+}
+
+// Return the FileSystem serving p for a change, the path within it, and its
+// mount point. This fails for mount points and the directories leading to
+// them.
+func (m *Mux) change(p string) (FileSystem, string, string, error) {
+	if m.mounted(p) || len(m.children(p)) > 0 {
+		return nil, "", "", os.ErrPermission
+	}
+	fs, rel, mount := m.mount(p)
+	if fs == nil {
+		return nil, "", "", os.ErrPermission
+	}
+	return fs, rel, mount, nil
+}
+
+// Create implements FileSystem.
+func (m *Mux) Create(p string) (File, error) {
+	return m.CreateAt(p, 0)
+}
+
+// CreateAt implements CreateAter.
+func (m *Mux) CreateAt(p string, off int64) (File, error) {
+	fs, rel, _, err := m.change(p)
+	if err != nil {
+		return nil, err
+	}
+	return CreateAt(fs, rel, off)
+}
+
+// OpenAt implements OpenAter.
+func (m *Mux) OpenAt(p string, off int64) (File, error) {
+	fs, rel := m.route(p)
+	if fs == nil {
+		return nil, os.ErrNotExist
+	}
+	return OpenAt(fs, rel, off)
+}
+
+// Mkdir implements FileSystem.
+func (m *Mux) Mkdir(p string) error {
+	if m.mounted(p) || len(m.children(p)) > 0 {
+		return os.ErrExist
+	}
+	fs, rel, _, err := m.change(p)
+	if err != nil {
+		return err
+	}
+	return fs.Mkdir(rel)
+}
+
+// Remove implements FileSystem.
+func (m *Mux) Remove(p string) error {
+	fs, rel, _, err := m.change(p)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(rel)
+}
+
+// Rename implements FileSystem. Files can't be renamed across mounts.
+func (m *Mux) Rename(old, new string) error {
+	fs, relOld, mount, err := m.change(old)
+	if err != nil {
+		return err
+	}
+	_, relNew, mountNew, err := m.change(new)
+	if err != nil {
+		return err
+	}
+	if mount != mountNew {
+		return errCrossMount
+	}
+	return fs.Rename(relOld, relNew)
+}
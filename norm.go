@@ -0,0 +1,43 @@
+package ftp
+
+import "os"
+
+// A normFS is a FileSystem whose directory listings have their names
+// normalized.
+type normFS struct {
+	wrappedFS
+	norm func(string) string
+}
+
+func (f *normFS) Open(p string) (File, error) {
+	file, err := f.FileSystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &normFile{file, f.norm}, nil
+}
+
+// A normFile is a File whose Readdir normalizes names.
+type normFile struct {
+	File
+	norm func(string) string
+}
+
+// Readdir implements File.
+func (f *normFile) Readdir(n int) ([]os.FileInfo, error) {
+	list, err := f.File.Readdir(n)
+	for i, fi := range list {
+		if name := f.norm(fi.Name()); name != fi.Name() {
+			list[i] = &namedFileInfo{fi, name}
+		}
+	}
+	return list, err
+}
+
+// A namedFileInfo is an os.FileInfo with a different name.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *namedFileInfo) Name() string { return fi.name }
@@ -0,0 +1,123 @@
+package ftp
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// An overlay is a set of read-only files, keyed by cleaned absolute path,
+// added over a FileSystem.
+type overlay interface {
+	has(p string) bool
+	stat(p string) (os.FileInfo, error)
+	open(p string) (File, error)
+	paths() []string
+}
+
+// An overlayFS is a FileSystem with an overlay's files added. The files
+// can't be written, created over, removed or renamed, and are listed
+// after the real entries of their directory.
+type overlayFS struct {
+	wrappedFS
+	files overlay
+}
+
+// Return whether p is an overlay file, and p cleaned.
+func (f *overlayFS) file(p string) (bool, string) {
+	p = path.Clean("/" + p)
+	return f.files.has(p), p
+}
+
+func (f *overlayFS) Stat(p string) (os.FileInfo, error) {
+	if ok, p := f.file(p); ok {
+		return f.files.stat(p)
+	}
+	return f.FileSystem.Stat(p)
+}
+
+func (f *overlayFS) Open(p string) (File, error) {
+	if ok, p := f.file(p); ok {
+		return f.files.open(p)
+	}
+	file, err := f.FileSystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Clean("/" + p)
+	var extra []os.FileInfo
+	for _, op := range f.files.paths() {
+		if path.Dir(op) != dir {
+			continue
+		}
+		if fi, err := f.files.stat(op); err == nil {
+			extra = append(extra, fi)
+		}
+	}
+	if len(extra) == 0 {
+		return file, nil
+	}
+	return &virtualDir{File: file, extra: extra}, nil
+}
+
+// OpenAt isn't supported for overlay files, so callers fall back to
+// seeking.
+func (f *overlayFS) OpenAt(p string, off int64) (File, error) {
+	if ok, _ := f.file(p); ok {
+		return nil, errNotSupported
+	}
+	return f.wrappedFS.OpenAt(p, off)
+}
+
+// OpenStat isn't supported for overlay files, so callers fall back to
+// Stat.
+func (f *overlayFS) OpenStat(p string) (File, os.FileInfo, error) {
+	if ok, _ := f.file(p); ok {
+		return nil, nil, errNotSupported
+	}
+	return f.wrappedFS.OpenStat(p)
+}
+
+func (f *overlayFS) Create(p string) (File, error) {
+	if ok, _ := f.file(p); ok {
+		return nil, os.ErrPermission
+	}
+	return f.FileSystem.Create(p)
+}
+
+func (f *overlayFS) CreateAt(p string, off int64) (File, error) {
+	if ok, _ := f.file(p); ok {
+		return nil, os.ErrPermission
+	}
+	return CreateAt(f.FileSystem, p, off)
+}
+
+func (f *overlayFS) Chtimes(p string, atime, mtime time.Time) error {
+	if ok, _ := f.file(p); ok {
+		return os.ErrPermission
+	}
+	return f.wrappedFS.Chtimes(p, atime, mtime)
+}
+
+func (f *overlayFS) Mkdir(p string) error {
+	if ok, _ := f.file(p); ok {
+		return os.ErrExist
+	}
+	return f.FileSystem.Mkdir(p)
+}
+
+func (f *overlayFS) Remove(p string) error {
+	if ok, _ := f.file(p); ok {
+		return os.ErrPermission
+	}
+	return f.FileSystem.Remove(p)
+}
+
+func (f *overlayFS) Rename(old, new string) error {
+	if ok, _ := f.file(old); ok {
+		return os.ErrPermission
+	} else if ok, _ := f.file(new); ok {
+		return os.ErrPermission
+	}
+	return f.FileSystem.Rename(old, new)
+}
@@ -0,0 +1,102 @@
+package ftp
+
+import (
+	"os"
+	"path"
+)
+
+// A Perm is a set of operations permitted on a path. These correspond to the
+// flags of the MLST "perm" fact defined by RFC 3659 section 7.5.5.
+type Perm uint
+
+const (
+	PermAppend Perm = 1 << iota // a: APPE to a file.
+	PermCreate                  // c: STOR into a directory.
+	PermDelete                  // d: DELE a file or RMD a directory.
+	PermEnter                   // e: CWD into a directory.
+	PermRename                  // f: RNFR a file or directory.
+	PermList                    // l: LIST a directory.
+	PermMkdir                   // m: MKD in a directory.
+	PermPurge                   // p: Delete the contents of a directory.
+	PermRead                    // r: RETR a file.
+	PermWrite                   // w: STOR over a file.
+
+	// PermAll permits everything.
+	PermAll = PermAppend | PermCreate | PermDelete | PermEnter | PermRename |
+		PermList | PermMkdir | PermPurge | PermRead | PermWrite
+)
+
+// String returns the flags of the perm fact.
+func (p Perm) String() string {
+	var b []byte
+	for i, c := range "acdeflmprw" {
+		if p&(1<<uint(i)) != 0 {
+			b = append(b, byte(c))
+		}
+	}
+	return string(b)
+}
+
+// A Permitter is an Authorizer that also controls what each user may do with
+// each path. FileHandler refuses commands that aren't permitted and reports
+// the permissions in the MLST perm fact, so that clients can grey out
+// operations the user can't perform.
+type Permitter interface {
+	Authorizer
+
+	// Permit returns the operations user may perform on path.
+	Permit(user, path string) Perm
+}
+
+// Flags of the perm fact applying to files and directories.
+const (
+	filePerm = PermAppend | PermDelete | PermRename | PermRead | PermWrite
+	dirPerm  = PermCreate | PermDelete | PermEnter | PermRename | PermList |
+		PermMkdir | PermPurge
+
+	// readPerm is permitted to read-only sessions.
+	readPerm = PermEnter | PermList | PermRead
+)
+
+// Return the operations permitted on path, which is described by fi if it
+// exists.
+func (s *fileSession) perm(path string, fi os.FileInfo) Perm {
+	p := PermAll
+	if pm, ok := s.Authorizer.(Permitter); ok {
+		p = pm.Permit(s.User, path)
+	}
+	if _, ro := s.Server.ReadOnly(); ro || s.readOnly {
+		p &= readPerm
+	}
+	if fi == nil {
+		return p
+	} else if fi.IsDir() {
+		return p & dirPerm
+	}
+	return p & filePerm
+}
+
+// Return whether any of the operations in p are permitted on path.
+func (s *fileSession) permit(path string, p Perm) bool {
+	if s.readOnly {
+		if p &= readPerm; p == 0 {
+			return false
+		}
+	}
+	pm, ok := s.Authorizer.(Permitter)
+	return !ok || pm.Permit(s.User, path)&p != 0
+}
+
+// Return whether path may be written with p if it exists, or else created
+// in its directory. A path that can't be stat'ed is taken to exist.
+func (s *fileSession) permitWrite(path string, p Perm) bool {
+	if _, err := s.Stat(path); isNotExist(err) {
+		return s.permit(parentDir(path), PermCreate)
+	}
+	return s.permit(path, p)
+}
+
+// Return the directory containing p.
+func parentDir(p string) string {
+	return path.Dir(p)
+}
@@ -0,0 +1,107 @@
+package ftp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ErrNoPorts is returned by a PortAllocator when no ports are available.
+var ErrNoPorts = errors.New("no passive ports available")
+
+// A PortAllocator chooses ports for passive connections. When several server
+// instances share one address, implementations can coordinate so that each
+// instance only advertises ports that route back to it, for example by
+// partitioning a range or by reserving ports in a shared store.
+type PortAllocator interface {
+	// Allocate returns a port to listen on for s.
+	Allocate(s *Session) (int, error)
+
+	// Release returns a port once its listener has been closed.
+	Release(port int)
+}
+
+// PartitionedPorts is a PortAllocator that splits a range of ports evenly
+// between server instances. Instance i of n uses every nth port of Range
+// starting from Range.Min+i.
+type PartitionedPorts struct {
+	Range     PortRange // Range of ports shared by all instances.
+	Instance  int       // Instance is the index of this instance.
+	Instances int       // Instances is the number of instances, or 1 if 0.
+
+	m    sync.Mutex
+	used map[int]bool
+	next int
+}
+
+// Allocate implements PortAllocator.
+func (p *PartitionedPorts) Allocate(s *Session) (int, error) {
+	n := p.Instances
+	if n <= 0 {
+		n = 1
+	}
+	first := p.Range.Min + p.Instance
+	count := 0
+	if first <= p.Range.Max {
+		count = (p.Range.Max-first)/n + 1
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.used == nil {
+		p.used = make(map[int]bool)
+	}
+	for i := 0; i < count; i++ {
+		port := first + (p.next+i)%count*n
+		if !p.used[port] {
+			p.used[port] = true
+			p.next = (p.next + i + 1) % count
+			return port, nil
+		}
+	}
+	return 0, ErrNoPorts
+}
+
+// Release implements PortAllocator.
+func (p *PartitionedPorts) Release(port int) {
+	p.m.Lock()
+	delete(p.used, port)
+	p.m.Unlock()
+}
+
+// A portListener releases its port to an allocator when closed.
+type portListener struct {
+	net.Listener
+	once    sync.Once
+	release func()
+}
+
+// Close implements net.Listener.
+func (l *portListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(l.release)
+	return err
+}
+
+// Listen on a port chosen by a, retrying a few times if the port is taken.
+func (s *Session) listenAllocated(a PortAllocator, nw, host string) (net.Listener, error) {
+	var err error
+	for i := 0; i < 8; i++ {
+		var port int
+		if port, err = a.Allocate(s); err != nil {
+			return nil, err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		var li net.Listener
+		if li, err = s.Server.listen(nw, addr); err != nil {
+			a.Release(port)
+			continue
+		}
+		return &portListener{
+			Listener: li,
+			release:  func() { a.Release(port) },
+		}, nil
+	}
+	return nil, err
+}
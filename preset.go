@@ -0,0 +1,148 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errProtRequired = errors.New("data connections must be protected")
+
+// A Preset is a bundle of settings applied by Server.Preset, on top of the
+// Server's own.
+type Preset int
+
+const (
+	// PresetNone applies no settings.
+	PresetNone Preset = iota
+
+	// PresetHardened refuses active data connections and thereby bounce
+	// attacks, requires TLS for logins and PROT P for data connections if
+	// TLS is configured, requires TLS 1.2 or later, refuses anonymous
+	// logins, and locks out addresses after 5 failed logins for 15 minutes
+	// unless MaxLoginFailures is set. AllowBounce is ignored. The default
+	// greeting already reveals nothing about the server.
+	PresetHardened
+)
+
+// Whether active data connections are refused.
+func (s *Server) passiveOnly() bool {
+	return s.PassiveOnly || s.Preset == PresetHardened
+}
+
+// Whether TLS data connections are required.
+func (s *Server) requireProt() bool {
+	return (s.RequireProt || s.Preset == PresetHardened) && s.TLS != nil
+}
+
+// Whether logins are refused without TLS.
+func (s *Server) requireTLS() bool {
+	return (s.RequireTLS || s.Preset == PresetHardened) && s.TLS != nil
+}
+
+// Whether anonymous logins are refused.
+func (s *Server) denyAnonymous() bool {
+	return s.DenyAnonymous || s.Preset == PresetHardened
+}
+
+// Whether user names an anonymous login.
+func isAnonymous(user string) bool {
+	user = strings.ToLower(user)
+	return user == "anonymous" || user == "ftp"
+}
+
+// Return the minimum TLS version required.
+func (s *Server) minTLSVersion() uint16 {
+	if s.Preset == PresetHardened {
+		return tls.VersionTLS12
+	}
+	return 0
+}
+
+// Return the number of failed logins after which an address is locked out,
+// or 0 if there is no limit, and for how long.
+func (s *Server) loginLimit() (int, time.Duration) {
+	n, d := s.MaxLoginFailures, s.LockoutDuration
+	if n <= 0 && s.Preset == PresetHardened {
+		n = 5
+	}
+	if d <= 0 {
+		d = 15 * time.Minute
+	}
+	return n, d
+}
+
+// Failed logins by client address.
+type lockouts struct {
+	mu sync.Mutex
+	m  map[string]*lockout
+}
+
+type lockout struct {
+	failures int
+	until    time.Time // When failures are forgotten.
+}
+
+// Return the host of a client address.
+func clientHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Return how long logins from addr remain locked out, or 0 if they aren't.
+func (s *Server) lockedOut(addr net.Addr) time.Duration {
+	n, _ := s.loginLimit()
+	if n <= 0 {
+		return 0
+	}
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	l := s.lockouts.m[clientHost(addr)]
+	if l == nil || l.failures < n {
+		return 0
+	}
+	if d := l.until.Sub(s.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Record a login from addr, which failed unless ok.
+func (s *Server) recordLogin(addr net.Addr, ok bool) {
+	n, d := s.loginLimit()
+	if n <= 0 {
+		return
+	}
+	host := clientHost(addr)
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	if ok {
+		delete(s.lockouts.m, host)
+		return
+	}
+	if s.lockouts.m == nil {
+		s.lockouts.m = make(map[string]*lockout)
+	}
+	now := s.now()
+	for k, l := range s.lockouts.m {
+		if now.After(l.until) {
+			delete(s.lockouts.m, k)
+		}
+	}
+	l := s.lockouts.m[host]
+	if l == nil {
+		l = new(lockout)
+		s.lockouts.m[host] = l
+	}
+	l.failures++
+	l.until = now.Add(d)
+}
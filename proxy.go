@@ -0,0 +1,318 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+)
+
+var errUpstream = errors.New("upstream refused data connection")
+
+// An Upstream is a backend server that a ProxyHandler relays a session to.
+type Upstream struct {
+	Addr     string // Addr of the backend server.
+	User     string // User name to log in to the backend with.
+	Password string // Password to log in to the backend with.
+}
+
+// A ProxyHandler relays sessions to backend FTP servers chosen per user. The
+// control channel is relayed command by command, while data connections are
+// terminated locally and spliced to a passive connection to the backend.
+type ProxyHandler struct {
+	// Route chooses the backend for a login. Returning a nil Upstream
+	// rejects the login. Returning an error closes the session.
+	Route func(user, pass string) (*Upstream, error)
+
+	Dialer Dialer // Dialer for backend connections.
+}
+
+var _ Handler = (*ProxyHandler)(nil)
+
+// Handle implements Handler.
+func (h *ProxyHandler) Handle(s *Session) error {
+	ps := proxySession{
+		ProxyHandler: h,
+		Session:      s,
+		local: fileSession{
+			FileHandler: new(FileHandler),
+			Session:     s,
+			authed:      true,
+		},
+	}
+	defer ps.close()
+	return ps.Handle()
+}
+
+// A proxySession wraps session state for a ProxyHandler.
+type proxySession struct {
+	*ProxyHandler
+	*Session
+
+	local   fileSession     // Handles data channel setup locally.
+	up      *textproto.Conn // Control connection to the backend.
+	upAddr  string          // Address of the backend.
+	restart string          // Pending REST argument.
+}
+
+// Commands that transfer data, and whether they upload.
+var proxyTransfers = map[string]bool{
+	"LIST": false, "NLST": false, "MLSD": false, "RETR": false,
+	"STOR": true, "STOU": true, "APPE": true,
+}
+
+func (s *proxySession) Handle() error {
+	for {
+		c, err := s.Command()
+		if err != nil {
+			return err
+		}
+		if s.up == nil {
+			err = s.handlePreAuth(c)
+		} else {
+			err = s.handlePostAuth(c)
+		}
+		if err != nil {
+			return err
+		}
+		if c.Cmd == "QUIT" {
+			return io.EOF
+		}
+	}
+}
+
+func (s *proxySession) handlePreAuth(c *Command) error {
+	switch c.Cmd {
+	case "USER":
+		if c.Msg == "" {
+			return s.Reply(504, "A user name is required.")
+		}
+		s.User = c.Msg
+		return s.Reply(331, "Please specify the password.")
+	case "PASS":
+		if s.User == "" {
+			return s.Reply(503, "Log in with USER first.")
+		}
+		up, err := s.Route(s.User, c.Msg)
+		if err != nil {
+			return err
+		} else if up == nil {
+			s.User = ""
+			return s.Reply(430, "Invalid user name or password.")
+		}
+		if err := s.connect(up); err != nil {
+			s.logf("upstream %s: %v", up.Addr, err)
+			s.User = ""
+			return s.Reply(530, "Login failed.")
+		}
+		s.Password = c.Msg
+		return s.Reply(230, "Login successful.")
+	case "QUIT":
+		return s.Reply(221, "Goodbye.")
+	default:
+		return s.Reply(530, "Log in with USER and PASS.")
+	}
+}
+
+func (s *proxySession) handlePostAuth(c *Command) error {
+	switch c.Cmd {
+	case "PASV", "EPSV", "PORT", "EPRT":
+		return s.local.handle(c)
+	case "REST":
+		if _, err := strconv.ParseInt(c.Msg, 10, 64); err != nil {
+			return s.Reply(501, "Invalid syntax.")
+		}
+		s.restart = c.Msg
+		return s.ReplyString(350, "Restart position accepted ("+c.Msg+").")
+	case "QUIT":
+		s.exchange(c)
+		return s.Reply(221, "Goodbye.")
+	case "USER", "PASS", "ACCT", "REIN":
+		// Logging in again upstream would bypass Route.
+		return s.Reply(503, "Already logged in.")
+	}
+	restart := s.restart
+	s.restart = ""
+	if upload, ok := proxyTransfers[c.Cmd]; ok {
+		return s.transfer(c, restart, upload)
+	}
+	r, err := s.exchange(c)
+	if err != nil {
+		return err
+	}
+	return s.ReplyString(r.Code, r.Msg)
+}
+
+// Connect and log in to the backend.
+func (s *proxySession) connect(up *Upstream) error {
+	var conn net.Conn
+	var err error
+	if s.Dialer != nil {
+		conn, err = s.Dialer.Dial("tcp", up.Addr)
+	} else {
+		conn, err = net.Dial("tcp", up.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.up = textproto.NewConn(conn)
+	s.upAddr = up.Addr
+	if r, err := s.reply(); err != nil || !r.Success() {
+		return s.fail(err, r)
+	}
+	r, err := s.exchange(&Command{Cmd: "USER", Msg: up.User})
+	if err == nil && r.Intermediate() {
+		r, err = s.exchange(&Command{Cmd: "PASS", Msg: up.Password})
+	}
+	if err != nil || !r.Success() {
+		return s.fail(err, r)
+	}
+	return nil
+}
+
+// Close the backend connection after a failure, returning an error.
+func (s *proxySession) fail(err error, r *Reply) error {
+	s.close()
+	if err == nil {
+		err = errors.New(r.Msg)
+	}
+	return err
+}
+
+// Close the backend connection.
+func (s *proxySession) close() {
+	if s.up != nil {
+		s.up.Close()
+		s.up = nil
+	}
+}
+
+// Send a command to the backend and read the final reply.
+func (s *proxySession) exchange(c *Command) (*Reply, error) {
+	if err := c.Encode(&s.up.Writer); err != nil {
+		return nil, err
+	}
+	for {
+		if r, err := s.reply(); err != nil || !r.Preliminary() {
+			return r, err
+		}
+	}
+}
+
+// Read a reply from the backend.
+func (s *proxySession) reply() (*Reply, error) {
+	r := new(Reply)
+	if err := r.Decode(&s.up.Reader); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Relay a data transfer, splicing the client's data connection with a new
+// passive connection to the backend.
+func (s *proxySession) transfer(c *Command, restart string, upload bool) error {
+	if s.Data == nil {
+		return s.Reply(425, "Use PORT or PASV first.")
+	}
+	data, err := s.dialData()
+	if err != nil {
+		s.CloseData()
+		s.logf("upstream data: %v", err)
+		return s.Reply(425, "Can't open data connection.")
+	}
+	defer data.Close()
+	if restart != "" {
+		r, err := s.exchange(&Command{Cmd: "REST", Msg: restart})
+		if err != nil {
+			s.CloseData()
+			return err
+		} else if !r.Intermediate() {
+			s.CloseData()
+			return s.ReplyString(r.Code, r.Msg)
+		}
+	}
+	if err := c.Encode(&s.up.Writer); err != nil {
+		s.CloseData()
+		return err
+	}
+	r, err := s.reply()
+	if err != nil {
+		s.CloseData()
+		return err
+	}
+	if !r.Preliminary() {
+		s.CloseData()
+		return s.ReplyString(r.Code, r.Msg)
+	}
+	if err := s.ReplyString(r.Code, r.Msg); err != nil {
+		s.CloseData()
+		return err
+	}
+	if upload {
+		_, err = io.Copy(data, s.Data)
+	} else {
+		_, err = io.Copy(s.Data, data)
+	}
+	data.Close()
+	s.CloseData()
+	if err != nil {
+		s.logf("data: %v", err)
+		return s.abort()
+	}
+	for {
+		if r, err = s.reply(); err != nil {
+			return err
+		} else if !r.Preliminary() {
+			return s.ReplyString(r.Code, r.Msg)
+		}
+	}
+}
+
+// Abort the backend's transfer after relaying it failed, and reply 426.
+func (s *proxySession) abort() error {
+	if err := (&Command{Cmd: "ABOR"}).Encode(&s.up.Writer); err != nil {
+		return err
+	}
+	// The backend replies to the transfer, then to ABOR.
+	for n := 0; n < 2; {
+		r, err := s.reply()
+		if err != nil {
+			return err
+		} else if !r.Preliminary() {
+			n++
+		}
+	}
+	return s.Reply(426, "Connection closed; transfer aborted.")
+}
+
+// Open a passive data connection to the backend.
+func (s *proxySession) dialData() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(s.upAddr)
+	if err != nil {
+		return nil, err
+	}
+	var port int
+	if r, err := s.exchange(&Command{Cmd: "EPSV"}); err != nil {
+		return nil, err
+	} else if r.Code == 229 {
+		if port, err = ParseEPSV(r.Msg); err != nil {
+			return nil, err
+		}
+	} else if r, err = s.exchange(&Command{Cmd: "PASV"}); err != nil {
+		return nil, err
+	} else if r.Code == 227 {
+		addr, err := ParsePASV(r.Msg)
+		if err != nil {
+			return nil, err
+		}
+		port = addr.Port
+	} else {
+		return nil, errUpstream
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if s.Dialer != nil {
+		return s.Dialer.Dial("tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
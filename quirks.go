@@ -0,0 +1,72 @@
+package ftp
+
+import "strings"
+
+// A Quirk is a workaround for clients that do not conform to the protocol.
+// Quirks may be combined with bitwise OR.
+type Quirk int
+
+const (
+	// QuirkListFlags strips ls-style flags like "-la" from LIST arguments.
+	QuirkListFlags Quirk = 1 << iota
+
+	// QuirkDottedPORT accepts PORT addresses written with dots, as in
+	// "127.0.0.1,4,1" or "127.0.0.1.4.1".
+	QuirkDottedPORT
+
+	// QuirkNoSpace accepts commands missing the space between the command
+	// name and its argument, as in "CWDfoo".
+	QuirkNoSpace
+
+	// QuirkCodeLines repeats the reply code at the start of every line of a
+	// multi-line reply, as in "211-MDTM", for clients that cannot parse the
+	// indented continuation lines used by default.
+	QuirkCodeLines
+)
+
+// DefaultQuirks are the quirks enabled for all clients if Server.Quirks is 0.
+var DefaultQuirks = QuirkListFlags
+
+// A Compat enables quirks for clients matching certain criteria. A client
+// matches if every non-empty criterion matches.
+type Compat struct {
+	Client string // Client matches a substring of the CLNT name, ignoring case.
+	User   string // User matches the user name exactly.
+	Quirks Quirk  // Quirks to enable for matching clients.
+}
+
+// Whether s matches c.
+func (c *Compat) match(s *Session) bool {
+	if c.Client == "" && c.User == "" {
+		return false
+	}
+	if c.Client != "" {
+		client := strings.ToLower(s.Client)
+		if client == "" || !strings.Contains(client, strings.ToLower(c.Client)) {
+			return false
+		}
+	}
+	if c.User != "" && c.User != s.User {
+		return false
+	}
+	return true
+}
+
+// Recompute the quirks enabled for s. This is called when the client
+// identifies itself with CLNT or USER.
+func (s *Session) updateQuirks() {
+	if s.Server.Strict {
+		s.Quirks = 0
+		return
+	}
+	q := s.Server.Quirks
+	if q == 0 {
+		q = DefaultQuirks
+	}
+	for i := range s.Server.Compat {
+		if c := &s.Server.Compat[i]; c.match(s) {
+			q |= c.Quirks
+		}
+	}
+	s.Quirks = q
+}
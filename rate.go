@@ -0,0 +1,242 @@
+package ftp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A limiter is a token bucket limiting bandwidth shared by connections. Its
+// rate is updated every second while connections use it.
+type limiter struct {
+	update func() int64 // Return the current rate.
+
+	mu      sync.Mutex
+	rate    int64   // Bytes per second, or unlimited if not positive.
+	tokens  float64 // Bytes that may be transferred without waiting.
+	last    time.Time
+	updated time.Time
+	active  map[int]time.Time // Last use by each priority.
+}
+
+// Return how many tokens each byte costs a connection of priority prio, and
+// record its use. While connections of higher priority are active, each level
+// of difference makes bytes cost four times as much, so that they get most of
+// the bandwidth. This must be called with l.mu held.
+func (l *limiter) cost(prio int, now time.Time) float64 {
+	if l.active == nil {
+		l.active = make(map[int]time.Time)
+	}
+	l.active[prio] = now
+	top := prio
+	for p, t := range l.active {
+		if now.Sub(t) >= time.Second {
+			delete(l.active, p)
+		} else if p > top {
+			top = p
+		}
+	}
+	d := top - prio
+	if d > 8 {
+		d = 8
+	}
+	return float64(uint(1) << (2 * uint(d)))
+}
+
+// Update the rate if it hasn't been recently. This must be called with l.mu
+// held.
+func (l *limiter) refresh(now time.Time) {
+	if now.Sub(l.updated) < time.Second {
+		return
+	}
+	l.updated = now
+	if rate := l.update(); rate != l.rate {
+		l.rate, l.tokens = rate, 0
+	}
+}
+
+// Return how much of n bytes to transfer at once, which is at most a tenth of
+// a second worth of bandwidth.
+func (l *limiter) chunk(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refresh(time.Now())
+	if l.rate <= 0 {
+		return n
+	}
+	if max := int(l.rate / 10); max <= 0 {
+		return 1
+	} else if n > max {
+		return max
+	}
+	return n
+}
+
+// Wait until n bytes may be transferred by a connection of priority prio, and
+// take them from the bucket.
+func (l *limiter) wait(n, prio int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.refresh(now)
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	if burst := float64(l.rate) / 10; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n) * l.cost(prio, now)
+	d := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// A limitedConn is a net.Conn whose reads and writes are limited.
+type limitedConn struct {
+	net.Conn
+	l    *limiter
+	prio int // Transfer priority, from the session's Account.
+}
+
+// Read implements net.Conn.
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:c.l.chunk(len(b))])
+	c.l.wait(n, c.prio)
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *limitedConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 && err == nil {
+		var nn int
+		m := c.l.chunk(len(b))
+		c.l.wait(m, c.prio)
+		nn, err = c.Conn.Write(b[:m])
+		n += nn
+		b = b[nn:]
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// A BandwidthWindow sets a bandwidth limit for a time of day.
+type BandwidthWindow struct {
+	// Start and End are times of day, as durations since midnight in the
+	// location of the server's clock. If End is before Start, the window
+	// spans midnight.
+	Start, End time.Duration
+
+	Class string // Class limited, or "" for the limit on all sessions.
+	Rate  int64  // Bytes per second, or unlimited if not positive.
+}
+
+// Return whether the window contains the time of day d.
+func (w *BandwidthWindow) contains(d time.Duration) bool {
+	if w.End < w.Start {
+		return d >= w.Start || d < w.End
+	}
+	return d >= w.Start && d < w.End
+}
+
+// SetRate overrides the rate of a bandwidth class, or of all sessions if class
+// is "", taking precedence over Classes and Schedule. A rate of 0 removes the
+// limit, and a negative rate removes the override. Transfers in progress
+// change rate within a second.
+func (s *Server) SetRate(class string, rate int64) {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	if rate < 0 {
+		delete(s.rates, class)
+		return
+	}
+	if s.rates == nil {
+		s.rates = make(map[string]int64)
+	}
+	s.rates[class] = rate
+}
+
+// Return the rate override of a bandwidth class, if any.
+func (s *Server) rateOverride(class string) (int64, bool) {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	rate, ok := s.rates[class]
+	return rate, ok
+}
+
+// Return the names of the bandwidth classes configured or set, sorted.
+func (s *Server) rateClasses() []string {
+	seen := make(map[string]bool)
+	for class := range s.Classes {
+		seen[class] = true
+	}
+	for _, w := range s.Schedule {
+		seen[w.Class] = true
+	}
+	s.limitersMu.Lock()
+	for class := range s.rates {
+		seen[class] = true
+	}
+	s.limitersMu.Unlock()
+	var classes []string
+	for class := range seen {
+		if class != "" {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// Return the current rate for a bandwidth class, or for all sessions if class
+// is "". A matching window of the schedule takes precedence over Classes.
+func (s *Server) classRate(class string) int64 {
+	if rate, ok := s.rateOverride(class); ok {
+		return rate
+	}
+	now := s.now()
+	y, m, d := now.Date()
+	tod := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	for i := range s.Schedule {
+		if w := &s.Schedule[i]; w.Class == class && w.contains(tod) {
+			return w.Rate
+		}
+	}
+	if class == "" {
+		return 0
+	}
+	return s.Classes[class]
+}
+
+// Return the limiter for a bandwidth class, or for all sessions if class is
+// "". This returns nil if the class is never limited.
+func (s *Server) classLimiter(class string) *limiter {
+	limited := class != "" && s.Classes[class] > 0
+	for _, w := range s.Schedule {
+		limited = limited || w.Class == class
+	}
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	if _, ok := s.rates[class]; !limited && !ok {
+		return nil
+	}
+	if s.limiters == nil {
+		s.limiters = make(map[string]*limiter)
+	}
+	l := s.limiters[class]
+	if l == nil {
+		l = &limiter{update: func() int64 { return s.classRate(class) }}
+		s.limiters[class] = l
+	}
+	return l
+}
@@ -0,0 +1,205 @@
+package ftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A RedactMode says how a kind of personal data is redacted.
+type RedactMode int
+
+const (
+	// RedactNone leaves values as they are.
+	RedactNone RedactMode = iota
+
+	// RedactHash replaces values with a short salted hash, so that records
+	// about the same user, address, or file can still be correlated.
+	RedactHash
+
+	// RedactTruncate keeps part of a value: the network of an address (/24
+	// for IPv4, /48 for IPv6), the directory of a path, and the first letter
+	// of a user name.
+	RedactTruncate
+
+	// RedactRemove replaces values entirely.
+	RedactRemove
+)
+
+// Redaction is a policy for redacting personal data from debug output, logs,
+// and audit records.
+type Redaction struct {
+	Users RedactMode // User names.
+	Addrs RedactMode // Client addresses.
+	Paths RedactMode // File and directory names.
+
+	// Salt is mixed into hashes, so that they can't be reversed by hashing
+	// likely values.
+	Salt string
+}
+
+const redacted = "[redacted]"
+
+// Return a salted hash of v.
+func (r *Redaction) hash(v string) string {
+	sum := sha256.Sum256([]byte(r.Salt + v))
+	return "h:" + hex.EncodeToString(sum[:6])
+}
+
+// Redact a user name.
+func (r *Redaction) user(u string) string {
+	switch {
+	case u == "":
+		return u
+	case r.Users == RedactHash:
+		return r.hash(u)
+	case r.Users == RedactTruncate:
+		_, n := utf8.DecodeRuneInString(u)
+		return u[:n] + "*"
+	case r.Users == RedactRemove:
+		return redacted
+	}
+	return u
+}
+
+// Redact a path.
+func (r *Redaction) path(p string) string {
+	switch {
+	case p == "":
+		return p
+	case r.Paths == RedactHash:
+		return r.hash(p)
+	case r.Paths == RedactTruncate:
+		return path.Join(path.Dir(p), "*")
+	case r.Paths == RedactRemove:
+		return redacted
+	}
+	return p
+}
+
+// Redact a host, which may include a port.
+func (r *Redaction) host(h string) string {
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		h = host
+	}
+	switch r.Addrs {
+	case RedactHash:
+		return r.hash(h)
+	case RedactTruncate:
+		ip := net.ParseIP(h)
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		} else if ip != nil {
+			return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+		}
+		return redacted
+	case RedactRemove:
+		return redacted
+	}
+	return h
+}
+
+// Return the client's address as it may be logged.
+func (s *Session) logAddr() string {
+	if s.Addr == nil {
+		return ""
+	}
+	if s.Server.Redact.Addrs == RedactNone {
+		return s.Addr.String()
+	}
+	return s.Server.Redact.host(s.Addr.String())
+}
+
+// Return the argument of c as it may be logged.
+func (s *Session) logArg(c *Command) string {
+	r := &s.Server.Redact
+	switch {
+	case c.Cmd == "PASS":
+		return "***"
+	case c.Cmd == "USER":
+		return r.user(c.Msg)
+	case pathCommands[c.Cmd] && r.Paths != RedactNone:
+		// The path is redacted without any LIST options before it.
+		if p := stripListFlags(c.Msg); p != "" {
+			return r.path(p)
+		}
+	}
+	return c.Msg
+}
+
+// Return the absolute path given as the argument of c, if any, for logs.
+func (s *Session) logPath(c *Command) string {
+	if !pathCommands[c.Cmd] {
+		return ""
+	}
+	p := stripListFlags(c.Msg)
+	if p == "" {
+		return ""
+	}
+	return s.Server.Redact.path(s.Path(p))
+}
+
+// Redact the session's user name, client address, and any paths of errors in
+// args, returning the formatted message.
+func (s *Session) redactf(format string, args ...interface{}) string {
+	r := &s.Server.Redact
+	if r.Users == RedactNone && r.Addrs == RedactNone && r.Paths == RedactNone {
+		return fmt.Sprintf(format, args...)
+	}
+	if r.Paths != RedactNone {
+		args = append([]interface{}(nil), args...)
+		for i, a := range args {
+			switch err := a.(type) {
+			case *os.PathError:
+				args[i] = &os.PathError{Op: err.Op, Path: r.path(err.Path), Err: err.Err}
+			case *os.LinkError:
+				args[i] = &os.LinkError{Op: err.Op, Old: r.path(err.Old), New: r.path(err.New), Err: err.Err}
+			}
+		}
+	}
+	msg := fmt.Sprintf(format, args...)
+	if r.Users != RedactNone && s.User != "" {
+		msg = replaceWord(msg, s.User, r.user(s.User))
+	}
+	if r.Addrs != RedactNone && s.Addr != nil {
+		if host, _, err := net.SplitHostPort(s.Addr.String()); err == nil {
+			msg = replaceWord(msg, host, r.host(host))
+		}
+	}
+	return msg
+}
+
+// Replace the occurrences of word in s that aren't part of a longer word or
+// number, so that a short user name such as "a" doesn't match inside others.
+func replaceWord(s, word, repl string) string {
+	var b bytes.Buffer
+	for {
+		i := strings.Index(s, word)
+		if i < 0 {
+			break
+		}
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[i+len(word):])
+		b.WriteString(s[:i])
+		if isWordRune(before) || isWordRune(after) {
+			b.WriteString(word)
+		} else {
+			b.WriteString(repl)
+		}
+		s = s[i+len(word):]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// Whether r can be part of a word or number.
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
@@ -0,0 +1,80 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Errors returned by CheckRestart.
+var (
+	ErrRestartRange = errors.New("restart offset beyond end of file")
+	ErrRestartASCII = errors.New("restart offsets are not supported in ASCII mode")
+)
+
+// Returned when an upload sends data beyond the byte range set by RANG.
+var errRangeExceeded = errors.New("data beyond byte range")
+
+// ParseRestart parses the argument of REST, a byte offset.
+func ParseRestart(msg string) (int64, error) {
+	n, err := strconv.ParseInt(msg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid restart offset")
+	}
+	return n, nil
+}
+
+// CheckRestart returns whether a transfer of a file of the given size may
+// restart at off with the given representation type. Offsets count bytes as
+// stored, which don't match what is sent in ASCII mode, where line endings
+// are translated, so nonzero offsets are refused there. An offset equal to
+// the size is allowed and transfers nothing.
+func CheckRestart(off, size int64, typ string) error {
+	if off == 0 {
+		return nil
+	}
+	if typ == "A" {
+		return ErrRestartASCII
+	}
+	if off > size {
+		return ErrRestartRange
+	}
+	return nil
+}
+
+// Seek f to the restart offset off. Backends differ near the end of a file:
+// some return io.EOF when seeking exactly to it, which is taken as success,
+// and some clamp offsets beyond it, which fails with ErrRestartRange rather
+// than transferring from the wrong offset.
+func seekTo(f File, off int64) error {
+	n, err := f.Seek(off, io.SeekStart)
+	if err == io.EOF && n == off {
+		return nil
+	} else if err == nil && n != off {
+		return ErrRestartRange
+	}
+	return err
+}
+
+// A rangeWriter writes up to n bytes, the rest of a byte range set by RANG,
+// failing with errRangeExceeded after writing any that fit.
+type rangeWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (w *rangeWriter) Write(b []byte) (int, error) {
+	over := int64(len(b)) > w.n
+	if over && w.n <= 0 {
+		return 0, errRangeExceeded
+	} else if over {
+		b = b[:w.n]
+	}
+	n, err := w.w.Write(b)
+	w.n -= int64(n)
+	if err == nil && over {
+		err = errRangeExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,100 @@
+package ftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// A resumeStore holds the state of ended sessions that were given resume
+// tokens, keyed by token.
+type resumeStore struct {
+	mu sync.Mutex
+	m  map[string]resumeState
+}
+
+// The state restored by SITE RESUME.
+type resumeState struct {
+	user     string
+	dir      string
+	restart  int64
+	renaming string
+	expires  time.Time
+}
+
+// Store the state of an ended session under token.
+func (r *resumeStore) put(token string, st resumeState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = make(map[string]resumeState)
+	}
+	now := time.Now()
+	for k, e := range r.m {
+		if now.After(e.expires) {
+			delete(r.m, k)
+		}
+	}
+	r.m[token] = st
+}
+
+// Remove and return the state stored under token for user, if it is fresh.
+func (r *resumeStore) take(token, user string) (resumeState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.m[token]
+	if !ok || st.user != user {
+		return resumeState{}, false
+	}
+	delete(r.m, token)
+	return st, time.Now().Before(st.expires)
+}
+
+// Generate a random resume token.
+func newResumeToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Whether SITE RESUME is enabled.
+func hasResume(s *fileSession) bool {
+	return s.ResumeTTL > 0
+}
+
+// Handler for SITE RESUME. Without an argument, this gives the session a
+// token under which its state is kept when it ends. With a token, this
+// restores the state of the session it was given to.
+func (s *fileSession) handleRESUME(c *Command) error {
+	if c.Msg == "" {
+		if s.resumeToken == "" {
+			s.resumeToken = newResumeToken()
+		}
+		return s.ReplyString(200, "Resume token: "+s.resumeToken)
+	}
+	st, ok := s.resumes.take(c.Msg, s.User)
+	if !ok {
+		return s.Reply(550, "Unknown or expired resume token.")
+	}
+	s.SetDir(st.dir)
+	s.restart, s.renaming = st.restart, st.renaming
+	s.resumed = true
+	return s.Reply(200, "Session resumed.")
+}
+
+// Keep the state of a session given a resume token for ResumeTTL.
+func (s *fileSession) saveResume() {
+	if s.resumeToken == "" {
+		return
+	}
+	s.resumes.put(s.resumeToken, resumeState{
+		user:     s.User,
+		dir:      s.Dir,
+		restart:  s.restart,
+		renaming: s.renaming,
+		expires:  time.Now().Add(s.ResumeTTL),
+	})
+}
@@ -0,0 +1,45 @@
+package ftp
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetryHint returns a hint for clients to retry after d, such as "try again
+// in 30 seconds", or "try again later" if d is not positive. Handlers can
+// append it to transient failure replies, as in "451 File system
+// unavailable; try again in 30 seconds.", so that automation backs off for
+// as long as needed.
+func RetryHint(d time.Duration) string {
+	if d <= 0 {
+		return "try again later"
+	}
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs == 1 {
+		return "try again in 1 second"
+	}
+	return fmt.Sprintf("try again in %d seconds", secs)
+}
+
+// RetryAfter returns how long until the breaker lets a trial call through,
+// or 0 if it isn't open.
+func (b *Breaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return 0
+	}
+	if d := time.Until(b.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Reply to a command failing because the file system is unavailable, with a
+// hint of when to retry if the breaker is open.
+func (s *fileSession) replyUnavailable() error {
+	return s.replyErr(451, errBreakerOpen, "File system unavailable; %s.", RetryHint(s.Breaker.RetryAfter()))
+}
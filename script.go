@@ -0,0 +1,129 @@
+package ftp
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// A ScriptRule is a scripted response to matching commands.
+type ScriptRule struct {
+	Cmd string // Cmd matches the command name, or any command if empty.
+	Arg string // Arg matches the argument exactly, if non-empty.
+
+	Code  int           // Code of the reply.
+	Msg   string        // Msg of the reply.
+	Delay time.Duration // Delay before replying.
+
+	// Raw is written verbatim instead of a reply if non-empty, allowing
+	// malformed replies to be simulated. Lines should end with CRLF.
+	Raw string
+
+	// Data is sent over the data connection before replying if non-nil.
+	// A 150 reply is sent first, and a 425 is sent instead if there is no
+	// data connection. This can be used for canned listings and files.
+	Data []byte
+
+	// Close closes the connection after replying.
+	Close bool
+}
+
+// Whether r matches c.
+func (r *ScriptRule) match(c *Command) bool {
+	return (r.Cmd == "" || strings.EqualFold(r.Cmd, c.Cmd)) &&
+		(r.Arg == "" || r.Arg == c.Msg)
+}
+
+// A ScriptHandler replies to commands according to a script, for testing FTP
+// clients against unusual servers. The first matching rule is used for each
+// command. Unmatched logins, data connection setup, TYPE, and MODE are
+// handled normally, and other unmatched commands get a 502.
+type ScriptHandler struct {
+	Greeting string       // Greeting sent instead of DefaultGreeting.
+	Rules    []ScriptRule // Rules in order of precedence.
+}
+
+var _ Handler = (*ScriptHandler)(nil)
+
+// Handle implements Handler.
+func (h *ScriptHandler) Handle(s *Session) error {
+	local := fileSession{
+		FileHandler: new(FileHandler),
+		Session:     s,
+		authed:      true,
+	}
+	if h.Greeting != "" {
+		if err := s.ReplyString(220, h.Greeting); err != nil {
+			return err
+		}
+	}
+	for {
+		c, err := s.Command()
+		if err != nil {
+			return err
+		}
+		if r := h.match(c); r != nil {
+			err = h.reply(s, r)
+			if err == nil && r.Close {
+				err = io.EOF
+			}
+		} else {
+			err = h.fallback(&local, c)
+		}
+		if err != nil {
+			return err
+		}
+		if c.Cmd == "QUIT" {
+			return io.EOF
+		}
+	}
+}
+
+// Return the first rule matching c, or nil.
+func (h *ScriptHandler) match(c *Command) *ScriptRule {
+	for i := range h.Rules {
+		if r := &h.Rules[i]; r.match(c) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Reply according to r.
+func (h *ScriptHandler) reply(s *Session, r *ScriptRule) error {
+	time.Sleep(r.Delay)
+	if r.Data != nil {
+		if s.Data == nil {
+			return s.Reply(425, "Use PORT or PASV first.")
+		}
+		if err := s.Reply(150, "Here comes the data."); err != nil {
+			return err
+		}
+		if _, err := s.Data.Write(r.Data); err != nil {
+			s.CloseData()
+			return s.Reply(426, "Transfer aborted.")
+		}
+		s.CloseData()
+	}
+	if r.Raw != "" {
+		return s.raw(r.Raw)
+	}
+	return s.ReplyString(r.Code, r.Msg)
+}
+
+// Handle an unmatched command.
+func (h *ScriptHandler) fallback(s *fileSession, c *Command) error {
+	switch c.Cmd {
+	case "USER":
+		s.User = c.Msg
+		return s.Reply(331, "Please specify the password.")
+	case "PASS":
+		s.Password = c.Msg
+		return s.Reply(230, "Login successful.")
+	case "QUIT":
+		return s.Reply(221, "Goodbye.")
+	case "PASV", "EPSV", "PORT", "EPRT", "TYPE", "MODE", "NOOP":
+		return s.handle(c)
+	}
+	return s.Reply(502, "Not implemented.")
+}
@@ -1,9 +1,18 @@
 package ftp
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/textproto"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
 )
 
 // DefaultGreeting is the default greeting for new connections.
@@ -22,14 +31,262 @@ type Listener interface {
 	Listen(net, addr string) (net.Listener, error)
 }
 
+// A PortRange is an inclusive range of ports. The zero value allows any port.
+type PortRange struct {
+	Min, Max int
+}
+
 // A Server serves incoming connections.
 type Server struct {
 	Addr     string      // Addr to bind the control channel to.
-	TLS      *tls.Config // TLS config enables FTPS if non-nil.
+	TLS      *tls.Config // TLS config enables implicit FTPS if non-nil.
 	Dialer   Dialer      // Dialer for active connections.
 	Listener Listener    // Listener for passive connections.
 	Handler  Handler     // Handler for commands.
 	Debug    bool        // Debug prints control channel traffic.
+
+	// ExplicitTLS serves FTPS by AUTH TLS (RFC 4217) rather than implicit
+	// TLS, so that clients connect without TLS and upgrade the control
+	// connection by command. The default port is then that of FTP.
+	ExplicitTLS bool
+
+	// AllowCCC allows clients to revert the control connection to
+	// plaintext with CCC after AUTH TLS, keeping data connections
+	// protected. This exposes commands, though not passwords sent before,
+	// and is only for clients behind NAT devices that must read them.
+	AllowCCC bool
+
+	// WrapControl, if set, wraps each control connection before it is
+	// served, above any TLS layer. After AUTH TLS, it wraps the new TLS
+	// connection, so that it always sees plaintext. This allows connection
+	// metrics or custom framing in test rigs.
+	WrapControl func(c net.Conn) net.Conn
+
+	// KeyLogWriter, if set, receives TLS master secrets of control and data
+	// connections in NSS key log format, so that captures can be decrypted
+	// with Wireshark. This compromises security and is only for debugging.
+	KeyLogWriter io.Writer
+
+	// HandshakeError, if set, is called when the TLS handshake of a control
+	// or data connection fails, with the ClientHello if the handshake got
+	// that far. This helps diagnose clients that can't connect over FTPS.
+	HandshakeError func(hello *tls.ClientHelloInfo, err error)
+
+	// ClientHello, if set, is called with the TLS ClientHello of every
+	// control and data connection, for example to reject known-bad
+	// automation tools by their cipher suites or ALPN protocols. Returning
+	// an error aborts the handshake. Handlers can inspect the ClientHello of
+	// the control connection with Session.ClientHello.
+	ClientHello func(hello *tls.ClientHelloInfo) error
+
+	// DataCertBinding requires TLS data connections to present the client
+	// certificate of the control connection, or one naming the logged in
+	// user as a DNS name, email address, or URI in its subject alternative
+	// names. Others fail the transfer. A client certificate is requested
+	// for data connections even if TLS.ClientAuth doesn't.
+	DataCertBinding bool
+
+	// PublicIP is advertised in PASV replies if non-nil. This is needed when
+	// the server is behind NAT. PASV over an IPv6 control connection is
+	// refused with a 425 suggesting EPSV unless this is an IPv4 address.
+	PublicIP net.IP
+
+	// PassivePorts restricts the ports used for passive connections.
+	PassivePorts PortRange
+
+	// PassiveAddr chooses the address advertised and the ports used for a
+	// session's passive connections. This allows the choice to depend on
+	// which interface the control connection arrived on. If nil, PublicIP
+	// and PassivePorts are used.
+	PassiveAddr func(*Session) (net.IP, PortRange)
+
+	// PortAllocator chooses passive ports if non-nil, taking precedence over
+	// PassivePorts and the range returned by PassiveAddr.
+	PortAllocator PortAllocator
+
+	// DataNetwork restricts data connections to "tcp4" or "tcp6" if set.
+	// Otherwise, active connections use the network of the client's address
+	// and passive connections use the network the client requested.
+	DataNetwork string
+
+	// DualStack makes passive listeners for EPSV without a network argument
+	// bind all interfaces, accepting both IPv4 and IPv6 connections. By
+	// default, they bind the address the control connection arrived on.
+	DualStack bool
+
+	// ActiveBlocklist are networks that active connections may not target.
+	// Active connections to ports below 1024 are also refused, so that the
+	// server can't be used in bounce attacks (RFC 2577). AllowBounce
+	// disables these checks for trusted deployments.
+	ActiveBlocklist []*net.IPNet
+	AllowBounce     bool
+
+	// PassiveOnly refuses active data connections; PORT and EPRT are not
+	// available.
+	PassiveOnly bool
+
+	// RequireProt refuses data connections without TLS when TLS is
+	// configured, so that clients must send PROT P first.
+	RequireProt bool
+
+	// RequireTLS refuses USER and PASS with 530 until the control
+	// connection is protected, by AUTH TLS or implicit TLS, when TLS is
+	// configured, so that passwords are never sent in the clear.
+	RequireTLS bool
+
+	// ActivePolicy, if set, is consulted before every active connection,
+	// after the checks above, so that embedders can apply their own egress
+	// policy. Returning an error refuses the connection.
+	ActivePolicy func(addr net.Addr) error
+
+	// PassiveReply, if set, returns the text following the code of 227 and
+	// 229 replies, for clients that need a particular format. The address is
+	// as returned by Session.PassiveAddr. If it returns "", the default text
+	// is used.
+	PassiveReply func(s *Session, code int, addr *net.TCPAddr) string
+
+	// WrapData, if set, wraps each data connection before transfers begin,
+	// above any TLS layer. This allows custom accounting, compression, or
+	// filtering of data in both directions.
+	WrapData func(s *Session, c net.Conn) net.Conn
+
+	// DataLinger, if positive, sets SO_LINGER on data connections, so that
+	// closing one waits up to this long for unsent data to be delivered.
+	DataLinger time.Duration
+
+	// Shaper simulates a slow network on data connections if non-nil. This
+	// is meant for test servers and is separate from any rate limits.
+	Shaper *Shaper
+
+	// Clock returns the current time, or time.Now is used if nil.
+	Clock func() time.Time
+
+	// Deterministic makes output stable for golden tests: listings are
+	// sorted by name and times are formatted in UTC. Combine this with
+	// Clock and a PartitionedPorts allocator, which hands out ports in a
+	// fixed sequence, for fully reproducible sessions.
+	Deterministic bool
+
+	// MaxSessions limits the number of concurrent sessions if positive.
+	// Connections over the limit wait up to QueueTimeout for a session to
+	// end, and are then closed with a 421 reply.
+	MaxSessions  int
+	QueueTimeout time.Duration
+
+	// Classes maps bandwidth class names to rates in bytes per second. The
+	// class of a session is set by its Account. All data connections of
+	// sessions in a class share its bandwidth.
+	Classes map[string]int64
+
+	// Schedule varies bandwidth limits by time of day. Changes apply to
+	// transfers in progress within a second.
+	Schedule []BandwidthWindow
+
+	// MaxSessionMemory limits the estimated memory each session may hold
+	// for directory listings if positive. Commands exceeding it fail with a
+	// 451 reply.
+	MaxSessionMemory int64
+
+	// ErrorHandler is called when a Handler returns an error other than
+	// io.EOF, or panics, in which case the error is a *PanicError. If nil,
+	// panics are logged and other errors are ignored.
+	ErrorHandler func(*Session, error)
+
+	// Auditor, if set, receives a record of every command.
+	Auditor Auditor
+
+	// Redact is applied to user names, client addresses, and paths in debug
+	// output, logs, and audit records.
+	Redact Redaction
+
+	// Access, if set, decides whether clients may connect and log in by
+	// their address. See CountryPolicy.
+	Access AccessPolicy
+
+	// Tarpit, if set, returns how long to delay the greeting and the replies
+	// to USER and PASS for a client address, slowing down mass scanners and
+	// password guessing from addresses deemed suspicious at little cost to
+	// others. See TarpitNets.
+	Tarpit func(addr net.Addr) time.Duration
+
+	// StallTimeout, if positive, aborts transfers moving no data for this
+	// long, so that a stuck client or backend doesn't hold a session.
+	StallTimeout time.Duration
+
+	// ProfileLabels labels session goroutines with the session ID, user,
+	// and current command for runtime/pprof, so that CPU and goroutine
+	// profiles can be broken down by them. Users are redacted.
+	ProfileLabels bool
+
+	// ReasonCodes appends a token naming the cause to the failure replies
+	// of FileHandler, as in "550 No such file. [ENOENT]", so that
+	// integrations can branch on causes without parsing the text.
+	ReasonCodes bool
+
+	// Catalog localizes reply messages for clients that select a language
+	// with LANG, and lists the languages in FEAT.
+	Catalog Catalog
+
+	// ErrorLog logs errors. If nil, errors are logged with the log package.
+	ErrorLog *log.Logger
+
+	// Quirks are enabled for all clients. If 0, DefaultQuirks is used.
+	Quirks Quirk
+
+	// Strict disables all quirks and enforces exact RFC 959, 2428, and 3659
+	// command syntax and reply codes. This is useful for conformance testing.
+	Strict bool
+
+	// Compat enables additional quirks for clients matching each entry.
+	Compat []Compat
+
+	// DenyAnonymous refuses the user names "anonymous" and "ftp".
+	DenyAnonymous bool
+
+	// MaxLoginFailures, if positive, locks out a client address after this
+	// many failed logins, until none have failed for LockoutDuration, or 15
+	// minutes if 0. Logins while locked out are refused with 421.
+	MaxLoginFailures int
+	LockoutDuration  time.Duration
+
+	// Preset applies a bundle of settings, such as PresetHardened.
+	Preset Preset
+
+	slots     chan struct{} // Session slots, if MaxSessions is positive.
+	slotsOnce sync.Once
+
+	limiters   map[string]*limiter // Limiters by bandwidth class.
+	rates      map[string]int64    // Rates set with SetRate, by class.
+	limitersMu sync.Mutex
+
+	sessions   map[string]*sessionInfo // Sessions in progress, by ID.
+	sessionsMu sync.Mutex
+
+	tlsConf *tls.Config // TLS with KeyLogWriter applied.
+	tlsOnce sync.Once
+
+	lockouts lockouts
+
+	maint    *Maintenance // Maintenance mode, if in one.
+	readOnly string       // Message refusing changes while read-only, or "".
+	maintMu  sync.Mutex
+}
+
+// Log an error through the server's logger.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Return the current time according to the server's clock.
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
 }
 
 // Listen through the server's listener.
@@ -40,6 +297,30 @@ func (s *Server) listen(nw, addr string) (net.Listener, error) {
 	return net.Listen(nw, addr)
 }
 
+// Return the advertised address and port range for passive connections.
+func (s *Server) passiveAddr(ss *Session) (net.IP, PortRange) {
+	if s.PassiveAddr != nil {
+		return s.PassiveAddr(ss)
+	}
+	return s.PublicIP, s.PassivePorts
+}
+
+// Whether active connections may target addr.
+func (s *Server) allowTarget(addr *net.TCPAddr) bool {
+	if s.AllowBounce && s.Preset != PresetHardened {
+		return true
+	}
+	if addr.Port < 1024 {
+		return false
+	}
+	for _, n := range s.ActiveBlocklist {
+		if n.Contains(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
 // Dial through the server's dialer.
 func (s *Server) dial(nw, addr string) (net.Conn, error) {
 	if s.Dialer != nil {
@@ -54,7 +335,7 @@ func (s *Server) dial(nw, addr string) (net.Conn, error) {
 func (s *Server) ListenAndServe(fork bool) (net.Listener, error) {
 	a := s.Addr
 	if a == "" {
-		if s.TLS == nil {
+		if s.TLS == nil || s.ExplicitTLS {
 			a = ":ftp"
 		} else {
 			a = ":ftps"
@@ -73,30 +354,258 @@ func (s *Server) ListenAndServe(fork bool) (net.Listener, error) {
 
 // Serve incoming connections over l.
 func (s *Server) Serve(l net.Listener) error {
-	if s.TLS != nil {
-		l = tls.NewListener(l, s.TLS)
+	if s.TLS != nil && !s.ExplicitTLS {
+		l = s.tlsListener(l, s.tlsConfig())
 	}
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			return err
 		}
-		go s.ServeFTP(c)
+		if s.MaxSessions <= 0 {
+			go s.ServeFTP(c)
+		} else if s.QueueTimeout <= 0 && !s.acquire(0) {
+			go s.reject(c)
+		} else {
+			go s.serveLimited(c)
+		}
+	}
+}
+
+// Serve c once a session slot is available, or reject it after waiting for
+// the queue timeout.
+func (s *Server) serveLimited(c net.Conn) {
+	if s.QueueTimeout > 0 && !s.acquire(s.QueueTimeout) {
+		s.reject(c)
+		return
+	}
+	defer s.release()
+	s.ServeFTP(c)
+}
+
+// Acquire a session slot, waiting up to d.
+func (s *Server) acquire(d time.Duration) bool {
+	s.slotsOnce.Do(func() {
+		s.slots = make(chan struct{}, s.MaxSessions)
+	})
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
 	}
+	if d <= 0 {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Release a session slot.
+func (s *Server) release() {
+	<-s.slots
+}
+
+// Reject a connection because there are too many sessions.
+func (s *Server) reject(c net.Conn) {
+	r := Reply{421, "Too many connections; try again later."}
+	r.Encode(textproto.NewWriter(bufio.NewWriter(c)))
+	c.Close()
 }
 
 // ServeFTP serves one client.
 func (s *Server) ServeFTP(c net.Conn) {
+	tc, _ := c.(*tls.Conn)
+	hc, _ := c.(*handshakeConn)
+	if hc != nil {
+		tc = hc.Conn
+	}
+	raw := c
+	if s.WrapControl != nil {
+		c = s.WrapControl(c)
+	}
 	ss := Session{
+		ID:     newSessionID(),
 		Addr:   c.RemoteAddr(),
 		Server: s,
 		conn:   textproto.NewConn(c),
+		ctrl:   c,
 	}
+	ss.ctrlRaw, ss.tlsCtrl, ss.ctrlTLS = raw, hc, tc
 	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
 		ss.host = a.IP.String()
 	}
+	ss.ctx, ss.cancel = context.WithCancel(context.Background())
+	if s.Tarpit != nil {
+		ss.tarpit = s.Tarpit(ss.Addr)
+	}
+	ss.updateQuirks()
+	s.track(&ss, true)
+	defer func() {
+		if v := recover(); v != nil {
+			pe, ok := v.(*PanicError) // From a transfer goroutine.
+			if !ok {
+				pe = &PanicError{v, debug.Stack()}
+			}
+			s.handleError(&ss, pe)
+		}
+		ss.Close()
+		s.track(&ss, false)
+	}()
+	if s.Access != nil {
+		if err := s.Access.Connect(clientIP(ss.Addr)); err != nil {
+			ss.logf("refused: %v", err)
+			ss.Reply(421, "Service not available.")
+			return
+		}
+	}
+	if m, ok := s.InMaintenance(); ok {
+		if !m.ReadOnly {
+			ss.ReplyString(421, m.message())
+			return
+		}
+		ss.readOnly = true
+		ss.greeting = m.message()
+	}
 	if s.Handler != nil {
-		s.Handler.Handle(&ss)
+		err := s.Handler.Handle(&ss)
+		if err != nil && err != io.EOF && err != errSessionClosed && err != errDrained {
+			s.handleError(&ss, err)
+		}
+	}
+}
+
+// A SessionInfo describes a session in progress.
+type SessionInfo struct {
+	ID    string    // Session ID.
+	User  string    // User, once logged in.
+	Addr  net.Addr  // Address of the client.
+	Start time.Time // When the session started.
+
+	Dir         string // Working directory.
+	Cmd         string // Command in progress, if any.
+	Transferred int64  // Bytes of file data transferred by the command.
+}
+
+// A sessionInfo is a session in progress and its description.
+type sessionInfo struct {
+	ss   *Session
+	info SessionInfo
+}
+
+// Sessions returns the sessions in progress, oldest first.
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for _, si := range s.sessions {
+		info := si.info
+		info.Dir, info.Cmd = si.ss.live()
+		info.Transferred = si.ss.Transferred()
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Start.Equal(list[j].Start) {
+			return list[i].Start.Before(list[j].Start)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Record that a session has logged in, for Sessions, unless policy refuses
+// it because the user is logged in elsewhere. This returns the user's other
+// sessions, which TakeoverKick leaves to the caller to close.
+func (s *Server) loggedIn(ss *Session, policy Takeover) ([]*Session, bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	var others []*Session
+	if policy == TakeoverReject || policy == TakeoverKick {
+		for id, si := range s.sessions {
+			if id != ss.ID && si.info.User == ss.User {
+				others = append(others, si.ss)
+			}
+		}
+	}
+	if len(others) > 0 && policy == TakeoverReject {
+		return nil, false
+	}
+	if si := s.sessions[ss.ID]; si != nil {
+		si.info.User = ss.User
+	}
+	return others, true
+}
+
+// Add or remove a session in progress.
+func (s *Server) track(ss *Session, add bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if !add {
+		delete(s.sessions, ss.ID)
+		return
 	}
-	ss.Close()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*sessionInfo)
+	}
+	s.sessions[ss.ID] = &sessionInfo{ss, SessionInfo{ID: ss.ID, Addr: ss.Addr, Start: s.now()}}
+}
+
+// Return the session in progress with the given ID, or nil.
+func (s *Server) session(id string) *Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if si := s.sessions[id]; si != nil {
+		return si.ss
+	}
+	return nil
+}
+
+// Drain calls Drain on the session in progress with the given ID, as found in
+// audit records and logs, returning false if there is none.
+func (s *Server) Drain(id string) bool {
+	ss := s.session(id)
+	if ss == nil {
+		return false
+	}
+	ss.Drain()
+	return true
+}
+
+// Kick closes the session in progress with the given ID at once, cancelling
+// its context, returning false if there is none. A transfer in progress
+// fails once the FileSystem notices the cancellation.
+func (s *Server) Kick(id string) bool {
+	ss := s.session(id)
+	if ss == nil {
+		return false
+	}
+	ss.Drain()
+	ss.cancel()
+	ss.ctrl.Close()
+	return true
+}
+
+// Report an abnormal session error.
+func (s *Server) handleError(ss *Session, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(ss, err)
+	} else if _, ok := err.(*PanicError); ok {
+		ss.logf("%v", err)
+	}
+}
+
+// A PanicError is reported to Server.ErrorHandler when a Handler panics.
+type PanicError struct {
+	Value interface{} // Value passed to panic.
+	Stack []byte      // Stack trace of the panicking goroutine.
+}
+
+// Error implements error.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic serving session: %v\n%s", e.Value, e.Stack)
 }
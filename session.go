@@ -1,27 +1,130 @@
 package ftp
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	mrand "math/rand"
 	"net"
 	"net/textproto"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var errSessionClosed = errors.New("session is closed")
+var errNetworkNotAllowed = errors.New("network not allowed for data connections")
+var errTargetNotAllowed = errors.New("address not allowed for active connections")
+var errDrained = errors.New("session drained")
 
 // A Session represents a single control channel session with a client.
+//
+// A Session belongs to the goroutine serving it, which runs Handler.Handle,
+// and its fields and methods may only be used from that goroutine unless
+// noted. While a transfer is in progress, the function passed to Transfer or
+// Receive runs in its own goroutine and the serving goroutine waits for it,
+// so that function may use the Session too, except to change the data
+// connection, which the serving goroutine aborts on ABOR. Ctx, Drain,
+// Draining, and Transferred may be called from any goroutine, and
+// Server.Sessions describes sessions in progress safely.
 type Session struct {
+	ID      string   // ID uniquely identifies the session in logs.
 	Addr    net.Addr // Addr of remote host.
 	Server  *Server  // Server the session belongs to.
 	Context          // Context shared with the client.
 
 	TLS *tls.Config // TLS config to use for data connections.
 
+	Client string // Client name given with CLNT, if any.
+	Host   string // Host name given with HOST, if any.
+	Quirks Quirk  // Quirks enabled for this client.
+
+	// Account is the logged in user's account, if the Authorizer is an
+	// AccountAuthorizer.
+	Account *Account
+
 	host    string
+	pasvIP  net.IP // IP advertised for the passive connection.
+	mem     int64  // Memory reserved by the session.
 	conn    *textproto.Conn
 	cmd     *Command
 	greeted bool
+	start   time.Time // When the current command was received.
+	xfer    int64     // Bytes of file data transferred by the current command.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	utf8    bool     // Whether the client sent OPTS UTF8 ON.
+	hash    string   // Hash algorithm selected with OPTS HASH.
+	lang    string   // Language selected with LANG, or "" for the default.
+	facts   []string // MLST facts selected with OPTS, or nil for all.
+	bytes   int64    // Bytes of file data transferred by the session.
+	lastErr string   // Last error reply, for STAT.
+
+	ctrl     net.Conn       // Control connection, as wrapped by WrapControl.
+	ctrlRaw  net.Conn       // Control connection, as given to ServeFTP.
+	tlsCtrl  *handshakeConn // Control connection's TLS layer, if it keeps the ClientHello.
+	ctrlTLS  *tls.Conn      // Control connection's TLS layer, if any.
+	authTLS  bool           // Whether TLS was started by AUTH TLS.
+	cleared  bool           // Whether CCC reverted the control connection to plaintext.
+	draining int32          // Set atomically by Drain.
+
+	next chan readResult // Receives the command read in the background, if any.
+
+	mu sync.Mutex // Guards Dir and cmd for reading by other goroutines.
+
+	tarpit time.Duration // Delay of pre-login replies, from Server.Tarpit.
+
+	greeting string // Greeting to send in place of DefaultGreeting, if any.
+	readOnly bool   // Whether the session may not change files.
+
+	hosts *HostMux // Mux routing the session by HOST, if any.
+}
+
+// Ctx returns the session's context, which is cancelled when the session is
+// closed.
+func (s *Session) Ctx() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Set the current command.
+func (s *Session) setCmd(c *Command) {
+	s.mu.Lock()
+	s.cmd = c
+	s.mu.Unlock()
+}
+
+// SetDir sets the working directory. Handlers should use this rather than
+// set Dir, so that Server.Sessions may read it from other goroutines.
+func (s *Session) SetDir(dir string) {
+	s.mu.Lock()
+	s.Dir = dir
+	s.mu.Unlock()
+}
+
+// Return the working directory and current command, for Server.Sessions.
+func (s *Session) live() (dir, cmd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd != nil {
+		cmd = s.cmd.Cmd
+	}
+	return s.Dir, cmd
+}
+
+// Label the session goroutine with the session, user, and current command.
+func (s *Session) label() {
+	user := s.Server.Redact.user(s.User)
+	pprof.SetGoroutineLabels(pprof.WithLabels(s.Ctx(),
+		pprof.Labels("session", s.ID, "user", user, "cmd", s.cmd.Cmd)))
 }
 
 // Command reads the next command, or returns the current command if it has
@@ -32,42 +135,79 @@ func (s *Session) Command() (*Command, error) {
 		return nil, errSessionClosed
 	}
 	if !s.greeted {
-		if err := s.Reply(220, DefaultGreeting); err != nil {
+		greeting := DefaultGreeting
+		if s.greeting != "" {
+			greeting = s.greeting
+		}
+		if err := s.ReplyString(220, greeting); err != nil {
 			return nil, err
 		}
 	}
 	if s.cmd != nil {
 		return s.cmd, nil
 	}
-	cmd := new(Command)
-	if err := cmd.Decode(&s.conn.Reader); err != nil {
+	if s.Draining() {
+		return nil, s.drained()
+	}
+	cmd, err := s.read()
+	if err != nil {
+		if s.Draining() {
+			return nil, s.drained()
+		}
 		return nil, err
 	}
-	s.cmd = cmd
+	s.setCmd(cmd)
+	s.start = time.Now()
+	atomic.StoreInt64(&s.xfer, 0)
+	if s.Server.ProfileLabels {
+		s.label()
+	}
 	if s.Server.Debug {
-		fmt.Println("<", cmd)
+		s.debug("<", &Command{Cmd: cmd.Cmd, Msg: s.logArg(cmd)})
 	}
 	return cmd, nil
 }
 
-// Reply sends a reply. This must be called with a non-intermediate reply code
-// in order to allow the next command to be read. After replying to a QUIT
-// command with a non-intermediate response code, the session is closed.
-func (s *Session) Reply(code int, msg string, args ...interface{}) error {
+// Reply sends a reply, formatted as by fmt.Sprintf if args are given. This
+// must be called with a non-intermediate reply code in order to allow the
+// next command to be read. After replying to a QUIT command with a
+// non-intermediate response code, the session is closed.
+//
+// The format should be a constant. Use ReplyString or ReplyLines for text
+// derived from client input or file names. The format is translated into
+// the language selected with LANG by the Server's Catalog.
+func (s *Session) Reply(code int, format string, args ...interface{}) error {
+	format = s.localize(format)
 	if len(args) > 0 {
-		msg = fmt.Sprintf(msg, args...)
+		return s.ReplyString(code, fmt.Sprintf(format, args...))
 	}
+	return s.ReplyString(code, format)
+}
+
+// ReplyLines sends a reply of one or more lines, without formatting.
+func (s *Session) ReplyLines(code int, lines []string) error {
+	return s.ReplyString(code, strings.Join(lines, "\n"))
+}
+
+// ReplyString sends a reply without formatting. Lines of the message are
+// separated by newlines. Otherwise, this is like Reply.
+func (s *Session) ReplyString(code int, msg string) error {
 	if s.conn == nil {
 		return errSessionClosed
 	}
 	if s.cmd == nil && s.greeted {
 		return errors.New("no command to reply to")
 	}
+	if code >= 200 {
+		s.tarpitDelay()
+		s.audit(code)
+		s.record(code, msg)
+	}
 	m := Reply{code, msg}
 	if s.Server.Debug {
-		fmt.Println(">", m)
+		s.debug(">", m)
 	}
-	if err := m.Encode(&s.conn.Writer); err != nil {
+	if err := m.encode(&s.conn.Writer, s.Quirks&QuirkCodeLines != 0); err != nil {
 		return err
 	}
 	if err := s.conn.W.Flush(); err != nil {
@@ -81,13 +221,81 @@ func (s *Session) Reply(code int, msg string, args ...interface{}) error {
 		return nil
 	}
 	quit := s.cmd.Cmd == "QUIT"
-	s.cmd = nil
+	s.setCmd(nil)
 	if quit {
 		return s.Close()
 	}
 	return nil
 }
 
+// Write a raw string to the control channel in place of a reply. This is
+// only meant for simulating misbehaving servers, and the current command is
+// considered replied to.
+func (s *Session) raw(msg string) error {
+	if s.conn == nil {
+		return errSessionClosed
+	}
+	if s.Server.Debug {
+		s.debug(">", msg)
+	}
+	if _, err := s.conn.W.WriteString(msg); err != nil {
+		return err
+	}
+	if err := s.conn.W.Flush(); err != nil {
+		return err
+	}
+	s.setCmd(nil)
+	return nil
+}
+
+// Print control channel traffic tagged with the session ID.
+func (s *Session) debug(dir string, v interface{}) {
+	fmt.Println(s.ID, dir, s.redactf("%v", v))
+}
+
+// Log an error tagged with the session ID.
+func (s *Session) logf(format string, args ...interface{}) {
+	s.Server.logf("ftp: session %s: %s", s.ID, s.redactf(format, args...))
+}
+
+// Generate a random session ID.
+func newSessionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Drain marks the session to be closed with a 421 reply once the current
+// command, such as a transfer, completes. An idle session is closed at once.
+// Unlike Close, this may be called from any goroutine, for example when the
+// user's access is revoked.
+func (s *Session) Drain() {
+	if atomic.CompareAndSwapInt32(&s.draining, 0, 1) && s.ctrl != nil {
+		// Interrupt a wait for the next command.
+		s.ctrl.SetReadDeadline(time.Now())
+	}
+}
+
+// Draining returns whether Drain has been called.
+func (s *Session) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// Send the reply closing a drained session, which has no command to reply to.
+func (s *Session) drained() error {
+	m := Reply{421, "Service closing control connection."}
+	if s.Server.Debug {
+		s.debug(">", m)
+	}
+	s.greeted = true
+	if err := m.encode(&s.conn.Writer, s.Quirks&QuirkCodeLines != 0); err == nil {
+		s.conn.W.Flush()
+	}
+	return errDrained
+}
+
 // Close the session. This will send a default goodbye reply if one has not
 // been sent in response to a QUIT.
 func (s *Session) Close() error {
@@ -95,9 +303,12 @@ func (s *Session) Close() error {
 		return errSessionClosed
 	}
 	if s.cmd != nil || !s.greeted {
-		s.Reply(421, DefaultGoodbye)
+		s.ReplyString(421, DefaultGoodbye)
 	}
 	s.CloseData()
+	if s.cancel != nil {
+		s.cancel()
+	}
 	err := s.conn.Close()
 	s.conn = nil
 	return err
@@ -110,12 +321,41 @@ func (s *Session) Active(addr net.Addr) error {
 		s.Data.Close()
 		s.Data = nil
 	}
-	c, err := s.Server.dial(addr.Network(), addr.String())
+	if s.Server.passiveOnly() {
+		return errTargetNotAllowed
+	}
+	if s.Server.requireProt() && s.TLS == nil {
+		return errProtRequired
+	}
+	nw := addr.Network()
+	if a, ok := addr.(*net.TCPAddr); ok {
+		nw = "tcp6"
+		if a.IP.To4() != nil {
+			nw = "tcp4"
+		}
+		if !s.allowNetwork(nw) {
+			return errNetworkNotAllowed
+		}
+		if !s.Server.allowTarget(a) {
+			return errTargetNotAllowed
+		}
+	}
+	if p := s.Server.ActivePolicy; p != nil {
+		if err := p(addr); err != nil {
+			s.logf("active: %v", err)
+			return errTargetNotAllowed
+		}
+	}
+	c, err := s.Server.dial(nw, addr.String())
 	if err != nil {
 		return err
 	}
+	c = s.wrapData(c)
 	if s.TLS != nil {
-		c = tls.Server(c, s.TLS)
+		c = s.Server.tlsServer(c, s.TLS)
+	}
+	if w := s.Server.WrapData; w != nil {
+		c = w(s, c)
 	}
 	s.Data = ActiveConn(c)
 	s.Data.Type(s.Type)
@@ -129,19 +369,113 @@ func (s *Session) Passive(nw string) error {
 		s.Data.Close()
 		s.Data = nil
 	}
-	addr := net.JoinHostPort(s.host, "0")
-	li, err := s.Server.listen(nw, addr)
+	if !s.allowNetwork(nw) {
+		return errNetworkNotAllowed
+	}
+	if s.Server.requireProt() && s.TLS == nil {
+		return errProtRequired
+	}
+	ip, ports := s.Server.passiveAddr(s)
+	li, err := s.listenPassive(nw, ports)
 	if err != nil {
 		return err
 	}
+	li = &wrapListener{li, s.wrapData}
 	if s.TLS != nil {
-		li = tls.NewListener(li, s.TLS)
+		li = s.Server.tlsListener(li, s.TLS)
+	}
+	if w := s.Server.WrapData; w != nil {
+		li = &wrapListener{li, func(c net.Conn) net.Conn { return w(s, c) }}
 	}
+	s.pasvIP = ip
 	s.Data = PassiveConn(li)
 	s.Data.Type(s.Type)
 	return nil
 }
 
+// Wrap a new data connection below any TLS layer.
+func (s *Session) wrapData(c net.Conn) net.Conn {
+	if d := s.Server.DataLinger; d > 0 {
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(int((d + time.Second - 1) / time.Second))
+		}
+	}
+	if sh := s.Server.Shaper; sh != nil {
+		c = sh.shape(c)
+	}
+	var prio int
+	if s.Account != nil {
+		prio = s.Account.Priority
+		if l := s.Server.classLimiter(s.Account.Class); l != nil {
+			c = &limitedConn{c, l, prio}
+		}
+	}
+	if l := s.Server.classLimiter(""); l != nil {
+		c = &limitedConn{c, l, prio}
+	}
+	return c
+}
+
+// Whether data connections over nw are allowed by the server.
+func (s *Session) allowNetwork(nw string) bool {
+	return s.Server.DataNetwork == "" || nw == "tcp" || nw == s.Server.DataNetwork
+}
+
+// Whether the control connection is over IPv6.
+func (s *Session) ipv6() bool {
+	ip := net.ParseIP(s.host)
+	return ip != nil && ip.To4() == nil
+}
+
+// Listen on the first available port in ports, starting from a random port,
+// or on a port chosen by the server's PortAllocator if it has one. If an
+// IPv4 listener is requested over an IPv6 control connection, this listens
+// on all IPv4 interfaces.
+func (s *Session) listenPassive(nw string, ports PortRange) (net.Listener, error) {
+	host := s.host
+	if nw == "tcp4" && s.ipv6() {
+		host = ""
+	} else if nw == "tcp" && s.Server.DualStack {
+		host = ""
+	}
+	if a := s.Server.PortAllocator; a != nil {
+		return s.listenAllocated(a, nw, host)
+	}
+	if ports.Min <= 0 || ports.Max < ports.Min {
+		return s.Server.listen(nw, net.JoinHostPort(host, "0"))
+	}
+	n := ports.Max - ports.Min + 1
+	start := mrand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		p := ports.Min + (start+i)%n
+		addr := net.JoinHostPort(host, strconv.Itoa(p))
+		var li net.Listener
+		if li, err = s.Server.listen(nw, addr); err == nil {
+			return li, nil
+		}
+	}
+	return nil, err
+}
+
+// PassiveAddr returns the address to advertise for the passive connection.
+// This is the listening address, with the IP replaced by the public IP if
+// one is configured.
+func (s *Session) PassiveAddr() *net.TCPAddr {
+	if s.Data == nil {
+		return nil
+	}
+	addr, ok := s.Data.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	a := *addr
+	if s.pasvIP != nil {
+		a.IP = s.pasvIP
+	}
+	return &a
+}
+
 // SetType sets s.Type as well as the type of any existing data channel.
 func (s *Session) SetType(t string) error {
 	switch t {
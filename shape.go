@@ -0,0 +1,88 @@
+package ftp
+
+import (
+	"net"
+	"time"
+)
+
+// A Shaper simulates a slow network on data connections. It is intended for
+// test servers, to reproduce client timeout and resume behavior, and is
+// deterministic: every read and write is delayed by exactly the configured
+// latency plus the time the bandwidth allows for the bytes transferred.
+type Shaper struct {
+	Latency   time.Duration // Latency added to each read and write.
+	Bandwidth int64         // Bandwidth in bytes per second, if positive.
+}
+
+// Shape c. The returned connection transfers at most 1/10th of a second
+// worth of bandwidth per read or write.
+func (sh *Shaper) shape(c net.Conn) net.Conn {
+	return &shapedConn{Conn: c, sh: sh}
+}
+
+// A shapedConn is a net.Conn slowed down by a Shaper.
+type shapedConn struct {
+	net.Conn
+	sh *Shaper
+}
+
+// Return how much of n bytes to transfer at once.
+func (c *shapedConn) chunk(n int) int {
+	if bw := c.sh.Bandwidth; bw > 0 {
+		if max := int(bw / 10); max > 0 && n > max {
+			return max
+		} else if max == 0 {
+			return 1
+		}
+	}
+	return n
+}
+
+// Sleep for the time it takes to transfer n bytes.
+func (c *shapedConn) wait(n int) {
+	d := c.sh.Latency
+	if bw := c.sh.Bandwidth; bw > 0 {
+		d += time.Duration(int64(n) * int64(time.Second) / bw)
+	}
+	time.Sleep(d)
+}
+
+// Read implements net.Conn.
+func (c *shapedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:c.chunk(len(b))])
+	c.wait(n)
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *shapedConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 && err == nil {
+		var nn int
+		m := c.chunk(len(b))
+		c.wait(m)
+		nn, err = c.Conn.Write(b[:m])
+		n += nn
+		b = b[nn:]
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection.
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// A wrapListener wraps connections it accepts.
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+// Accept implements net.Listener.
+func (l *wrapListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(c), nil
+}
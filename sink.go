@@ -0,0 +1,46 @@
+package ftp
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// A Sink consumes uploads to a path directly, such as by streaming them into
+// a message queue, without storing a file. The upload fails if Close returns
+// an error.
+type Sink func(path string) (io.WriteCloser, error)
+
+// A sinkFS is a FileSystem with uploads to some paths sent to Sinks.
+type sinkFS struct {
+	wrappedFS
+	sinks map[string]Sink // Keyed by cleaned absolute path.
+}
+
+func (f *sinkFS) Create(p string) (File, error) {
+	return f.CreateAt(p, 0)
+}
+
+func (f *sinkFS) CreateAt(p string, off int64) (File, error) {
+	sink := f.sinks[path.Clean("/"+p)]
+	if sink == nil {
+		return CreateAt(f.FileSystem, p, off)
+	}
+	if off > 0 {
+		return nil, errNotSupported
+	}
+	wc, err := sink(path.Clean("/" + p))
+	if err != nil {
+		return nil, err
+	}
+	return &sinkFile{wc}, nil
+}
+
+// A sinkFile is a File writing to a Sink.
+type sinkFile struct {
+	io.WriteCloser
+}
+
+func (f *sinkFile) Read(b []byte) (int, error)                { return 0, os.ErrPermission }
+func (f *sinkFile) Seek(off int64, whence int) (int64, error) { return 0, errNotSupported }
+func (f *sinkFile) Readdir(n int) ([]os.FileInfo, error)      { return nil, errNotSupported }
@@ -0,0 +1,85 @@
+package ftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A State describes what the client has negotiated in a session, for hooks
+// and custom commands to inspect.
+type State struct {
+	Type  string   // Representation type set with TYPE, if any.
+	Mode  string   // Transfer mode set with MODE, if any.
+	Prot  string   // Data channel protection level, "C" or "P".
+	UTF8  bool     // Whether the client sent OPTS UTF8 ON.
+	Hash  string   // Hash algorithm selected with OPTS HASH, if any.
+	Facts []string // MLST facts selected with OPTS MLST.
+}
+
+// State returns the state negotiated in the session so far.
+func (s *Session) State() State {
+	st := State{
+		Type:  s.Type,
+		Mode:  s.Mode,
+		Prot:  "C",
+		UTF8:  s.utf8,
+		Hash:  s.hash,
+		Facts: append([]string(nil), s.selectedFacts()...),
+	}
+	if s.TLS != nil {
+		st.Prot = "P"
+	}
+	return st
+}
+
+// Return the MLST facts selected by the client.
+func (s *Session) selectedFacts() []string {
+	if s.facts == nil {
+		return mlstFacts
+	}
+	return s.facts
+}
+
+// Record the outcome of the current command, replied to with code, for
+// STAT.
+func (s *Session) record(code int, msg string) {
+	s.bytes += s.xfer
+	if code >= 400 && s.cmd != nil {
+		if i := strings.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[:i]
+		}
+		s.lastErr = fmt.Sprintf("%s: %d %s", s.cmd.Cmd, code, msg)
+	}
+}
+
+// Return lines describing the session, for STAT without an argument.
+func (s *Session) status() []string {
+	st := s.State()
+	if st.Type == "" {
+		st.Type = "A"
+	}
+	if st.Mode == "" {
+		st.Mode = "S"
+	}
+	msg := []string{"FTP server status:"}
+	if s.Addr != nil {
+		msg = append(msg, "Connected from "+s.logAddr())
+	}
+	if s.User != "" {
+		msg = append(msg, "Logged in as "+s.User)
+	}
+	msg = append(msg, fmt.Sprintf("TYPE: %s, MODE: %s, PROT: %s", st.Type, st.Mode, st.Prot))
+	switch {
+	case s.Data == nil:
+		msg = append(msg, "No data connection")
+	case s.Data.Passive():
+		msg = append(msg, "Passive data connection on "+s.Data.Addr().String())
+	default:
+		msg = append(msg, "Active data connection to "+s.Data.Addr().String())
+	}
+	msg = append(msg, fmt.Sprintf("Bytes transferred: %d", s.bytes))
+	if s.lastErr != "" {
+		msg = append(msg, "Last error: "+s.lastErr)
+	}
+	return append(msg, "End of status")
+}
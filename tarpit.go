@@ -0,0 +1,37 @@
+package ftp
+
+import (
+	"net"
+	"time"
+)
+
+// TarpitNets returns a function for Server.Tarpit delaying clients from any
+// of nets, such as ranges known for scanning.
+func TarpitNets(delay time.Duration, nets ...*net.IPNet) func(net.Addr) time.Duration {
+	return func(addr net.Addr) time.Duration {
+		ip := net.ParseIP(clientHost(addr))
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return delay
+			}
+		}
+		return 0
+	}
+}
+
+// Delay the greeting and replies to USER and PASS for a client the server's
+// Tarpit deems suspicious, until the session is closed.
+func (s *Session) tarpitDelay() {
+	if s.tarpit <= 0 {
+		return
+	}
+	if s.greeted && (s.cmd == nil || s.cmd.Cmd != "USER" && s.cmd.Cmd != "PASS") {
+		return
+	}
+	t := time.NewTimer(s.tarpit)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.Ctx().Done():
+	}
+}
@@ -0,0 +1,251 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var errFSTimeout = errors.New("file system operation timed out")
+
+// A timeoutFS is a ContextFileSystem applying a FileHandler's OpTimeout and
+// retry policy to another, including to the optional interfaces it forwards.
+type timeoutFS struct {
+	fs      ContextFileSystem
+	ctx     context.Context // Context for the optional interfaces, which take none.
+	timeout time.Duration
+	retries int
+	delay   time.Duration
+}
+
+// Run op, retrying it on failure if retry is set. Errors implying that a
+// retry would fail the same way aren't retried.
+func (f *timeoutFS) do(ctx context.Context, retry bool, op func(context.Context) (interface{}, error)) (interface{}, error) {
+	for i := 0; ; i++ {
+		v, err := f.try(ctx, op)
+		if err == nil || !retry || i >= f.retries || ctx.Err() != nil ||
+			isNotExist(err) || isPermission(err) || isOffline(err) != nil {
+			return v, err
+		}
+		select {
+		case <-time.After(f.delay << uint(i)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Run op once, giving up after the timeout. If op completes after that, any
+// File it returned is closed.
+func (f *timeoutFS) try(ctx context.Context, op func(context.Context) (interface{}, error)) (interface{}, error) {
+	if f.timeout <= 0 {
+		return op(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	type result struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := op(ctx)
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err == context.DeadlineExceeded {
+			r.err = errFSTimeout
+		}
+		return r.v, r.err
+	case <-ctx.Done():
+		go func() {
+			if c, ok := (<-done).v.(io.Closer); ok {
+				c.Close()
+			}
+		}()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errFSTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (f *timeoutFS) CreateContext(ctx context.Context, path string) (File, error) {
+	v, err := f.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return f.fs.CreateContext(ctx, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(File), nil
+}
+
+func (f *timeoutFS) MkdirContext(ctx context.Context, path string) error {
+	_, err := f.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return nil, f.fs.MkdirContext(ctx, path)
+	})
+	return err
+}
+
+func (f *timeoutFS) OpenContext(ctx context.Context, path string) (File, error) {
+	v, err := f.do(ctx, true, func(ctx context.Context) (interface{}, error) {
+		return f.fs.OpenContext(ctx, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutFile{v.(File), f, ctx}, nil
+}
+
+func (f *timeoutFS) RemoveContext(ctx context.Context, path string) error {
+	_, err := f.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return nil, f.fs.RemoveContext(ctx, path)
+	})
+	return err
+}
+
+func (f *timeoutFS) RenameContext(ctx context.Context, old, new string) error {
+	_, err := f.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return nil, f.fs.RenameContext(ctx, old, new)
+	})
+	return err
+}
+
+func (f *timeoutFS) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	v, err := f.do(ctx, true, func(ctx context.Context) (interface{}, error) {
+		return f.fs.StatContext(ctx, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(os.FileInfo), nil
+}
+
+func (f *timeoutFS) CreateAt(path string, off int64) (File, error) {
+	if off == 0 {
+		return f.CreateContext(f.ctx, path)
+	}
+	c, ok := f.fs.(CreateAter)
+	if !ok {
+		return nil, errNotSupported
+	}
+	v, err := f.do(f.ctx, false, func(context.Context) (interface{}, error) {
+		return c.CreateAt(path, off)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(File), nil
+}
+
+func (f *timeoutFS) OpenAt(path string, off int64) (File, error) {
+	o, ok := f.fs.(OpenAter)
+	if !ok {
+		return nil, errNotSupported
+	}
+	v, err := f.do(f.ctx, true, func(context.Context) (interface{}, error) {
+		return o.OpenAt(path, off)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(File), nil
+}
+
+// A fileStat is a File returned by OpenStat with its description. It is
+// closed if OpenStat completes after a timeout.
+type fileStat struct {
+	File
+	fi os.FileInfo
+}
+
+func (f *timeoutFS) OpenStat(path string) (File, os.FileInfo, error) {
+	o, ok := f.fs.(OpenStater)
+	if !ok {
+		return nil, nil, errNotSupported
+	}
+	v, err := f.do(f.ctx, true, func(context.Context) (interface{}, error) {
+		file, fi, err := o.OpenStat(path)
+		if err != nil {
+			return nil, err
+		}
+		return fileStat{file, fi}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	fs := v.(fileStat)
+	return fs.File, fs.fi, nil
+}
+
+func (f *timeoutFS) Quota(user string) (int64, int64, error) {
+	q, ok := f.fs.(Quotaer)
+	if !ok {
+		return 0, 0, errNotSupported
+	}
+	v, err := f.do(f.ctx, true, func(context.Context) (interface{}, error) {
+		used, limit, err := q.Quota(user)
+		return [2]int64{used, limit}, err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	quota := v.([2]int64)
+	return quota[0], quota[1], nil
+}
+
+func (f *timeoutFS) Allocate(size int64) error {
+	a, ok := f.fs.(Allocator)
+	if !ok {
+		return errNotSupported
+	}
+	_, err := f.do(f.ctx, false, func(context.Context) (interface{}, error) {
+		return nil, a.Allocate(size)
+	})
+	return err
+}
+
+func (f *timeoutFS) DirSize(path string) (int64, error) {
+	d, ok := f.fs.(DirSizer)
+	if !ok {
+		return 0, errNotSupported
+	}
+	v, err := f.do(f.ctx, true, func(context.Context) (interface{}, error) {
+		return d.DirSize(path)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+func (f *timeoutFS) Chtimes(path string, atime, mtime time.Time) error {
+	c, ok := f.fs.(Chtimeser)
+	if !ok {
+		return errNotSupported
+	}
+	_, err := f.do(f.ctx, false, func(context.Context) (interface{}, error) {
+		return nil, c.Chtimes(path, atime, mtime)
+	})
+	return err
+}
+
+// A timeoutFile is a File whose Readdir is subject to a timeout. Since reading
+// a directory advances the File, this isn't retried.
+type timeoutFile struct {
+	File
+	fs  *timeoutFS
+	ctx context.Context
+}
+
+// Readdir implements File.
+func (f *timeoutFile) Readdir(n int) ([]os.FileInfo, error) {
+	v, err := f.fs.do(f.ctx, false, func(context.Context) (interface{}, error) {
+		return f.File.Readdir(n)
+	})
+	list, _ := v.([]os.FileInfo)
+	return list, err
+}
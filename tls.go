@@ -0,0 +1,278 @@
+package ftp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Errors returned by Session.StartTLS and Session.ClearTLS.
+var (
+	errNoTLS      = errors.New("TLS is not configured")
+	errTLSActive  = errors.New("control connection already uses TLS")
+	errPipelined  = errors.New("commands sent during a TLS change")
+	errNotAuthTLS = errors.New("control connection not protected by AUTH TLS")
+	errCCCRefused = errors.New("clearing the control connection is not allowed")
+)
+
+var errDataCert = errors.New("data connection certificate doesn't match the session")
+
+// Return the TLS config for control and data connections, with the server's
+// KeyLogWriter and any minimum version of its Preset applied.
+func (s *Server) tlsConfig() *tls.Config {
+	s.tlsOnce.Do(func() {
+		s.tlsConf = s.TLS
+		min := s.minTLSVersion()
+		if s.TLS != nil && (s.KeyLogWriter != nil || s.TLS.MinVersion < min) {
+			s.tlsConf = s.TLS.Clone()
+			s.tlsConf.KeyLogWriter = s.KeyLogWriter
+			if s.tlsConf.MinVersion < min {
+				s.tlsConf.MinVersion = min
+			}
+		}
+	})
+	return s.tlsConf
+}
+
+// Return a TLS server connection over c. If HandshakeError or ClientHello is
+// set, the ClientHello is kept, and the handshake is completed on first use
+// so that a failure can be reported with it.
+func (s *Server) tlsServer(c net.Conn, config *tls.Config) net.Conn {
+	if s.HandshakeError == nil && s.ClientHello == nil {
+		return tls.Server(c, config)
+	}
+	hc := &handshakeConn{report: s.HandshakeError}
+	config = config.Clone()
+	get := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hc.hello = hello
+		if s.ClientHello != nil {
+			if err := s.ClientHello(hello); err != nil {
+				return nil, err
+			}
+		}
+		if get != nil {
+			return get(hello)
+		}
+		return nil, nil
+	}
+	hc.Conn = tls.Server(c, config)
+	return hc
+}
+
+// Return a listener accepting TLS server connections over l.
+func (s *Server) tlsListener(l net.Listener, config *tls.Config) net.Listener {
+	return &wrapListener{l, func(c net.Conn) net.Conn { return s.tlsServer(c, config) }}
+}
+
+// A handshakeConn is a TLS connection keeping its ClientHello and reporting
+// handshake failures.
+type handshakeConn struct {
+	*tls.Conn
+	once   sync.Once
+	hello  *tls.ClientHelloInfo              // Set during the handshake, if one is received.
+	report func(*tls.ClientHelloInfo, error) // Called on failure, if non-nil.
+}
+
+// Complete the handshake, reporting any failure.
+func (c *handshakeConn) handshake() {
+	c.once.Do(func() {
+		if err := c.Conn.Handshake(); err != nil && c.report != nil {
+			c.report(c.hello, err)
+		}
+	})
+}
+
+// Read implements net.Conn.
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	c.handshake()
+	return c.Conn.Read(b)
+}
+
+// Write implements net.Conn.
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	c.handshake()
+	return c.Conn.Write(b)
+}
+
+// StartTLS replies 234 with msg and upgrades the control connection to TLS,
+// as AUTH TLS does (RFC 4217). This fails without replying if TLS isn't
+// configured, the control connection already uses TLS, or the client sent
+// more commands after the current one, which would otherwise be taken as
+// sent over TLS.
+func (s *Session) StartTLS(msg string) error {
+	if s.Server.TLS == nil {
+		return errNoTLS
+	} else if s.ctrlTLS != nil {
+		return errTLSActive
+	} else if s.next != nil || s.conn.R.Buffered() > 0 {
+		return errPipelined
+	}
+	if err := s.ReplyString(234, msg); err != nil {
+		return err
+	}
+	raw := s.ctrlRaw
+	if s.Server.AllowCCC {
+		raw = &tlsRecordConn{Conn: raw}
+	}
+	c := s.Server.tlsServer(raw, s.Server.tlsConfig())
+	if hc, ok := c.(*handshakeConn); ok {
+		s.tlsCtrl, s.ctrlTLS = hc, hc.Conn
+	} else {
+		s.ctrlTLS = c.(*tls.Conn)
+	}
+	if s.Server.WrapControl != nil {
+		c = s.Server.WrapControl(c)
+	}
+	s.conn = textproto.NewConn(c)
+	s.authTLS = true
+	return nil
+}
+
+// ClearTLS replies 200 with msg and reverts the control connection to
+// plaintext after AUTH TLS, as CCC does (RFC 4217 section 6), for clients
+// behind NAT devices that must see the data connection commands. Data
+// connections stay protected as set by PROT. This fails without replying
+// unless the server's AllowCCC is set and TLS was started by StartTLS, or if
+// the client sent more commands after the current one.
+func (s *Session) ClearTLS(msg string) error {
+	if !s.Server.AllowCCC {
+		return errCCCRefused
+	} else if !s.authTLS || s.cleared {
+		return errNotAuthTLS
+	} else if s.next != nil || s.conn.R.Buffered() > 0 {
+		return errPipelined
+	}
+	if err := s.ReplyString(200, msg); err != nil {
+		return err
+	}
+	// Exchange close_notify alerts; the client's is read as EOF.
+	if err := s.ctrlTLS.CloseWrite(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, s.ctrlTLS); err != nil {
+		return err
+	}
+	// CloseWrite leaves a past write deadline on the connection.
+	if err := s.ctrl.SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+	s.conn = textproto.NewConn(s.ctrl)
+	s.cleared = true
+	return nil
+}
+
+// A tlsRecordConn reads no further than the end of each TLS record, so that
+// plaintext following a close_notify alert isn't consumed by the TLS layer.
+type tlsRecordConn struct {
+	net.Conn
+	hdr     [5]byte
+	pending []byte // Bytes of the record header yet to be read.
+	rem     int    // Bytes of the record body yet to be read.
+}
+
+// Read implements net.Conn.
+func (c *tlsRecordConn) Read(b []byte) (int, error) {
+	if c.rem == 0 && len(c.pending) == 0 {
+		if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		c.rem = int(c.hdr[3])<<8 | int(c.hdr[4])
+		c.pending = c.hdr[:]
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if len(b) > c.rem {
+		b = b[:c.rem]
+	}
+	n, err := c.Conn.Read(b)
+	c.rem -= n
+	return n, err
+}
+
+// Whether the control connection uses TLS.
+func (s *Session) secure() bool {
+	return s.ctrlTLS != nil
+}
+
+// ClientHello returns the TLS ClientHello of the control connection, so that
+// handlers can classify clients. This returns nil for connections without
+// TLS, or if neither ClientHello nor HandshakeError is set in the Server.
+func (s *Session) ClientHello() *tls.ClientHelloInfo {
+	if s.tlsCtrl == nil {
+		return nil
+	}
+	s.tlsCtrl.handshake()
+	return s.tlsCtrl.hello
+}
+
+// Return the TLS config for data connections. With DataCertBinding, this
+// requires a client certificate matching the control connection's or the
+// user.
+func (s *Session) dataTLS() *tls.Config {
+	config := s.Server.tlsConfig()
+	if !s.Server.DataCertBinding {
+		return config
+	}
+	config = config.Clone()
+	switch config.ClientAuth {
+	case tls.NoClientCert, tls.RequestClientCert:
+		config.ClientAuth = tls.RequireAnyClientCert
+	case tls.VerifyClientCertIfGiven:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 || !s.certMatches(cs.PeerCertificates[0]) {
+			s.logf("data: %v", errDataCert)
+			return errDataCert
+		}
+		return nil
+	}
+	return config
+}
+
+// Whether a data connection's client certificate is the control
+// connection's, or names the user in its subject alternative names.
+func (s *Session) certMatches(cert *x509.Certificate) bool {
+	if s.ctrlTLS != nil {
+		if certs := s.ctrlTLS.ConnectionState().PeerCertificates; len(certs) > 0 &&
+			bytes.Equal(certs[0].Raw, cert.Raw) {
+			return true
+		}
+	}
+	if s.User == "" {
+		return false
+	}
+	for _, name := range cert.DNSNames {
+		if name == s.User {
+			return true
+		}
+	}
+	for _, name := range cert.EmailAddresses {
+		if name == s.User {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if u.String() == s.User {
+			return true
+		}
+	}
+	return false
+}
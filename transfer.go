@@ -0,0 +1,168 @@
+package ftp
+
+import (
+	"context"
+	"io"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// A dataError is an error reading or writing the data connection.
+type dataError struct {
+	err error
+}
+
+func (e *dataError) Error() string {
+	return "data connection: " + e.err.Error()
+}
+
+// Whether err means a transfer was aborted by the data connection failing.
+func isAborted(err error) bool {
+	_, ok := err.(*dataError)
+	return ok || err == errFaultReset
+}
+
+// A dataIO reads and writes the data connection of a session, counting the
+// bytes transferred and marking errors as dataErrors.
+type dataIO struct {
+	s *Session
+}
+
+func (d dataIO) Write(b []byte) (int, error) {
+	n, err := d.s.Data.Write(b)
+	atomic.AddInt64(&d.s.xfer, int64(n))
+	if err != nil {
+		err = &dataError{err}
+	}
+	return n, err
+}
+
+func (d dataIO) Read(b []byte) (int, error) {
+	n, err := d.s.Data.Read(b)
+	atomic.AddInt64(&d.s.xfer, int64(n))
+	if err != nil && err != io.EOF {
+		err = &dataError{err}
+	}
+	return n, err
+}
+
+// Transfer sends data to the client with send over the data connection. It
+// replies 150 before calling send, and once it returns, closes the data
+// connection and replies 226 on success. If there is no data connection,
+// it replies 425. If the data connection fails, it replies 426, and if send
+// fails otherwise, 451. Data connections are rate limited as configured for
+// the Server. The returned error is from replying.
+func (s *Session) Transfer(send func(w io.Writer) error) error {
+	return s.finishData(s.transfer("Opening data connection.", true, func() error {
+		return send(dataIO{s})
+	}))
+}
+
+// Receive is like Transfer, but receives data from the client with recv.
+func (s *Session) Receive(recv func(r io.Reader) error) error {
+	return s.finishData(s.transfer("Ready to receive data.", false, func() error {
+		return recv(dataIO{s})
+	}))
+}
+
+// Run fn over the data connection after replying 150 with msg, and close the
+// data connection. If send is true, the writing side is shut down first so
+// that the client sees the end of the data before the final reply. This
+// returns errNoDataConn without a reply if there is no data connection.
+func (s *Session) transfer(msg string, send bool, fn func() error) error {
+	if s.Data == nil {
+		return errNoDataConn
+	}
+	if err := s.ReplyString(150, msg); err != nil {
+		s.CloseData()
+		return err
+	}
+	if err := s.run(fn); err != nil {
+		s.CloseData()
+		return err
+	}
+	if send && s.Data != nil {
+		if err := s.Data.CloseWrite(); err != nil {
+			s.CloseData()
+			return &dataError{err}
+		}
+	}
+	if err := s.CloseData(); err != nil && err != errNoDataConn {
+		return &dataError{err}
+	}
+	return nil
+}
+
+// Run fn, a transfer over the data connection, in its own goroutine. The data
+// connection is aborted if ABOR is received, the session is closed, or no
+// data moves for the server's StallTimeout, so that fn fails. Any other
+// command received meanwhile is kept for Command.
+func (s *Session) run(fn func() error) error {
+	data, ctx := s.Data, s.Ctx()
+	done := make(chan error, 1)
+	panicked := make(chan *PanicError, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				panicked <- &PanicError{v, debug.Stack()}
+			}
+		}()
+		done <- fn()
+	}()
+	var next chan readResult
+	if s.conn != nil {
+		next = s.readAhead()
+	}
+	var stall <-chan time.Time
+	if d := s.Server.StallTimeout; d > 0 {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		stall = t.C
+	}
+	last := int64(-1)
+	for {
+		select {
+		case err := <-done:
+			return err
+		case p := <-panicked:
+			panic(p)
+		case r := <-next:
+			next <- r
+			next = nil
+			if r.err == nil && r.cmd.Cmd == "ABOR" {
+				data.Abort()
+			}
+		case <-ctx.Done():
+			data.Abort()
+			ctx = context.Background()
+		case <-stall:
+			if n := s.Transferred(); n != last {
+				last = n
+				continue
+			}
+			s.logf("data: no progress for %v; aborting", s.Server.StallTimeout)
+			data.Abort()
+			stall = nil
+		}
+	}
+}
+
+// Transferred returns the bytes of file data transferred by the current
+// command so far. Unlike most Session methods, this may be called from any
+// goroutine, for example to report the progress of transfers.
+func (s *Session) Transferred() int64 {
+	return atomic.LoadInt64(&s.xfer)
+}
+
+// Reply to the end of a transfer according to err.
+func (s *Session) finishData(err error) error {
+	if err == nil {
+		return s.Reply(226, "Transfer complete.")
+	} else if err == errNoDataConn {
+		return s.Reply(425, "Use PORT or PASV first.")
+	} else if isAborted(err) {
+		return s.Reply(426, "Connection closed; transfer aborted.")
+	}
+	return s.Reply(451, "Local error in processing.")
+}
@@ -0,0 +1,135 @@
+package ftp
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A ConfigError lists the problems found by Server.Validate.
+type ConfigError struct {
+	Problems []string
+}
+
+// Error implements error.
+func (e *ConfigError) Error() string {
+	return "ftp: invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the server's configuration for mistakes that would only
+// show up once clients connect, returning a *ConfigError describing each.
+func (s *Server) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if s.Handler == nil {
+		add("Handler is nil; set a FileHandler")
+	}
+	if s.TLS != nil {
+		if len(s.TLS.Certificates) == 0 && s.TLS.GetCertificate == nil && s.TLS.GetConfigForClient == nil {
+			add("TLS has no certificates; set TLS.Certificates")
+		}
+		for i, cert := range s.TLS.Certificates {
+			if err := checkCert(cert.Certificate, cert.PrivateKey); err != nil {
+				add("TLS certificate %d: %v", i, err)
+			}
+		}
+	} else {
+		if s.Preset == PresetHardened {
+			add("PresetHardened requires TLS; set TLS")
+		}
+		if s.RequireProt || s.DataCertBinding {
+			add("RequireProt and DataCertBinding have no effect without TLS; set TLS")
+		}
+		if s.ExplicitTLS {
+			add("ExplicitTLS has no effect without TLS; set TLS")
+		}
+	}
+	if p := s.PassivePorts; p.Min > 0 || p.Max > 0 {
+		if p.Min <= 0 || p.Max < p.Min || p.Max > 65535 {
+			add("PassivePorts %d-%d is not a valid range, so any port is used; set 1 <= Min <= Max <= 65535", p.Min, p.Max)
+		} else if n := p.Max - p.Min + 1; s.MaxSessions > n {
+			add("PassivePorts has %d ports for up to %d sessions; widen the range or lower MaxSessions", n, s.MaxSessions)
+		}
+	}
+	if ip := s.PublicIP; ip != nil {
+		if ip.IsUnspecified() || ip.IsLoopback() {
+			add("PublicIP %v can't be reached by clients; set the address clients connect to", ip)
+		} else if ip.To4() == nil {
+			add("PublicIP %v is not IPv4, so it can't be advertised by PASV; set an IPv4 address", ip)
+		}
+	}
+	switch s.DataNetwork {
+	case "", "tcp4", "tcp6":
+	default:
+		add("DataNetwork %q is not tcp4 or tcp6", s.DataNetwork)
+	}
+	if s.MaxSessions <= 0 && s.QueueTimeout > 0 {
+		add("QueueTimeout has no effect without MaxSessions")
+	}
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
+// Check that a certificate chain is current and matches its private key.
+func checkCert(chain [][]byte, key crypto.PrivateKey) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("empty chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("private key can't sign")
+	}
+	pub, ok := signer.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !pub.Equal(leaf.PublicKey) {
+		return fmt.Errorf("private key doesn't match the certificate")
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return fmt.Errorf("expired %v", leaf.NotAfter)
+	} else if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("not valid until %v", leaf.NotBefore)
+	}
+	return nil
+}
+
+// A Checker is a Handler that can check its backends are working, for
+// Server.SelfCheck.
+type Checker interface {
+	Check() error
+}
+
+// SelfCheck validates the configuration, then checks that the Handler can
+// serve, if it is a Checker. This is meant for health checks and runtime
+// diagnostics.
+func (s *Server) SelfCheck() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if c, ok := s.Handler.(Checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// Check implements Checker, checking that the circuit breaker is closed and
+// the root directory can be read.
+func (h *FileHandler) Check() error {
+	if h.Breaker.tripped() {
+		return errBreakerOpen
+	}
+	if _, err := h.FileSystem.Stat("/"); err != nil {
+		return fmt.Errorf("ftp: file system: %v", err)
+	}
+	return nil
+}
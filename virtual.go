@@ -0,0 +1,109 @@
+package ftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// A VirtualFile is a read-only file generated by the server rather than
+// stored in the FileSystem, such as a README for each user.
+type VirtualFile struct {
+	// Content returns the file's content for a session.
+	Content func(s *Session) []byte
+
+	// ModTime is the modification time reported, or the current time if
+	// zero.
+	ModTime time.Time
+}
+
+// virtualFiles are the virtual files of a session.
+type virtualFiles struct {
+	files map[string]*VirtualFile
+	s     *Session
+}
+
+func (v *virtualFiles) has(p string) bool { return v.files[p] != nil }
+
+func (v *virtualFiles) stat(p string) (os.FileInfo, error) {
+	vf := v.files[p]
+	t := vf.ModTime
+	if t.IsZero() {
+		t = v.s.Server.now()
+	}
+	size := int64(len(vf.Content(v.s)))
+	return &stat{name: path.Base(p), size: size, mode: 0444, time: t}, nil
+}
+
+func (v *virtualFiles) open(p string) (File, error) {
+	return &virtualFile{Reader: bytes.NewReader(v.files[p].Content(v.s))}, nil
+}
+
+func (v *virtualFiles) paths() []string {
+	list := make([]string, 0, len(v.files))
+	for p := range v.files {
+		list = append(list, p)
+	}
+	return list
+}
+
+// A virtualFile is a File reading a virtual file's content.
+type virtualFile struct {
+	*bytes.Reader
+}
+
+func (f *virtualFile) Write(b []byte) (int, error)          { return 0, os.ErrPermission }
+func (f *virtualFile) Close() error                         { return nil }
+func (f *virtualFile) Readdir(n int) ([]os.FileInfo, error) { return nil, errNotSupported }
+
+// A virtualDir is a directory File listing virtual files after its real
+// entries. Real entries with the same name as a virtual file are hidden.
+type virtualDir struct {
+	File
+	extra []os.FileInfo
+}
+
+// Readdir implements File.
+func (f *virtualDir) Readdir(n int) ([]os.FileInfo, error) {
+	list, err := f.File.Readdir(n)
+	list = f.hide(list)
+	if n <= 0 {
+		list = append(list, f.extra...)
+		f.extra = nil
+		return list, err
+	}
+	if err != io.EOF {
+		if len(list) == 0 && err == nil {
+			return f.Readdir(n)
+		}
+		return list, err
+	}
+	if len(f.extra) == 0 {
+		return list, err
+	}
+	if m := n - len(list); m < len(f.extra) {
+		list = append(list, f.extra[:m]...)
+		f.extra = f.extra[m:]
+		return list, nil
+	}
+	list = append(list, f.extra...)
+	f.extra = nil
+	return list, nil
+}
+
+// Remove entries named like virtual files from list.
+func (f *virtualDir) hide(list []os.FileInfo) []os.FileInfo {
+	out := make([]os.FileInfo, 0, len(list))
+	for _, fi := range list {
+		hidden := false
+		for _, v := range f.extra {
+			hidden = hidden || v.Name() == fi.Name()
+		}
+		if !hidden {
+			out = append(out, fi)
+		}
+	}
+	return out
+}
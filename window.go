@@ -0,0 +1,101 @@
+package ftp
+
+import "time"
+
+// A Window is a daily period in which an account may be logged in, such as
+// 08:00 to 18:00 on weekdays in Europe/Berlin.
+type Window struct {
+	// Days are the days on which the window opens, or every day if empty.
+	Days []time.Weekday
+
+	// Start and End are the offsets from midnight at which the window opens
+	// and closes. If End is not after Start, the window closes the next day.
+	Start, End time.Duration
+
+	// Location is the time zone of the window, or the server's local time
+	// zone if nil.
+	Location *time.Location
+}
+
+// Contains returns whether the window is open at t.
+func (w Window) Contains(t time.Time) bool {
+	return !w.closes(t).IsZero()
+}
+
+// Return when the window open at t closes, or the zero time if it isn't.
+func (w Window) closes(t time.Time) time.Time {
+	loc := w.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	y, m, d := t.Date()
+	// The window may have opened today or, spanning midnight, yesterday.
+	for _, day := range []int{d, d - 1} {
+		midnight := time.Date(y, m, day, 0, 0, 0, 0, loc)
+		if !w.opensOn(midnight.Weekday()) {
+			continue
+		}
+		start, end := midnight.Add(w.Start), midnight.Add(w.End)
+		if w.End <= w.Start {
+			end = time.Date(y, m, day+1, 0, 0, 0, 0, loc).Add(w.End)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+// Whether the window opens on day.
+func (w Window) opensOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Return when the last of windows open at t closes, or the zero time if none
+// is open. Windows opening as others close are not followed, so a session is
+// checked again at the returned time.
+func windowCloses(windows []Window, t time.Time) time.Time {
+	var until time.Time
+	for _, w := range windows {
+		if end := w.closes(t); end.After(until) {
+			until = end
+		}
+	}
+	return until
+}
+
+// Drain the session when its account's login windows close, if
+// WindowDrain is set.
+func (s *fileSession) watchWindow() {
+	if !s.WindowDrain || s.Account == nil || len(s.Account.Windows) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	s.windowDone = done
+	go func() {
+		for {
+			now := s.Server.now()
+			until := windowCloses(s.Account.Windows, now)
+			if until.IsZero() {
+				s.Drain()
+				return
+			}
+			t := time.NewTimer(until.Sub(now))
+			select {
+			case <-t.C:
+			case <-done:
+				t.Stop()
+				return
+			}
+		}
+	}()
+}